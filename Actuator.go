@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Actuator switches a load, like Inverter abstracts the source of the power
+// data.
+type Actuator interface {
+	SwitchOn() error
+	SwitchOff() error
+	IsOn() (bool, error)
+}
+
+// PowerMeter is implemented by actuators that measure the power drawn by
+// their load.
+type PowerMeter interface {
+	// GetPower returns the current power of the load in W
+	GetPower() (float64, error)
+}
+
+// Dimmer is implemented by actuators of dimmable loads.
+type Dimmer interface {
+	// SetLevel switches the load on with a brightness level between
+	// models.MinBrightness and models.MaxBrightness
+	SetLevel(level int) error
+	// Level returns the brightness level, 0 if the load is off
+	Level() (int, error)
+}
+
+// ReachabilityReporter is implemented by actuators whose gateway knows whether
+// the device can be reached. deconz accepts commands for Zigbee plugs that are
+// out of range, so a successful command does not mean the plug was switched.
+type ReachabilityReporter interface {
+	IsReachable() (bool, error)
+}
+
+// ErrActuatorUnreachable is returned when the device of a load is reported as
+// unreachable or does not answer.
+var ErrActuatorUnreachable = errors.New("actuator unreachable")
+
+// Status of a load whose commands keep failing although it is reachable
+const errSwitchFailing = "switching failed"
+
+// Polls in a row the monitoring sends a command that fails, after that the
+// load is reported as failed and the command is not sent again until the
+// decision changes or the load is reachable again
+const switchAttempts = 3
+
+// ErrSwitchGivenUp is the outcome of a command that is not sent any more, as
+// it has failed switchAttempts times in a row.
+var ErrSwitchGivenUp = fmt.Errorf("the command failed %d times in a row, it is not sent again", switchAttempts)
+
+// IsActuatorReachable reports whether the device of the actuator can be
+// reached. Actuators without ReachabilityReporter are reachable when they
+// answer.
+func IsActuatorReachable(actuator Actuator) bool {
+	if reporter, ok := actuator.(ReachabilityReporter); ok {
+		reachable, err := reporter.IsReachable()
+		return err == nil && reachable
+	}
+	_, err := actuator.IsOn()
+	return err == nil
+}
+
+// SwitchVerified switches the load on or off and reads back its state to
+// verify the command. Commands to an unreachable device are not sent and the
+// device has to be reachable after the command. There is a single attempt, so
+// a dead device does not block the caller.
+func SwitchVerified(actuator Actuator, on bool) error {
+	return applyVerified(actuator, func() error {
+		if on {
+			return actuator.SwitchOn()
+		}
+		return actuator.SwitchOff()
+	}, func() (bool, error) {
+		isOn, err := actuator.IsOn()
+		return isOn == on, err
+	})
+}
+
+// SetLevelVerified sets the brightness level of a dimmable load like
+// SwitchVerified switches it.
+func SetLevelVerified(actuator Actuator, level int) error {
+	dimmer, ok := actuator.(Dimmer)
+	if !ok {
+		return errors.New("load is not dimmable")
+	}
+	return applyVerified(actuator, func() error {
+		return dimmer.SetLevel(level)
+	}, func() (bool, error) {
+		current, err := dimmer.Level()
+		return current == level, err
+	})
+}
+
+func applyVerified(actuator Actuator, apply func() error, applied func() (bool, error)) error {
+	if !IsActuatorReachable(actuator) {
+		return ErrActuatorUnreachable
+	}
+	err := apply()
+	if err != nil {
+		return err
+	}
+	// deconz accepts commands for plugs that have just dropped out of range
+	if !IsActuatorReachable(actuator) {
+		return ErrActuatorUnreachable
+	}
+	ok, err := applied()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the state read back differs from the command")
+	}
+	return nil
+}
+
+// NewActuator creates the actuator of the backend configured for the load.
+func NewActuator(load models.Load, conbeeClient *ConbeeClient) (Actuator, error) {
+	switch load.BackendOrDefault() {
+	case models.ActuatorBackendDeconz:
+		if conbeeClient == nil {
+			return nil, errors.New("conbee client is nil")
+		}
+		if load.Group != "" {
+			return NewDeconzGroupActuator(conbeeClient, load.Group, load.Scene), nil
+		}
+		return NewDeconzActuator(conbeeClient, load.Light, load.UniqueID), nil
+	case models.ActuatorBackendShelly:
+		return NewShellyActuator(load), nil
+	case models.ActuatorBackendShellyGen2:
+		return NewShellyGen2Actuator(load), nil
+	case models.ActuatorBackendTasmota:
+		return NewTasmotaActuator(load), nil
+	default:
+		return nil, fmt.Errorf("unknown actuator backend %q of load %s", load.Backend, load.Name)
+	}
+}
+
+// DeconzActuator switches a light or plug of the deconz gateway. It is found
+// by its uniqueid if known, otherwise by its name, and resolved to the current
+// id of the light on every call.
+type DeconzActuator struct {
+	client   *ConbeeClient
+	light    string
+	uniqueID string
+}
+
+func NewDeconzActuator(client *ConbeeClient, light string, uniqueID string) *DeconzActuator {
+	return &DeconzActuator{
+		client:   client,
+		light:    light,
+		uniqueID: uniqueID,
+	}
+}
+
+func (a *DeconzActuator) find() (string, models.Light, error) {
+	return a.client.FindLight(a.light, a.uniqueID)
+}
+
+func (a *DeconzActuator) setState(state string) error {
+	id, light, err := a.find()
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Setting state of light %s (%s) to %s", light.Name, id, state)
+	return a.client.SetLightState(id, state)
+}
+
+func (a *DeconzActuator) SwitchOn() error {
+	return a.setState(`{"on":true}`)
+}
+
+func (a *DeconzActuator) SwitchOff() error {
+	return a.setState(`{"on":false}`)
+}
+
+func (a *DeconzActuator) IsOn() (bool, error) {
+	_, light, err := a.find()
+	return light.State.On, err
+}
+
+func (a *DeconzActuator) SetLevel(level int) error {
+	return a.setState(fmt.Sprintf(`{"on":true,"bri":%d}`, level))
+}
+
+func (a *DeconzActuator) Level() (int, error) {
+	_, light, err := a.find()
+	if err != nil || !light.State.On {
+		return 0, err
+	}
+	return light.State.Bri, nil
+}
+
+func (a *DeconzActuator) IsReachable() (bool, error) {
+	_, light, err := a.find()
+	return light.State.Reachable, err
+}
+
+// GetPower reads the ZHAPower or ZHAConsumption sensor of the plug, if it has
+// one.
+func (a *DeconzActuator) GetPower() (float64, error) {
+	_, light, err := a.find()
+	if err != nil {
+		return 0, err
+	}
+	return a.client.GetDevicePower(light.UniqueID)
+}
+
+// DeconzGroupActuator switches the lights of a deconz group together. If a
+// scene is configured, it is recalled to switch the load on.
+type DeconzGroupActuator struct {
+	client *ConbeeClient
+	group  string
+	scene  string
+}
+
+func NewDeconzGroupActuator(client *ConbeeClient, group string, scene string) *DeconzGroupActuator {
+	return &DeconzGroupActuator{
+		client: client,
+		group:  group,
+		scene:  scene,
+	}
+}
+
+func (a *DeconzGroupActuator) SwitchOn() error {
+	if a.scene != "" {
+		return a.client.RecallScene(a.group, a.scene)
+	}
+	return a.client.SetGroupOn(a.group, true)
+}
+
+func (a *DeconzGroupActuator) SwitchOff() error {
+	return a.client.SetGroupOn(a.group, false)
+}
+
+// IsOn reports whether any light of the group is on, so a partly switched
+// group is still switched off when the surplus is gone.
+func (a *DeconzGroupActuator) IsOn() (bool, error) {
+	_, group, err := a.client.GetGroupByName(a.group)
+	if err != nil {
+		return false, err
+	}
+	return group.State.AnyOn, nil
+}
+
+// IsReachable reports whether all lights of the group are reachable, a group
+// that is switched only partly would draw less than expected.
+func (a *DeconzGroupActuator) IsReachable() (bool, error) {
+	lights, err := a.client.GetGroupLights(a.group)
+	if err != nil {
+		return false, err
+	}
+	for _, light := range lights {
+		if !light.State.Reachable {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (a *DeconzGroupActuator) SetLevel(level int) error {
+	return a.client.SetGroupBrightness(a.group, level)
+}
+
+func (a *DeconzGroupActuator) Level() (int, error) {
+	_, group, err := a.client.GetGroupByName(a.group)
+	if err != nil {
+		return 0, err
+	}
+	if !group.State.AnyOn {
+		return 0, nil
+	}
+	return group.Action.Bri, nil
+}
+
+// GetPower returns the sum of the power measured by the plugs of the group.
+func (a *DeconzGroupActuator) GetPower() (float64, error) {
+	return a.client.GetGroupPower(a.group)
+}
+
+// relayLightTypes are the types of the HTTP relays in the list of lights.
+var relayLightTypes = map[string]string{
+	models.ActuatorBackendShelly:     "Shelly relay",
+	models.ActuatorBackendShellyGen2: "Shelly Gen2 relay",
+	models.ActuatorBackendTasmota:    "Tasmota relay",
+}
+
+// GetLights returns the lights of the deconz gateway together with the loads
+// switched by Shelly and Tasmota relays. The relays are listed with the id
+// <backend>:<load name>, their name is the name of the load and unreachable
+// relays are marked as such.
+func GetLights(properties *models.Properties, conbeeClient *ConbeeClient) (map[string]models.Light, *models.RestErrorResponse, error) {
+	lights := make(map[string]models.Light)
+	if conbeeClient != nil {
+		deconzLights, restErrResp, err := conbeeClient.GetLights()
+		if err != nil || restErrResp != nil {
+			return nil, restErrResp, err
+		}
+		for id, light := range deconzLights {
+			lights[id] = light
+		}
+	}
+	for _, load := range properties.SwitchedLoads() {
+		if !load.IsHttpRelay() {
+			continue
+		}
+		light := models.Light{
+			Name:     load.Name,
+			Type:     relayLightTypes[load.Backend],
+			UniqueID: fmt.Sprintf("%s/%d", load.Address, load.Channel),
+		}
+		actuator, err := NewActuator(load, conbeeClient)
+		if err == nil {
+			light.State.On, err = actuator.IsOn()
+			light.State.Reachable = err == nil
+		}
+		lights[load.Backend+":"+load.Name] = light
+	}
+	return lights, nil, nil
+}
+
+// NewLightActuator returns the actuator of a light by its name as listed by
+// GetLights: a load switched by a relay or a deconz light. The light of a
+// configured load is found by its uniqueid, so it can be switched by the
+// configured name after it has been renamed.
+func NewLightActuator(properties *models.Properties, conbeeClient *ConbeeClient, name string) (Actuator, error) {
+	load, ok := FindLightLoad(properties, name)
+	if ok && load.IsHttpRelay() {
+		return NewActuator(load, conbeeClient)
+	}
+	if conbeeClient == nil {
+		return nil, errors.New("conbee client is nil")
+	}
+	return NewDeconzActuator(conbeeClient, name, load.UniqueID), nil
+}
+
+// FindLightLoad returns the switched load of a light by its name as listed by
+// GetLights.
+func FindLightLoad(properties *models.Properties, name string) (models.Load, bool) {
+	if load, ok := properties.FindLoad(name); ok && load.IsHttpRelay() {
+		return load, true
+	}
+	for _, load := range properties.SwitchedLoads() {
+		if load.BackendOrDefault() == models.ActuatorBackendDeconz && load.Group == "" && load.Light == name {
+			return load, true
+		}
+	}
+	return models.Load{}, false
+}
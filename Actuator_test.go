@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDeconz is a deconz gateway with a fixed set of lights.
+type fakeDeconz struct {
+	*httptest.Server
+	apiKey  string
+	mutex   sync.Mutex
+	lights  map[string]models.Light
+	sensors map[string]models.Sensor
+	groups  map[string]models.Group
+	scenes  map[string]map[string]models.Scene
+	// Scenes that have been recalled as <group id>/<scene id>
+	recalled []string
+}
+
+func newFakeDeconz(t *testing.T, lights map[string]models.Light) *fakeDeconz {
+	fake := &fakeDeconz{apiKey: "key", lights: lights}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeDeconz) client() *ConbeeClient {
+	return NewConbeeClient("", "", strings.TrimPrefix(f.URL, "http://"), f.apiKey)
+}
+
+func (f *fakeDeconz) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prefix := "/api/" + f.apiKey + "/lights"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == prefix:
+		json.NewEncoder(w).Encode(f.lights)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/"+f.apiKey+"/sensors":
+		json.NewEncoder(w).Encode(f.sensors)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, prefix+"/") && strings.HasSuffix(r.URL.Path, "/state"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix+"/"), "/state")
+		light, ok := f.lights[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var state map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&state)
+		if on, ok := state["on"].(bool); ok {
+			light.State.On = on
+		}
+		if bri, ok := state["bri"].(float64); ok {
+			light.State.Bri = int(bri)
+		}
+		f.lights[id] = light
+		w.Write([]byte(`[{"success":{}}]`))
+	case strings.HasPrefix(r.URL.Path, "/api/"+f.apiKey+"/groups"):
+		f.handleGroups(w, r, strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"+f.apiKey+"/groups"), "/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handleGroups handles /groups, /groups/<id>/action, /groups/<id>/scenes and
+// /groups/<id>/scenes/<id>/recall, path holds the parts after /groups.
+func (f *fakeDeconz) handleGroups(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1:
+		groups := make(map[string]models.Group)
+		for id, group := range f.groups {
+			group.State = models.GroupState{AllOn: true}
+			for _, lightId := range group.Lights {
+				on := f.lights[lightId].State.On
+				group.State.AnyOn = group.State.AnyOn || on
+				group.State.AllOn = group.State.AllOn && on
+			}
+			groups[id] = group
+		}
+		json.NewEncoder(w).Encode(groups)
+	case r.Method == http.MethodGet && len(path) == 3 && path[2] == "scenes":
+		json.NewEncoder(w).Encode(f.scenes[path[1]])
+	case r.Method == http.MethodPut && len(path) == 3 && path[2] == "action":
+		var action map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&action)
+		on, _ := action["on"].(bool)
+		f.setGroupLights(path[1], on)
+		w.Write([]byte(`[{"success":{}}]`))
+	case r.Method == http.MethodPut && len(path) == 5 && path[4] == "recall":
+		if _, ok := f.scenes[path[1]][path[3]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.recalled = append(f.recalled, path[1]+"/"+path[3])
+		f.setGroupLights(path[1], true)
+		w.Write([]byte(`[{"success":{}}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeDeconz) setGroupLights(groupId string, on bool) {
+	for _, lightId := range f.groups[groupId].Lights {
+		light := f.lights[lightId]
+		light.State.On = on
+		f.lights[lightId] = light
+	}
+}
+
+func TestDeconzActuator(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Heating rod"},
+		"2": {Name: "Lamp"},
+	})
+	actuator, err := NewActuator(models.Load{Name: "boiler", Light: "Heating rod"}, fake.client())
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: Switch on
+	err = actuator.SwitchOn()
+	if err != nil {
+		t.Errorf("Test case 1: Expected nil error but got %v", err)
+	}
+	on, err := actuator.IsOn()
+	if err != nil || !on {
+		t.Errorf("Test case 1: Expected the load to be on but got %t, %v", on, err)
+	}
+	if fake.lights["2"].State.On {
+		t.Error("Test case 1: Expected other lights to stay off")
+	}
+
+	// Test case 2: Switch off
+	err = actuator.SwitchOff()
+	if err != nil {
+		t.Errorf("Test case 2: Expected nil error but got %v", err)
+	}
+	on, err = actuator.IsOn()
+	if err != nil || on {
+		t.Errorf("Test case 2: Expected the load to be off but got %t, %v", on, err)
+	}
+
+	// Test case 3: Unknown backend
+	_, err = NewActuator(models.Load{Name: "boiler", Backend: "unknown"}, fake.client())
+	if err == nil {
+		t.Error("Test case 3: Expected an error for an unknown backend")
+	}
+}
+
+func TestDeconzActuatorLevel(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{"1": {Name: "Heater"}})
+	actuator := NewDeconzActuator(fake.client(), "Heater", "")
+
+	// Test case 1: Setting a level switches the light on
+	err := actuator.SetLevel(128)
+	if err != nil {
+		t.Errorf("Test case 1: Expected nil error but got %v", err)
+	}
+	level, err := actuator.Level()
+	if err != nil || level != 128 || !fake.lights["1"].State.On {
+		t.Errorf("Test case 1: Expected level 128 but got %d, %v", level, err)
+	}
+
+	// Test case 2: The level of a light that is off is 0
+	err = actuator.SwitchOff()
+	if err != nil {
+		t.Errorf("Test case 2: Expected nil error but got %v", err)
+	}
+	level, err = actuator.Level()
+	if err != nil || level != 0 {
+		t.Errorf("Test case 2: Expected level 0 but got %d, %v", level, err)
+	}
+}
+
+func TestDeconzActuatorPower(t *testing.T) {
+	power := 1830.0
+	consumption := 52000.0
+	otherPower := 12.0
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Heating rod", UniqueID: "00:0d:6f:ff:fe:01:02:03-01"},
+		"2": {Name: "Lamp", UniqueID: "00:0d:6f:ff:fe:0a:0b:0c-01"},
+	})
+	fake.sensors = map[string]models.Sensor{
+		"5": {Name: "Consumption 5", Type: models.SensorTypeConsumption, UniqueID: "00:0d:6f:ff:fe:01:02:03-01-0702",
+			State: models.SensorState{Consumption: &consumption}},
+		"6": {Name: "Power 6", Type: models.SensorTypePower, UniqueID: "00:0d:6f:ff:fe:01:02:03-01-0b04",
+			State: models.SensorState{Power: &power}},
+		"7": {Name: "Power 7", Type: models.SensorTypePower, UniqueID: "00:0d:6f:ff:fe:99:99:99-01-0b04",
+			State: models.SensorState{Power: &otherPower}},
+	}
+
+	// Test case 1: Plug with a power sensor
+	actuator := NewDeconzActuator(fake.client(), "Heating rod", "")
+	measured, err := actuator.GetPower()
+	if err != nil || measured != power {
+		t.Errorf("Test case 1: Expected %f W but got %f, %v", power, measured, err)
+	}
+
+	// Test case 2: Light without a power sensor
+	_, err = NewDeconzActuator(fake.client(), "Lamp", "").GetPower()
+	if err == nil {
+		t.Error("Test case 2: Expected an error for a light without power sensor")
+	}
+}
+
+func TestDeconzGroupActuator(t *testing.T) {
+	power := 900.0
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Boiler left", UniqueID: "00:0d:6f:ff:fe:01:02:03-01"},
+		"2": {Name: "Boiler right", UniqueID: "00:0d:6f:ff:fe:04:05:06-01"},
+		"3": {Name: "Lamp"},
+	})
+	fake.sensors = map[string]models.Sensor{
+		"5": {Type: models.SensorTypePower, UniqueID: "00:0d:6f:ff:fe:01:02:03-01-0b04", State: models.SensorState{Power: &power}},
+		"6": {Type: models.SensorTypePower, UniqueID: "00:0d:6f:ff:fe:04:05:06-01-0b04", State: models.SensorState{Power: &power}},
+	}
+	fake.groups = map[string]models.Group{"7": {Name: "Boiler", Lights: []string{"1", "2"}}}
+	fake.scenes = map[string]map[string]models.Scene{"7": {"1": {Name: "Full power", Lights: []string{"1", "2"}}}}
+
+	// Test case 1: Group action
+	actuator, err := NewActuator(models.Load{Name: "boiler", Group: "Boiler"}, fake.client())
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	err = actuator.SwitchOn()
+	if err != nil {
+		t.Errorf("Test case 1: Expected nil error but got %v", err)
+	}
+	if !fake.lights["1"].State.On || !fake.lights["2"].State.On || fake.lights["3"].State.On {
+		t.Errorf("Test case 1: Expected only the lights of the group to be on but got %v", fake.lights)
+	}
+	on, err := actuator.IsOn()
+	if err != nil || !on {
+		t.Errorf("Test case 1: Expected the group to be on but got %t, %v", on, err)
+	}
+	measured, err := actuator.(PowerMeter).GetPower()
+	if err != nil || measured != 2*power {
+		t.Errorf("Test case 1: Expected %f W but got %f, %v", 2*power, measured, err)
+	}
+	err = actuator.SwitchOff()
+	if err != nil || fake.lights["1"].State.On || fake.lights["2"].State.On {
+		t.Errorf("Test case 1: Expected the lights of the group to be off but got %v, %v", fake.lights, err)
+	}
+
+	// Test case 2: Scene recall
+	actuator, err = NewActuator(models.Load{Name: "boiler", Group: "Boiler", Scene: "Full power"}, fake.client())
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	err = actuator.SwitchOn()
+	if err != nil || len(fake.recalled) != 1 || fake.recalled[0] != "7/1" {
+		t.Errorf("Test case 2: Expected scene 7/1 to be recalled but got %v, %v", fake.recalled, err)
+	}
+
+	// Test case 3: Unknown scene
+	actuator, _ = NewActuator(models.Load{Name: "boiler", Group: "Boiler", Scene: "Unknown"}, fake.client())
+	if err = actuator.SwitchOn(); err == nil {
+		t.Error("Test case 3: Expected an error for an unknown scene")
+	}
+
+	// Test case 4: A scene name used twice in the group is an error and no scene is recalled
+	fake.scenes["7"]["2"] = models.Scene{Name: "Full power"}
+	actuator, _ = NewActuator(models.Load{Name: "boiler", Group: "Boiler", Scene: "Full power"}, fake.client())
+	if err = actuator.SwitchOn(); err == nil || !strings.Contains(err.Error(), "1, 2") || len(fake.recalled) != 1 {
+		t.Errorf("Test case 4: Expected an error naming the scenes 1 and 2 but got %v, %v", err, fake.recalled)
+	}
+
+	// Test case 5: A group name used twice is an error and nothing is switched
+	fake.setGroupLights("7", false)
+	fake.groups["8"] = models.Group{Name: "Boiler", Lights: []string{"3"}}
+	actuator, _ = NewActuator(models.Load{Name: "boiler", Group: "Boiler"}, fake.client())
+	if err = actuator.SwitchOn(); err == nil || !strings.Contains(err.Error(), "7, 8") {
+		t.Errorf("Test case 5: Expected an error naming the groups 7 and 8 but got %v", err)
+	}
+	if fake.lights["1"].State.On || fake.lights["3"].State.On {
+		t.Errorf("Test case 5: Expected the lights to stay off but got %v", fake.lights)
+	}
+}
+
+func TestDeconzActuatorUniqueId(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Plug", UniqueID: "00:0d:6f:ff:fe:01:02:03-01"},
+		"2": {Name: "Plug", UniqueID: "00:0d:6f:ff:fe:04:05:06-01"},
+	})
+
+	// Test case 1: A name used twice is an error and nothing is switched
+	err := NewDeconzActuator(fake.client(), "Plug", "").SwitchOn()
+	if err == nil || !strings.Contains(err.Error(), "1, 2") {
+		t.Errorf("Test case 1: Expected an error naming the lights 1 and 2 but got %v", err)
+	}
+	if fake.lights["1"].State.On || fake.lights["2"].State.On {
+		t.Error("Test case 1: Expected the lights to stay off")
+	}
+
+	// Test case 2: The uniqueid selects the light, even after it is renamed
+	fake.lights["2"] = models.Light{Name: "Renamed", UniqueID: "00:0d:6f:ff:fe:04:05:06-01"}
+	err = NewDeconzActuator(fake.client(), "Plug", "00:0d:6f:ff:fe:04:05:06-01").SwitchOn()
+	if err != nil || fake.lights["1"].State.On || !fake.lights["2"].State.On {
+		t.Errorf("Test case 2: Expected only light 2 to be on but got %v, %v", fake.lights, err)
+	}
+
+	// Test case 3: Errors of the lookup are returned
+	err = fake.client().SwitchOnLight("Unknown")
+	if err == nil {
+		t.Error("Test case 3: Expected an error for an unknown light")
+	}
+}
+
+func TestResolveLightUniqueIds(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Heating rod", UniqueID: "00:0d:6f:ff:fe:01:02:03-01"},
+		"2": {Name: "Twin", UniqueID: "00:0d:6f:ff:fe:04:05:06-01"},
+		"3": {Name: "Twin", UniqueID: "00:0d:6f:ff:fe:07:08:09-01"},
+	})
+	properties := &models.Properties{
+		PlugName: "Heating rod",
+		Loads: []models.Load{
+			{Name: "twin", Light: "Twin"},
+			{Name: "pump", Backend: models.ActuatorBackendTasmota, Address: "192.168.1.41"},
+		},
+	}
+
+	// Test case 1: The plug is migrated, the ambiguous name is left as it is
+	changed, err := resolveLightUniqueIds(properties, fake.client())
+	if err != nil || !changed {
+		t.Errorf("Test case 1: Expected a change but got %t, %v", changed, err)
+	}
+	if properties.PlugUniqueId != "00:0d:6f:ff:fe:01:02:03-01" || properties.Loads[0].UniqueID != "" {
+		t.Errorf("Test case 1: Expected only the uniqueid of the plug but got %v", properties)
+	}
+
+	// Test case 2: Nothing left to resolve
+	changed, err = resolveLightUniqueIds(properties, fake.client())
+	if err != nil || changed {
+		t.Errorf("Test case 2: Expected no change but got %t, %v", changed, err)
+	}
+}
+
+// stuckActuator accepts every command but never changes its state.
+type stuckActuator struct {
+	commands int
+}
+
+func (a *stuckActuator) SwitchOn() error {
+	a.commands++
+	return nil
+}
+
+func (a *stuckActuator) SwitchOff() error {
+	a.commands++
+	return nil
+}
+
+func (a *stuckActuator) IsOn() (bool, error) {
+	return false, nil
+}
+
+// droppingActuator drops out of range with the first command.
+type droppingActuator struct {
+	stuckActuator
+}
+
+func (a *droppingActuator) IsReachable() (bool, error) {
+	return a.commands == 0, nil
+}
+
+func TestSwitchVerified(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{
+		"1": {Name: "Heating rod", State: models.State{Reachable: false}},
+		"2": {Name: "Pump", State: models.State{Reachable: true}},
+	})
+
+	// Test case 1: Commands to an unreachable plug are not sent
+	err := SwitchVerified(NewDeconzActuator(fake.client(), "Heating rod", ""), true)
+	if !errors.Is(err, ErrActuatorUnreachable) || fake.lights["1"].State.On {
+		t.Errorf("Test case 1: Expected %v but got %v", ErrActuatorUnreachable, err)
+	}
+
+	// Test case 2: Reachable plug
+	err = SwitchVerified(NewDeconzActuator(fake.client(), "Pump", ""), true)
+	if err != nil || !fake.lights["2"].State.On {
+		t.Errorf("Test case 2: Expected the plug to be on but got %v", err)
+	}
+
+	// Test case 3: A command without effect is reported without waiting for a retry
+	stuck := &stuckActuator{}
+	err = SwitchVerified(stuck, true)
+	if err == nil || stuck.commands != 1 {
+		t.Errorf("Test case 3: Expected an error after 1 command but got %d, %v", stuck.commands, err)
+	}
+
+	// Test case 4: A device that is unreachable after the command is reported as such
+	err = SwitchVerified(&droppingActuator{}, true)
+	if !errors.Is(err, ErrActuatorUnreachable) {
+		t.Errorf("Test case 4: Expected %v but got %v", ErrActuatorUnreachable, err)
+	}
+}
+
+func TestApplyDecisionsRetry(t *testing.T) {
+	load := models.Load{Name: "Pump"}
+	properties := models.Properties{Loads: []models.Load{load}}
+	stuck := &stuckActuator{}
+	m := &MonitoringController{
+		actuators:      map[string]loadActuator{load.Name: {load: load, actuator: stuck}},
+		unreachable:    make(map[string]bool),
+		switchFailures: make(map[string]switchFailure),
+	}
+	on := []SwitchDecision{{Load: load.Name, Action: SwitchActionOn}}
+
+	// Test case 1: A failed command is sent once per poll and not reported as failing yet
+	m.applyDecisions(on, properties)
+	if stuck.commands != 1 || m.switchFailing(load.Name) {
+		t.Errorf("Test case 1: Expected 1 command and no failure but got %d, %v", stuck.commands, m.switchFailing(load.Name))
+	}
+
+	// Test case 2: The load is failing after switchAttempts polls
+	for i := 1; i < switchAttempts; i++ {
+		m.applyDecisions(on, properties)
+	}
+	if stuck.commands != switchAttempts || !m.switchFailing(load.Name) {
+		t.Errorf("Test case 2: Expected %d commands and a failure but got %d, %v", switchAttempts, stuck.commands, m.switchFailing(load.Name))
+	}
+
+	// Test case 3: After switchAttempts polls the command is not sent again
+	outcome, _ := m.applyDecisions(on, properties)
+	if stuck.commands != switchAttempts || !errors.Is(outcome[load.Name], ErrSwitchGivenUp) {
+		t.Errorf("Test case 3: Expected no further command but got %d, %v", stuck.commands, outcome)
+	}
+
+	// Test case 4: A changed decision is sent again
+	off := []SwitchDecision{{Load: load.Name, Action: SwitchActionOff}}
+	m.applyDecisions(off, properties)
+	if stuck.commands != switchAttempts+1 || m.switchFailing(load.Name) {
+		t.Errorf("Test case 4: Expected the new command to be sent but got %d, %v", stuck.commands, m.switchFailing(load.Name))
+	}
+
+	// Test case 5: A load that is reachable again gets the command again
+	for i := 1; i < switchAttempts; i++ {
+		m.applyDecisions(off, properties)
+	}
+	m.setReachable(load.Name, false)
+	m.setReachable(load.Name, true)
+	m.applyDecisions(off, properties)
+	if stuck.commands != 2*switchAttempts+1 {
+		t.Errorf("Test case 5: Expected the command to be sent again but got %d commands", stuck.commands)
+	}
+
+	// Test case 6: The failures are forgotten once no command is due
+	m.applyDecisions([]SwitchDecision{{Load: load.Name, Action: SwitchActionNone}}, properties)
+	if m.switchFailing(load.Name) {
+		t.Errorf("Test case 6: Expected no failure after a decision without command")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BacktestParameters is one parameter set that is evaluated by a backtest.
+type BacktestParameters struct {
+	Threshold    float64
+	PollDuration int
+	// Power drawn by the plug while it is on in W
+	LoadPower float64
+}
+
+type BacktestResult struct {
+	Parameters BacktestParameters
+	// Number of times the plug changed its state
+	Switches int
+	// Time the plug was on
+	OnTime time.Duration
+	// Energy consumed by the plug in kWh
+	DivertedEnergy float64
+	// Energy taken from the grid by the whole house in kWh
+	GridEnergy float64
+}
+
+// fakePlug stands in for the ZigBee plug during a backtest.
+type fakePlug struct {
+	on       bool
+	switches int
+}
+
+func (p *fakePlug) apply(action SwitchAction) {
+	switch action {
+	case SwitchActionOn:
+		if !p.on {
+			p.on = true
+			p.switches++
+		}
+	case SwitchActionOff:
+		if p.on {
+			p.on = false
+			p.switches++
+		}
+	}
+}
+
+// RunBacktest runs the switching logic of the monitoring controller over a
+// recording with a virtual clock. The recording is expected to not contain the
+// consumption of the plug, so the load power is added while the plug is on.
+func RunBacktest(samples []RecordedSample, parameters BacktestParameters) (BacktestResult, error) {
+	result := BacktestResult{Parameters: parameters}
+	if len(samples) == 0 {
+		return result, fmt.Errorf("no samples to run the backtest on")
+	}
+	if parameters.PollDuration <= 0 {
+		return result, fmt.Errorf("poll duration must be positive")
+	}
+
+	clock := NewVirtualClock(samples[0].Timestamp)
+	inverter := NewReplayInverterFromSamples(samples, clock)
+	err := inverter.Connect()
+	if err != nil {
+		return result, err
+	}
+	properties := models.Properties{
+		Threshold:    parameters.Threshold,
+		PollDuration: parameters.PollDuration,
+	}
+	plug := &fakePlug{}
+
+	step := time.Duration(parameters.PollDuration) * time.Second
+	end := samples[len(samples)-1].Timestamp
+	for now := clock.Now(); !now.After(end); now = clock.Now() {
+		recorded, err := inverter.GetInverterData()
+		if err != nil {
+			return result, err
+		}
+		inputs := []LoadInput{{Load: models.Load{Name: models.DefaultLoadName}, On: plug.on, Power: &parameters.LoadPower}}
+		plug.apply(DecideLoads(withPlugLoad(recorded, plug.on, parameters.LoadPower), inputs, properties)[0].Action)
+
+		// The new state of the plug lasts until the next tick
+		data := withPlugLoad(recorded, plug.on, parameters.LoadPower)
+		if plug.on {
+			result.OnTime += step
+			result.DivertedEnergy += parameters.LoadPower * step.Hours() / 1000
+		}
+		if data.Overproduction < 0 {
+			result.GridEnergy += -data.Overproduction * step.Hours() / 1000
+		}
+		clock.Advance(step)
+	}
+	result.Switches = plug.switches
+	return result, nil
+}
+
+// withPlugLoad adds the consumption of the plug to a recorded sample.
+func withPlugLoad(data InverterData, plugOn bool, loadPower float64) InverterData {
+	if plugOn {
+		data.HousePowerConsumption += loadPower
+		data.Overproduction -= loadPower
+	}
+	return data
+}
+
+func parseFloatList(value string) ([]float64, error) {
+	var values []float64
+	for _, item := range strings.Split(value, ",") {
+		float, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, float)
+	}
+	return values, nil
+}
+
+func parseIntList(value string) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(value, ",") {
+		integer, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, integer)
+	}
+	return values, nil
+}
+
+// runBacktestCommand implements "backtest -recording file.csv -threshold 500,1000 -poll 10,60".
+// Every combination of the given thresholds and poll durations is evaluated.
+func runBacktestCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	recording := flags.String("recording", "", "CSV or JSON recording of inverter samples")
+	thresholds := flags.String("threshold", "1000", "comma separated list of thresholds in W")
+	pollDurations := flags.String("poll", "10", "comma separated list of poll durations in seconds")
+	loadPower := flags.Float64("load", 0, "power drawn by the plug in W, defaults to the threshold")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *recording == "" {
+		flags.Usage()
+		return fmt.Errorf("no recording given")
+	}
+
+	thresholdList, err := parseFloatList(*thresholds)
+	if err != nil {
+		return fmt.Errorf("invalid threshold list: %v", err)
+	}
+	pollDurationList, err := parseIntList(*pollDurations)
+	if err != nil {
+		return fmt.Errorf("invalid poll duration list: %v", err)
+	}
+
+	samples, err := LoadRecording(*recording)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Recording: %d samples from %s to %s\n\n", len(samples),
+		samples[0].Timestamp.Format(time.RFC3339), samples[len(samples)-1].Timestamp.Format(time.RFC3339))
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "Threshold (W)\tPoll (s)\tLoad (W)\tSwitches\tOn time\tDiverted (kWh)\tGrid (kWh)\t")
+	for _, threshold := range thresholdList {
+		for _, pollDuration := range pollDurationList {
+			parameters := BacktestParameters{
+				Threshold:    threshold,
+				PollDuration: pollDuration,
+				LoadPower:    *loadPower,
+			}
+			if parameters.LoadPower == 0 {
+				parameters.LoadPower = threshold
+			}
+			result, err := RunBacktest(samples, parameters)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(writer, "%.0f\t%d\t%.0f\t%d\t%s\t%.3f\t%.3f\t\n",
+				threshold, pollDuration, parameters.LoadPower, result.Switches,
+				result.OnTime.Round(time.Minute), result.DivertedEnergy, result.GridEnergy)
+		}
+	}
+	return writer.Flush()
+}
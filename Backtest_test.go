@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRecordingCsv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.csv")
+	content := "timestamp,HousePowerConsumption,PVPower\n" +
+		"2023-07-01T12:00:10Z,500,3000\n" +
+		"2023-07-01T12:00:00Z,400,2000\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := LoadRecording(path)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples but got %d", len(samples))
+	}
+	// Samples are sorted by time and the overproduction is calculated
+	if samples[0].PVPower != 2000 || samples[0].Overproduction != 1600 {
+		t.Errorf("Unexpected first sample %+v", samples[0])
+	}
+}
+
+func TestRunBacktest(t *testing.T) {
+	start := time.Date(2023, time.July, 1, 12, 0, 0, 0, time.UTC)
+	// One hour with 3000 W surplus followed by one hour with 500 W surplus
+	samples := []RecordedSample{
+		{Timestamp: start, InverterData: InverterData{HousePowerConsumption: 500, PVPower: 3500, Overproduction: 3000}},
+		{Timestamp: start.Add(time.Hour), InverterData: InverterData{HousePowerConsumption: 500, PVPower: 1000, Overproduction: 500}},
+		{Timestamp: start.Add(2 * time.Hour), InverterData: InverterData{HousePowerConsumption: 500, PVPower: 500, Overproduction: 0}},
+	}
+
+	result, err := RunBacktest(samples, BacktestParameters{Threshold: 2000, PollDuration: 60, LoadPower: 2000})
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	// On at the start, off on the first tick of the second hour
+	if result.Switches != 2 {
+		t.Errorf("Expected 2 switches but got %d", result.Switches)
+	}
+	if result.OnTime != time.Hour {
+		t.Errorf("Expected one hour on time but got %v", result.OnTime)
+	}
+	if result.DivertedEnergy < 1.99 || result.DivertedEnergy > 2.01 {
+		t.Errorf("Expected 2 kWh diverted energy but got %f", result.DivertedEnergy)
+	}
+	if result.GridEnergy != 0 {
+		t.Errorf("Expected no grid energy but got %f", result.GridEnergy)
+	}
+}
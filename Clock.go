@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the monitoring logic. It allows to run the
+// logic against recorded data in a backtest instead of the wall clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// VirtualClock only moves when it is told to.
+type VirtualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
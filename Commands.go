@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Command is a subcommand of the command line interface.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(args []string, out io.Writer) error
+}
+
+var commands []Command
+
+func init() {
+	commands = []Command{
+		{Name: "run", Usage: "run", Description: "Start the web interface and the monitoring (default)", Run: runCommandRun},
+		{Name: "discover", Usage: "discover", Description: "Find deconz gateways in the local network", Run: runCommandDiscover},
+		{Name: "pair", Usage: "pair [-host address] [-username name -password password]", Description: "Create a deconz API key and store it in the config", Run: runCommandPair},
+		{Name: "lights", Usage: "lights", Description: "List the lights and plugs of the deconz gateway and the Shelly and Tasmota relays", Run: runCommandLights},
+		{Name: "groups", Usage: "groups", Description: "List the groups and scenes of the deconz gateway", Run: runCommandGroups},
+		{Name: "switch", Usage: "switch <name> on|off", Description: "Switch a light or plug on or off", Run: runCommandSwitch},
+		{Name: "inverter", Usage: "inverter read [-json]", Description: "Print the current inverter data", Run: runCommandInverter},
+		{Name: "config", Usage: "config get [key] | set <key> <value> | export [-password p] [-out file] | import [-password p] [-dry-run] <file>", Description: "Show, change, export or import the configuration", Run: runCommandConfig},
+		{Name: "backtest", Usage: "backtest -recording file [-threshold list] [-poll list] [-load watt]", Description: "Run the switching logic over a recording", Run: runBacktestCommand},
+		{Name: "help", Usage: "help", Description: "Show this help", Run: runCommandHelp},
+	}
+}
+
+// RunCommand executes the subcommand given by the first argument. Without
+// arguments the server is started.
+func RunCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return runCommandRun(args, out)
+	}
+	for _, command := range commands {
+		if command.Name == args[0] {
+			if command.Name != "run" && os.Getenv("DEBUG") != "true" {
+				// Keep the output of the command readable
+				zerolog.SetGlobalLevel(zerolog.WarnLevel)
+			}
+			return command.Run(args[1:], out)
+		}
+	}
+	runCommandHelp(nil, out)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runCommandHelp(args []string, out io.Writer) error {
+	fmt.Fprintf(out, "%s %s\n\nUsage: %s [--config path] <command>\n\nCommands:\n", AppName, AppVersion, filepath.Base(os.Args[0]))
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(writer, "  %s\t%s\n", command.Usage, command.Description)
+	}
+	return writer.Flush()
+}
+
+func runCommandRun(args []string, out io.Writer) error {
+	runServer()
+	return nil
+}
+
+func runCommandDiscover(args []string, out io.Writer) error {
+	devices, err := DiscoverDeconzGateways()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no deconz gateway found")
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tADDRESS\tMAC")
+	for _, device := range devices {
+		fmt.Fprintf(writer, "%s\t%s\t%s:%d\t%s\n", device.ID, device.Name, device.InternalIPAddress, device.InternalPort, device.MACAddress)
+	}
+	return writer.Flush()
+}
+
+func runCommandPair(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("pair", flag.ContinueOnError)
+	host := flags.String("host", "", "address of the deconz gateway, discovered if empty")
+	username := flags.String("username", "", "deconz username")
+	password := flags.String("password", "", "deconz password")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	if *host != "" {
+		properties.HostAddress = *host
+	}
+	if *username != "" {
+		properties.DeconzUsername = *username
+		properties.DeconzPassword = *password
+	}
+	if properties.HostAddress == "" {
+		properties.HostAddress, err = DiscoverDeconzHostAddress()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Found deconz gateway at %s\n", properties.HostAddress)
+	}
+
+	client := NewConbeeClient(properties.DeconzUsername, properties.DeconzPassword, properties.HostAddress, "")
+	apiKey, err := client.CreateApiKey()
+	if err != nil {
+		return fmt.Errorf("could not create api key, press the Authenticate button in the deconz settings or "+
+			"provide a valid username and password: %v", err)
+	}
+	properties.ApiKey = apiKey
+	err = saveProperties(properties)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Paired with %s, API key: %s\n", properties.HostAddress, apiKey)
+	return nil
+}
+
+// newCommandConbeeClient creates a ConbeeClient from the stored configuration
+// and checks that the API key is valid.
+func newCommandConbeeClient(properties *models.Properties) (*ConbeeClient, error) {
+	if properties.HostAddress == "" {
+		return nil, fmt.Errorf("no deconz host address configured, run discover and pair first")
+	}
+	client := NewConbeeClient(properties.DeconzUsername, properties.DeconzPassword, properties.HostAddress, properties.ApiKey)
+	valid, err := client.CheckApiKey()
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, fmt.Errorf("deconz API key is not valid, run pair first")
+	}
+	return client, nil
+}
+
+// hasRelayLoads reports whether loads are switched by Shelly or Tasmota
+// relays, which work without the deconz gateway.
+func hasRelayLoads(properties *models.Properties) bool {
+	for _, load := range properties.SwitchedLoads() {
+		if load.IsHttpRelay() {
+			return true
+		}
+	}
+	return false
+}
+
+func runCommandLights(args []string, out io.Writer) error {
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	client, err := newCommandConbeeClient(properties)
+	if err != nil {
+		if !hasRelayLoads(properties) {
+			return err
+		}
+		fmt.Fprintf(out, "Skipping deconz lights: %v\n\n", err)
+		client = nil
+	}
+	lights, restErrResp, err := GetLights(properties, client)
+	if err != nil {
+		return err
+	}
+	if restErrResp != nil {
+		return fmt.Errorf("unexpected status code %d: %s", restErrResp.Code, restErrResp.Message)
+	}
+
+	ids := make([]string, 0, len(lights))
+	for id := range lights {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		if errA != nil || errB != nil {
+			return ids[i] < ids[j]
+		}
+		return a < b
+	})
+
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tTYPE\tON\tREACHABLE\tUNIQUE ID")
+	for _, id := range ids {
+		light := lights[id]
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%t\t%s\n", id, light.Name, light.Type, light.State.On, light.State.Reachable, light.UniqueID)
+	}
+	return writer.Flush()
+}
+
+func runCommandGroups(args []string, out io.Writer) error {
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	client, err := newCommandConbeeClient(properties)
+	if err != nil {
+		return err
+	}
+	groups, restErrResp, err := client.GetGroups()
+	if err != nil {
+		return err
+	}
+	if restErrResp != nil {
+		return fmt.Errorf("unexpected status code %d: %s", restErrResp.Code, restErrResp.Message)
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tLIGHTS\tANY ON\tSCENES")
+	for _, id := range ids {
+		group := groups[id]
+		scenes := make([]string, 0, len(group.Scenes))
+		for _, scene := range group.Scenes {
+			scenes = append(scenes, scene.Name)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%s\n", id, group.Name, strings.Join(group.Lights, ","),
+			group.State.AnyOn, strings.Join(scenes, ", "))
+	}
+	return writer.Flush()
+}
+
+func runCommandSwitch(args []string, out io.Writer) error {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return fmt.Errorf("usage: switch <name> on|off")
+	}
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	var client *ConbeeClient
+	if load, ok := properties.FindLoad(args[0]); !ok || !load.IsHttpRelay() {
+		client, err = newCommandConbeeClient(properties)
+		if err != nil {
+			return err
+		}
+	}
+	actuator, err := NewLightActuator(properties, client, args[0])
+	if err != nil {
+		return err
+	}
+	if args[1] == "on" {
+		err = SwitchVerified(actuator, true)
+	} else {
+		err = SwitchVerified(actuator, false)
+	}
+	if err != nil {
+		return err
+	}
+	on, err := actuator.IsOn()
+	if err != nil {
+		return err
+	}
+	if on {
+		fmt.Fprintf(out, "%s is on\n", args[0])
+	} else {
+		fmt.Fprintf(out, "%s is off\n", args[0])
+	}
+	return nil
+}
+
+func runCommandInverter(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "read" {
+		return fmt.Errorf("usage: inverter read [-json]")
+	}
+	flags := flag.NewFlagSet("inverter read", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the data as JSON")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	inverter := NewInverterClient(*properties)
+	err = inverter.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to inverter: %v", err)
+	}
+	data, err := inverter.GetInverterData()
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(writer, "House power consumption\t%.1f W\n", data.HousePowerConsumption)
+	fmt.Fprintf(writer, "PV power\t%.1f W\n", data.PVPower)
+	fmt.Fprintf(writer, "Overproduction\t%.1f W\n", data.Overproduction)
+	return writer.Flush()
+}
+
+func runCommandConfig(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: config get [key] | config set <key> <value> | config export | config import")
+	}
+	switch args[0] {
+	case "export":
+		return runConfigExport(args[1:], out)
+	case "import":
+		return runConfigImport(args[1:], out)
+	}
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	sections := properties.ToSections()
+	values := sections.Flatten()
+
+	switch args[0] {
+	case "get":
+		if len(args) == 2 {
+			value, ok := values[args[1]]
+			if !ok {
+				return fmt.Errorf("unknown config key %q", args[1])
+			}
+			fmt.Fprintln(out, value)
+			return nil
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s = %s\n", key, values[key])
+		}
+		return nil
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: config set <key> <value>")
+		}
+		_, known := values[args[1]]
+		if !known && !strings.HasPrefix(args[1], models.SectionLoadPrefix) &&
+			!strings.HasPrefix(args[1], models.SectionNotificationPrefix) {
+			return fmt.Errorf("unknown config key %q", args[1])
+		}
+		if _, ok := envOverrides[args[1]]; ok {
+			return fmt.Errorf("%s is set by the environment variable %s", args[1], models.EnvName(args[1]))
+		}
+		sections.SetFlat(args[1], args[2])
+		// Parse the values again to reject values of the wrong type
+		updated, err := models.FromSectionsWithDefaults(sections)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", args[1], err)
+		}
+		if errs := updated.Validate(); len(errs) > 0 {
+			return errs
+		}
+		return saveProperties(updated)
+	default:
+		return fmt.Errorf("usage: config get [key] | config set <key> <value> | config export | config import")
+	}
+}
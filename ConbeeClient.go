@@ -7,6 +7,7 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -122,11 +123,87 @@ func (c *ConbeeClient) GetLights() (map[string]models.Light, *models.RestErrorRe
 	return lights, nil, nil
 }
 
+func (c *ConbeeClient) GetSensors() (map[string]models.Sensor, *models.RestErrorResponse, error) {
+	log.Debug().Msg("Getting sensors")
+	response, err := c.restClient.R().Get("/api/" + c.apiKey + "/sensors")
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode() != 200 {
+		return nil, &models.RestErrorResponse{
+			Code:    response.StatusCode(),
+			Message: response.String(),
+		}, nil
+	}
+
+	var sensors map[string]models.Sensor
+	err = json.Unmarshal(response.Body(), &sensors)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sensors, nil, nil
+}
+
+// GetDevicePower returns the power drawn by the plug with the uniqueID of its
+// light, measured by the ZHAPower or ZHAConsumption sensor of the same device.
+func (c *ConbeeClient) GetDevicePower(uniqueID string) (float64, error) {
+	sensors, m, err := c.GetSensors()
+	if err != nil {
+		return 0, err
+	}
+	if m != nil {
+		return 0, fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	power := sensorPower(sensors, uniqueID)
+	if power == nil {
+		return 0, fmt.Errorf("device %s has no power sensor", models.DeviceAddress(uniqueID))
+	}
+	return *power, nil
+}
+
+// sensorPower returns the power measured by the sensors of the device of the
+// light with the uniqueID, nil if it has no power sensor. ZHAPower sensors
+// are preferred, ZHAConsumption sensors only report the power on some devices.
+func sensorPower(sensors map[string]models.Sensor, uniqueID string) *float64 {
+	address := models.DeviceAddress(uniqueID)
+	var power *float64
+	for _, sensor := range sensors {
+		if models.DeviceAddress(sensor.UniqueID) != address || sensor.State.Power == nil {
+			continue
+		}
+		if sensor.Type == models.SensorTypePower || (sensor.Type == models.SensorTypeConsumption && power == nil) {
+			power = sensor.State.Power
+		}
+	}
+	return power
+}
+
 func (c *ConbeeClient) SwitchOnLight(s string) error {
 	log.Info().Msgf("Switching on light %s", s)
 	id, err := c.GetLightIdByName(s)
+	if err != nil {
+		return err
+	}
+	return c.SetLightState(id, `{"on":true}`)
+}
+
+func (c *ConbeeClient) SwitchOffLight(s string) error {
+	log.Info().Msgf("Switching off light %s", s)
+	id, err := c.GetLightIdByName(s)
+	if err != nil {
+		return err
+	}
+	return c.SetLightState(id, `{"on":false}`)
+}
+
+// SetLightState sends the state, e.g. {"on":true,"bri":128}, to the light
+// with the id.
+func (c *ConbeeClient) SetLightState(id string, state string) error {
+	if id == "" {
+		return errors.New("light id is empty")
+	}
 	response, err := c.restClient.R().
-		SetBody(`{"on":true}`).
+		SetBody(state).
 		Put("/api/" + c.apiKey + "/lights/" + id + "/state")
 	if err != nil {
 		return err
@@ -137,12 +214,17 @@ func (c *ConbeeClient) SwitchOnLight(s string) error {
 	return nil
 }
 
-func (c *ConbeeClient) SwitchOffLight(s string) error {
-	log.Info().Msgf("Switching off light %s", s)
-	id, err := c.GetLightIdByName(s)
+// SetGroupBrightness switches the lights of a group on with the brightness
+// bri between 1 and 255.
+func (c *ConbeeClient) SetGroupBrightness(groupName string, bri int) error {
+	log.Info().Msgf("Setting brightness of group %s to %d", groupName, bri)
+	id, _, err := c.GetGroupByName(groupName)
+	if err != nil {
+		return err
+	}
 	response, err := c.restClient.R().
-		SetBody(`{"on":false}`).
-		Put("/api/" + c.apiKey + "/lights/" + id + "/state")
+		SetBody(fmt.Sprintf(`{"on":true,"bri":%d}`, bri)).
+		Put("/api/" + c.apiKey + "/groups/" + id + "/action")
 	if err != nil {
 		return err
 	}
@@ -152,47 +234,260 @@ func (c *ConbeeClient) SwitchOffLight(s string) error {
 	return nil
 }
 
-func (c *ConbeeClient) GetLightIdByName(lightName string) (string, error) {
+// FindLight returns the id and the light with the uniqueID or, if uniqueID is
+// empty, with the name. A name used by several lights is an error, as the
+// wrong plug might be switched.
+func (c *ConbeeClient) FindLight(lightName string, uniqueID string) (string, models.Light, error) {
 	lights, m, err := c.GetLights()
 	if err != nil {
-		return "", err
+		return "", models.Light{}, err
 	}
 	if m != nil {
-		return "", fmt.Errorf("unexpected status code: %d", m.Code)
+		return "", models.Light{}, fmt.Errorf("unexpected status code: %d", m.Code)
 	}
+	return findLight(lights, lightName, uniqueID)
+}
+
+func findLight(lights map[string]models.Light, lightName string, uniqueID string) (string, models.Light, error) {
+	if uniqueID != "" {
+		for id, light := range lights {
+			if light.UniqueID == uniqueID {
+				return id, light, nil
+			}
+		}
+		return "", models.Light{}, fmt.Errorf("light with uniqueid %s not found", uniqueID)
+	}
+	var ids []string
 	for id, light := range lights {
 		if light.Name == lightName {
-			return id, nil
+			ids = append(ids, id)
 		}
 	}
-	return "", fmt.Errorf("light %s not found", lightName)
+	switch len(ids) {
+	case 0:
+		return "", models.Light{}, fmt.Errorf("light %s not found", lightName)
+	case 1:
+		return ids[0], lights[ids[0]], nil
+	default:
+		sort.Strings(ids)
+		return "", models.Light{}, fmt.Errorf("light name %s is used by the lights %s, configure the uniqueid instead",
+			lightName, strings.Join(ids, ", "))
+	}
+}
+
+func (c *ConbeeClient) GetLightIdByName(lightName string) (string, error) {
+	id, _, err := c.FindLight(lightName, "")
+	return id, err
 }
 
 func (c *ConbeeClient) IsLightOn(plugName string) (bool, error) {
-	lights, m, err := c.GetLights()
+	_, light, err := c.FindLight(plugName, "")
 	if err != nil {
 		return false, err
 	}
+	return light.State.On, nil
+}
+
+func (c *ConbeeClient) GetGroups() (map[string]models.Group, *models.RestErrorResponse, error) {
+	log.Debug().Msg("Getting groups")
+	response, err := c.restClient.R().Get("/api/" + c.apiKey + "/groups")
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode() != 200 {
+		return nil, &models.RestErrorResponse{
+			Code:    response.StatusCode(),
+			Message: response.String(),
+		}, nil
+	}
+
+	var groups map[string]models.Group
+	err = json.Unmarshal(response.Body(), &groups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return groups, nil, nil
+}
+
+func (c *ConbeeClient) GetGroupScenes(groupId string) (map[string]models.Scene, *models.RestErrorResponse, error) {
+	log.Debug().Msgf("Getting scenes of group %s", groupId)
+	response, err := c.restClient.R().Get("/api/" + c.apiKey + "/groups/" + groupId + "/scenes")
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode() != 200 {
+		return nil, &models.RestErrorResponse{
+			Code:    response.StatusCode(),
+			Message: response.String(),
+		}, nil
+	}
+
+	var scenes map[string]models.Scene
+	err = json.Unmarshal(response.Body(), &scenes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return scenes, nil, nil
+}
+
+// GetGroupByName returns the id and the group with the name. A name used by
+// several groups is an error, as the wrong loads might be switched.
+func (c *ConbeeClient) GetGroupByName(groupName string) (string, models.Group, error) {
+	groups, m, err := c.GetGroups()
+	if err != nil {
+		return "", models.Group{}, err
+	}
+	if m != nil {
+		return "", models.Group{}, fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	var ids []string
+	for id, group := range groups {
+		if group.Name == groupName {
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", models.Group{}, fmt.Errorf("group %s not found", groupName)
+	case 1:
+		return ids[0], groups[ids[0]], nil
+	default:
+		sort.Strings(ids)
+		return "", models.Group{}, fmt.Errorf("group name %s is used by the groups %s, rename them in the Phoscon app",
+			groupName, strings.Join(ids, ", "))
+	}
+}
+
+// GetSceneIdByName returns the id of the scene of the group with the name. A
+// name used by several scenes of the group is an error.
+func (c *ConbeeClient) GetSceneIdByName(groupId string, sceneName string) (string, error) {
+	scenes, m, err := c.GetGroupScenes(groupId)
+	if err != nil {
+		return "", err
+	}
 	if m != nil {
-		return false, fmt.Errorf("unexpected status code: %d", m.Code)
+		return "", fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	var ids []string
+	for id, scene := range scenes {
+		if scene.Name == sceneName {
+			ids = append(ids, id)
+		}
 	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("scene %s not found", sceneName)
+	case 1:
+		return ids[0], nil
+	default:
+		sort.Strings(ids)
+		return "", fmt.Errorf("scene name %s is used by the scenes %s of group %s, rename them in the Phoscon app",
+			sceneName, strings.Join(ids, ", "), groupId)
+	}
+}
+
+// SetGroupOn switches all lights of the group on or off with a group action.
+func (c *ConbeeClient) SetGroupOn(groupName string, on bool) error {
+	log.Info().Msgf("Switching group %s on: %t", groupName, on)
+	id, _, err := c.GetGroupByName(groupName)
+	if err != nil {
+		return err
+	}
+	response, err := c.restClient.R().
+		SetBody(fmt.Sprintf(`{"on":%t}`, on)).
+		Put("/api/" + c.apiKey + "/groups/" + id + "/action")
+	if err != nil {
+		return err
+	}
+	if response.StatusCode() != 200 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode())
+	}
+	return nil
+}
+
+// RecallScene recalls a scene of a group.
+func (c *ConbeeClient) RecallScene(groupName string, sceneName string) error {
+	log.Info().Msgf("Recalling scene %s of group %s", sceneName, groupName)
+	groupId, _, err := c.GetGroupByName(groupName)
+	if err != nil {
+		return err
+	}
+	sceneId, err := c.GetSceneIdByName(groupId, sceneName)
+	if err != nil {
+		return err
+	}
+	response, err := c.restClient.R().
+		Put("/api/" + c.apiKey + "/groups/" + groupId + "/scenes/" + sceneId + "/recall")
+	if err != nil {
+		return err
+	}
+	if response.StatusCode() != 200 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode())
+	}
+	return nil
+}
+
+// GetGroupPower returns the sum of the power measured by the sensors of the
+// lights of the group.
+func (c *ConbeeClient) GetGroupPower(groupName string) (float64, error) {
+	lights, err := c.GetGroupLights(groupName)
+	if err != nil {
+		return 0, err
+	}
+	sensors, m, err := c.GetSensors()
+	if err != nil {
+		return 0, err
+	}
+	if m != nil {
+		return 0, fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	total := 0.0
+	measured := false
 	for _, light := range lights {
-		if light.Name == plugName {
-			return light.State.On, nil
+		if power := sensorPower(sensors, light.UniqueID); power != nil {
+			total += *power
+			measured = true
 		}
 	}
-	return false, fmt.Errorf("light %s not found", plugName)
+	if !measured {
+		return 0, fmt.Errorf("group %s has no power sensor", groupName)
+	}
+	return total, nil
 }
 
-func DiscoverDeconzHostAddress() (string, error) {
-	log.Info().Msg("Discovering deconz host address")
+// GetGroupLights returns the lights of the group with the name by their id.
+func (c *ConbeeClient) GetGroupLights(groupName string) (map[string]models.Light, error) {
+	_, group, err := c.GetGroupByName(groupName)
+	if err != nil {
+		return nil, err
+	}
+	lights, m, err := c.GetLights()
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return nil, fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	groupLights := make(map[string]models.Light, len(group.Lights))
+	for _, id := range group.Lights {
+		if light, ok := lights[id]; ok {
+			groupLights[id] = light
+		}
+	}
+	return groupLights, nil
+}
+
+// DiscoverDeconzGateways asks the phoscon.de discovery service for the deconz
+// gateways in the local network.
+func DiscoverDeconzGateways() ([]models.Device, error) {
+	log.Info().Msg("Discovering deconz gateways")
 	client := resty.New()
 	log.Info().Msg("Setting base url to https://phoscon.de")
 	log.Warn().Msg("This is a hack to get the deconz host address. It will only work if you have a deconz gateway on your network and an internet connection.")
 	client.SetBaseURL("https://phoscon.de")
 	response, err := client.R().Get("/discover")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var devices []models.Device
@@ -200,6 +495,15 @@ func DiscoverDeconzHostAddress() (string, error) {
 	err = json.Unmarshal(response.Body(), &devices)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
+		return nil, err
+	}
+	return devices, nil
+}
+
+func DiscoverDeconzHostAddress() (string, error) {
+	log.Info().Msg("Discovering deconz host address")
+	devices, err := DiscoverDeconzGateways()
+	if err != nil {
 		return "", err
 	}
 
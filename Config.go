@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/JsonRpcWebsocketServer/jrws"
+	models2 "github.com/db-tech/JsonRpcWebsocketServer/models"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/db-tech/SolarKostalConbee2Controller/safefile"
+	"github.com/rs/zerolog/log"
+	"os"
+	"reflect"
+	"sync"
+)
+
+var (
+	// Path of the config file, set by the --config flag or SKC_CONFIG
+	configPath = "config.ini"
+	// Config values that are set by environment variables
+	envOverrides = map[string]string{}
+	// Content of the config file as it was last read or written by the app
+	lastFileSections = models.Sections{}
+	// Serializes reading and writing the config file
+	configMutex sync.Mutex
+	// Guards properties, conbeeClient, inverter and monitoring. The websocket
+	// handlers hold it while they run, config reloads while they swap them.
+	appMutex sync.Mutex
+)
+
+// loadProperties reads the config file and applies the environment overrides.
+// Config files of an older schema version are migrated, the original file is
+// kept with the suffix .v<version>.bak. A missing config file that cannot be
+// created, e.g. on a read-only file system, is not an error, the configuration
+// then only comes from the environment.
+func loadProperties() (*models.Properties, error) {
+	log.Info().Msg("Initializing properties")
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	sections := models.Sections{}
+	err := CreateIniFileIfNotExists(configPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not create %s, using environment variables only", configPath)
+	} else {
+		unlock := lockConfigFile()
+		defer unlock()
+		log.Info().Msgf("Load properties from %s", configPath)
+		sections, err = readConfigFile(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return propertiesFromSections(sections)
+}
+
+// lockConfigFile takes the file lock of the config file, which is shared with
+// other processes. Without write access to the directory no lock can be taken,
+// the app can then only read the config anyway.
+func lockConfigFile() func() {
+	unlock, err := safefile.Lock(configPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not lock %s", configPath)
+		return func() {}
+	}
+	return unlock
+}
+
+// readConfigFile reads and migrates the config file. If the file is broken,
+// the last good backup is used. If writeChanges is set, a migrated config or a
+// restored backup is written back.
+func readConfigFile(writeChanges bool) (models.Sections, error) {
+	sections, readPath, err := models.LoadSectionsWithFallback(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if readPath != configPath {
+		log.Warn().Msgf("%s is broken, using the backup %s", configPath, readPath)
+		if writeChanges {
+			err = restoreConfigBackup(readPath)
+			if err != nil {
+				log.Error().Err(err).Msgf("Could not restore %s", readPath)
+			}
+		}
+	}
+	migrated, version, err := models.Migrate(sections)
+	if err != nil {
+		return nil, err
+	}
+	if version == models.CurrentSchemaVersion || !writeChanges {
+		return migrated, nil
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, version)
+	log.Info().Msgf("Migrating %s from schema version %d to %d, keeping the original as %s",
+		configPath, version, models.CurrentSchemaVersion, backupPath)
+	original, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	err = safefile.WriteFile(backupPath, original, 0600, 0)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not write backup of the config file, the migration is not saved")
+		return migrated, nil
+	}
+	err = models.SaveSectionsToFile(configPath, migrated)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not save the migrated config file")
+	}
+	return migrated, nil
+}
+
+// restoreConfigBackup replaces the broken config file with a backup. The
+// broken file is kept with the suffix .broken for inspection.
+func restoreConfigBackup(backupPath string) error {
+	data, err := os.ReadFile(backupPath)
+	if err != nil {
+		return err
+	}
+	broken, err := os.ReadFile(configPath)
+	if err == nil && len(broken) > 0 {
+		err = safefile.WriteFile(configPath+".broken", broken, 0600, 0)
+		if err != nil {
+			log.Warn().Err(err).Msg("Could not keep the broken config file")
+		}
+	}
+	log.Info().Msgf("Restoring %s from %s", configPath, backupPath)
+	return safefile.WriteFile(configPath, data, 0600, 0)
+}
+
+func propertiesFromSections(sections models.Sections) (*models.Properties, error) {
+	lastFileSections = sections.Copy()
+
+	withOverrides := sections.Copy()
+	envOverrides = models.EnvOverrides(os.LookupEnv)
+	for key, value := range envOverrides {
+		log.Info().Msgf("Property %s is set by %s", key, models.EnvName(key))
+		withOverrides.Set(models.SectionOf(key), key, value)
+	}
+
+	log.Info().Msg("Create properties from sections")
+	propertiesWithDefaults, err := models.FromSectionsWithDefaults(withOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return propertiesWithDefaults, nil
+}
+
+// saveProperties writes the properties to the config file. The changes of the
+// app are merged into the current file, so concurrent manual edits of other
+// values are kept. Values set by environment variables are left untouched in
+// the file, so they don't end up on disk.
+func saveProperties(properties *models.Properties) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	unlock := lockConfigFile()
+	defer unlock()
+
+	ours := properties.ToSections()
+	base := lastFileSections.Copy()
+	for key := range envOverrides {
+		ours.Delete(models.SectionOf(key), key)
+		base.Delete(models.SectionOf(key), key)
+	}
+	theirs, err := readConfigFile(false)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not read %s, overwriting it", configPath)
+		theirs = models.Sections{}
+	}
+
+	merged := models.MergeSections(base, ours, theirs)
+	if reflect.DeepEqual(merged, theirs) {
+		return nil
+	}
+	log.Info().Msgf("Save properties to %s", configPath)
+	err = models.SaveSectionsToFile(configPath, merged)
+	if err != nil {
+		return err
+	}
+	lastFileSections = merged
+	return nil
+}
+
+// reloadProperties is called when the config file has been changed. It applies
+// the new values to the running clients and the monitoring and notifies the
+// websocket clients with propertiesChanged.
+func reloadProperties(wsServer *jrws.WebsocketServer) {
+	configMutex.Lock()
+	if _, err := os.Stat(configPath); err != nil {
+		// Some editors remove the file before writing the new one
+		configMutex.Unlock()
+		log.Debug().Msgf("Config file %s not readable, skipping reload", configPath)
+		return
+	}
+	unlock := lockConfigFile()
+	sections, err := readConfigFile(false)
+	var reloaded *models.Properties
+	if err == nil {
+		reloaded, err = propertiesFromSections(sections)
+	}
+	unlock()
+	configMutex.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not reload the config file, keeping the current properties")
+		return
+	}
+	if errs := reloaded.Validate(); len(errs) > 0 {
+		log.Error().Err(errs).Msg("Reloaded config file is invalid, keeping the current properties")
+		return
+	}
+	appMutex.Lock()
+	defer appMutex.Unlock()
+	if properties == nil || reflect.DeepEqual(*properties, *reloaded) {
+		return
+	}
+
+	log.Info().Msg("Config file changed, applying new properties")
+	previous := *properties
+	*properties = *reloaded
+	applyPropertiesChange(previous, *properties, wsServer)
+}
+
+// lockHandlers makes the handlers of the websocket server hold appMutex while
+// they run, so a config reload does not swap the properties or clients under
+// them.
+func lockHandlers(wsServer *jrws.WebsocketServer) {
+	for method, handler := range wsServer.WsHandlers {
+		handler := handler
+		wsServer.WsHandlers[method] = func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+			appMutex.Lock()
+			defer appMutex.Unlock()
+			return handler(request, ws)
+		}
+	}
+}
+
+// applyPropertiesChange recreates the clients whose settings changed and
+// restarts a running monitoring with the new properties. The caller holds
+// appMutex.
+func applyPropertiesChange(previous models.Properties, current models.Properties, wsServer *jrws.WebsocketServer) {
+	if previous.HostAddress != current.HostAddress || previous.ApiKey != current.ApiKey ||
+		previous.DeconzUsername != current.DeconzUsername || previous.DeconzPassword != current.DeconzPassword {
+		log.Info().Msg("Deconz settings changed, recreating conbee client")
+		conbeeClient = NewConbeeClient(current.DeconzUsername, current.DeconzPassword, current.HostAddress, current.ApiKey)
+	}
+
+	if previous.KostalType != current.KostalType || previous.KostalAddress != current.KostalAddress ||
+		previous.KostalPassword != current.KostalPassword || previous.SimLatitude != current.SimLatitude ||
+		previous.SimKWp != current.SimKWp || previous.SimCloudiness != current.SimCloudiness ||
+		previous.SimBaseLoad != current.SimBaseLoad || previous.SimTimeAcceleration != current.SimTimeAcceleration ||
+		previous.SimDate != current.SimDate || previous.ReplayFile != current.ReplayFile {
+		log.Info().Msg("Inverter settings changed, recreating inverter client")
+		inverter = NewInverterClient(current)
+		err := inverter.Connect()
+		if err != nil {
+			log.Error().Err(err).Msg("Error connecting to inverter")
+		}
+	}
+
+	if monitoring != nil {
+		monitoring.SetClients(conbeeClient, inverter)
+		if monitoring.IsRunning() {
+			log.Info().Msg("Restart monitoring with the new properties")
+			err := monitoring.StartMonitoring(current)
+			if err != nil {
+				log.Error().Err(err).Msg("Could not restart monitoring")
+			}
+		}
+	}
+
+	if wsServer != nil {
+		err := wsServer.WriteNotificationToAllMembers("propertiesChanged", current)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not write notification to all members")
+		}
+	}
+}
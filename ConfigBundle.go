@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// exportConfig creates a bundle of the current properties. If state and
+// history are not nil, the bundle contains the learned state and the history
+// as well.
+func exportConfig(properties *models.Properties, password string, state *StateStore, history *HistoryStore) (*models.ConfigBundle, error) {
+	bundle, err := models.NewConfigBundle(properties, AppVersion, password)
+	if err != nil || state == nil || history == nil {
+		return bundle, err
+	}
+	data := &models.BundleData{}
+	data.State, err = state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	data.History, err = history.Export()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Data = data
+	return bundle, nil
+}
+
+// importConfig compares the bundle with the current properties and, unless
+// dryRun is set, saves it as the new config and restores the state and the
+// history it contains. The imported properties are returned with the
+// environment overrides applied, the caller has to make them the active ones.
+func importConfig(current *models.Properties, bundle *models.ConfigBundle, password string, dryRun bool, state *StateStore, history *HistoryStore) (*models.Properties, models.ImportConfigResult, error) {
+	result := models.ImportConfigResult{}
+	sections, err := bundle.Sections(password)
+	if err != nil {
+		return nil, result, err
+	}
+	if bundle.Data != nil {
+		err = bundle.Data.Check()
+		if err != nil {
+			return nil, result, err
+		}
+		result.State = len(bundle.Data.State) > 0
+		result.HistoryDays = len(bundle.Data.History)
+	}
+	for key, value := range envOverrides {
+		sections.Set(models.SectionOf(key), key, value)
+	}
+	imported, err := models.FromSectionsWithDefaults(sections)
+	if err != nil {
+		return nil, result, err
+	}
+
+	result.Changes = models.DiffSections(current.ToSections(), imported.ToSections())
+	for i := range result.Changes {
+		_, result.Changes[i].EnvOverride = envOverrides[result.Changes[i].Key]
+	}
+	if errs := imported.Validate(); len(errs) > 0 {
+		result.FieldErrors = errs
+		return nil, result, nil
+	}
+	if dryRun {
+		return imported, result, nil
+	}
+
+	if result.State {
+		err = state.Restore(bundle.Data.State)
+		if err != nil {
+			return nil, result, fmt.Errorf("could not restore the state: %v", err)
+		}
+	}
+	if result.HistoryDays > 0 {
+		err = history.Restore(bundle.Data.History)
+		if err != nil {
+			return nil, result, fmt.Errorf("could not restore the history: %v", err)
+		}
+	}
+	if len(result.Changes) == 0 {
+		return imported, result, nil
+	}
+	err = saveProperties(imported)
+	if err != nil {
+		return nil, result, err
+	}
+	result.Applied = true
+	return imported, result, nil
+}
+
+// runConfigExport implements "config export [-password p] [-history] [-out file]".
+func runConfigExport(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config export", flag.ContinueOnError)
+	password := flags.String("password", "", "encrypt the secrets with this password")
+	includeHistory := flags.Bool("history", false, "add the learned state and the history")
+	outPath := flags.String("out", "", "write the bundle to this file instead of stdout")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	var state *StateStore
+	var history *HistoryStore
+	if *includeHistory {
+		state = OpenStateStore(statePath())
+		history = OpenHistoryStore(historyPath())
+	}
+	bundle, err := exportConfig(properties, *password, state, history)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *outPath == "" {
+		_, err = out.Write(data)
+		return err
+	}
+	err = os.WriteFile(*outPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	if *password == "" {
+		fmt.Fprintf(out, "Exported to %s, the secrets are not encrypted\n", *outPath)
+	} else {
+		fmt.Fprintf(out, "Exported to %s\n", *outPath)
+	}
+	return nil
+}
+
+// runConfigImport implements "config import [-password p] [-dry-run] file".
+func runConfigImport(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config import", flag.ContinueOnError)
+	password := flags.String("password", "", "password the secrets have been encrypted with")
+	dryRun := flags.Bool("dry-run", false, "only show the changes")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: config import [-password p] [-dry-run] <file>")
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	bundle := &models.ConfigBundle{}
+	err = json.Unmarshal(data, bundle)
+	if err != nil {
+		return fmt.Errorf("invalid bundle: %v", err)
+	}
+	properties, err := loadProperties()
+	if err != nil {
+		return err
+	}
+	_, result, err := importConfig(properties, bundle, *password, *dryRun, OpenStateStore(statePath()), OpenHistoryStore(historyPath()))
+	if err != nil {
+		return err
+	}
+	if len(result.FieldErrors) > 0 {
+		return models.ValidationErrors(result.FieldErrors)
+	}
+
+	if result.State || result.HistoryDays > 0 {
+		verb := "Restored"
+		if *dryRun {
+			verb = "The bundle contains"
+		}
+		fmt.Fprintf(out, "%s the learned state and %d days of history\n", verb, result.HistoryDays)
+	}
+	if len(result.Changes) == 0 {
+		fmt.Fprintln(out, "No changes")
+		return nil
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tCURRENT\tIMPORTED\t")
+	for _, change := range result.Changes {
+		note := ""
+		if change.EnvOverride {
+			note = "(set by " + models.EnvName(change.Key) + ")"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", change.Key, change.Old, change.New, note)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	if result.Applied {
+		fmt.Fprintf(out, "\nImported %d changes\n", len(result.Changes))
+	} else {
+		fmt.Fprintln(out, "\nDry run, nothing has been changed")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Editors often write a file in several steps, wait for them to finish
+const configWatcherDebounce = 500 * time.Millisecond
+
+// ConfigWatcher calls onChange when the config file has been modified.
+type ConfigWatcher struct {
+	path     string
+	watcher  *fsnotify.Watcher
+	onChange func()
+	mutex    sync.Mutex
+	timer    *time.Timer
+}
+
+// WatchConfigFile starts watching the config file at path. The directory is
+// watched instead of the file itself, so files replaced by a rename, as many
+// editors do, are still noticed.
+func WatchConfigFile(path string, onChange func()) (*ConfigWatcher, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(absPath))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	configWatcher := &ConfigWatcher{
+		path:     absPath,
+		watcher:  watcher,
+		onChange: onChange,
+	}
+	go configWatcher.run()
+	log.Info().Msgf("Watching %s for changes", absPath)
+	return configWatcher, nil
+}
+
+func (w *ConfigWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.path {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			log.Debug().Msgf("Config file event: %s", event)
+			w.mutex.Lock()
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			w.timer = time.AfterFunc(configWatcherDebounce, w.onChange)
+			w.mutex.Unlock()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("Error watching config file")
+		}
+	}
+}
+
+func (w *ConfigWatcher) Close() error {
+	w.mutex.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mutex.Unlock()
+	return w.watcher.Close()
+}
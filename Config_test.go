@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/JsonRpcWebsocketServer/jrws"
+	models2 "github.com/db-tech/JsonRpcWebsocketServer/models"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadPropertiesWhileHandling(t *testing.T) {
+	previousPath, previousProperties, previousInverter := configPath, properties, inverter
+	t.Cleanup(func() {
+		configPath, properties, inverter = previousPath, previousProperties, previousInverter
+	})
+	configPath = filepath.Join(t.TempDir(), "config.ini")
+	write := func(kWp int) {
+		written, err := models.FromMapWithDefaults(map[string]string{"kostalType": models.InverterTypeSimulator,
+			"simKWp": fmt.Sprintf("%d", kWp)})
+		if err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+		if err := models.SaveSectionsToFile(configPath, written.ToSections()); err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+	}
+	write(1)
+	loaded, err := loadProperties()
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	properties = loaded
+	inverter = NewInverterClient(*properties)
+
+	wsServer := jrws.NewWebsocketServer("/ws", 0)
+	wsServer.AddHandler("read", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		return fmt.Sprintf("%f %v", properties.SimKWp, inverter.IsConnected()), nil
+	})
+	lockHandlers(wsServer)
+
+	// Test case 1: Reloads swap the properties and the inverter while handlers run, go test -race reports conflicts
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for kWp := 2; kWp <= 10; kWp++ {
+			write(kWp)
+			reloadProperties(nil)
+		}
+	}()
+	for reloading := true; reloading; {
+		select {
+		case <-done:
+			reloading = false
+		default:
+			wsServer.WsHandlers["read"](models2.Request{}, nil)
+		}
+	}
+	if properties.SimKWp != 10 {
+		t.Errorf("Test case 1: Expected the last reloaded simKWp 10 but got %f", properties.SimKWp)
+	}
+}
+
+func TestReloadPropertiesAfterTickError(t *testing.T) {
+	previousPath, previousProperties, previousInverter, previousMonitoring := configPath, properties, inverter, monitoring
+	t.Cleanup(func() {
+		configPath, properties, inverter, monitoring = previousPath, previousProperties, previousInverter, previousMonitoring
+	})
+	dir := t.TempDir()
+	configPath = filepath.Join(dir, "config.ini")
+	write := func(kWp int) {
+		written, err := models.FromMapWithDefaults(map[string]string{"kostalType": models.InverterTypeSimulator,
+			"simKWp": fmt.Sprintf("%d", kWp), "pollDuration": "1"})
+		if err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+		if err := models.SaveSectionsToFile(configPath, written.ToSections()); err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+	}
+	write(1)
+	loaded, err := loadProperties()
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	properties = loaded
+	inverter = nil
+	wsServer := jrws.NewWebsocketServer("/ws", 0)
+	monitoring = NewMonitoringController(nil, nil, OpenStateStore(filepath.Join(dir, stateFileName)), OpenHistoryStore(dir),
+		NewDecisionLog(), wsServer)
+
+	// Test case 1: Without inverter the tick fails, the monitoring keeps running
+	if err := monitoring.StartMonitoring(*properties); err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if !monitoring.IsRunning() {
+		t.Errorf("Test case 1: Expected the monitoring to keep running after a failed tick")
+	}
+
+	// Test case 2: A reload restarts the monitoring without waiting for it
+	write(2)
+	done := make(chan struct{})
+	go func() {
+		reloadProperties(wsServer)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Test case 2: Expected the reload to return")
+	}
+
+	// Test case 3: The monitoring handles the restart, the stop after it keeps it from
+	// ticking after the test
+	monitoring.StopMonitoring()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(monitoring.eventChan) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(monitoring.eventChan) > 0 || monitoring.IsRunning() || properties.SimKWp != 2 {
+		t.Errorf("Test case 3: Expected the restart to be handled with simKWp 2 but got %d events, %f",
+			len(monitoring.eventChan), properties.SimKWp)
+	}
+}
+
+func TestConfigBundleWithHistory(t *testing.T) {
+	previousPath := configPath
+	t.Cleanup(func() {
+		configPath = previousPath
+	})
+	configPath = filepath.Join(t.TempDir(), "config.ini")
+	current, err := models.FromMapWithDefaults(map[string]string{})
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	state := OpenStateStore(statePath())
+	state.UpdateLoad("boiler", func(state *LoadRuntimeState) {
+		state.LearnedPower = 1800
+	})
+	history := OpenHistoryStore(historyPath())
+	day := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	history.Append("sample", day, 1)
+
+	// Test case 1: Without stores the bundle has no data
+	bundle, err := exportConfig(current, "", nil, nil)
+	if err != nil || bundle.Data != nil {
+		t.Errorf("Test case 1: Expected a bundle without data but got %+v, %v", bundle, err)
+	}
+
+	// Test case 2: The bundle contains the state and the history
+	bundle, err = exportConfig(current, "", state, history)
+	if err != nil || bundle.Data == nil || len(bundle.Data.State) == 0 || len(bundle.Data.History) != 1 {
+		t.Fatalf("Test case 2: Expected the state and a day of history but got %+v, %v", bundle.Data, err)
+	}
+
+	// Test case 3: A dry run restores nothing
+	dir := t.TempDir()
+	restoredState := OpenStateStore(filepath.Join(dir, stateFileName))
+	restoredHistory := OpenHistoryStore(filepath.Join(dir, historyDirName))
+	_, result, err := importConfig(current, bundle, "", true, restoredState, restoredHistory)
+	if err != nil || !result.State || result.HistoryDays != 1 || restoredState.Load("boiler").LearnedPower != 0 {
+		t.Errorf("Test case 3: Expected nothing to be restored but got %+v, %v", result, err)
+	}
+
+	// Test case 4: The import restores the state and the history
+	_, result, err = importConfig(current, bundle, "", false, restoredState, restoredHistory)
+	if err != nil {
+		t.Fatalf("Test case 4: Expected nil error but got %v", err)
+	}
+	if power := OpenStateStore(filepath.Join(dir, stateFileName)).Load("boiler").LearnedPower; power != 1800 {
+		t.Errorf("Test case 4: Expected the learned power 1800 W but got %f", power)
+	}
+	count := 0
+	restoredHistory.Read("sample", day, day, func(entry HistoryEntry) {
+		count++
+	})
+	if count != 1 {
+		t.Errorf("Test case 4: Expected 1 history entry but got %d", count)
+	}
+
+	// Test case 5: History days that are no dates are rejected
+	bundle.Data.History["../config"] = ""
+	if _, _, err = importConfig(current, bundle, "", false, restoredState, restoredHistory); err == nil {
+		t.Errorf("Test case 5: Expected an error for an invalid day but got nil")
+	}
+}
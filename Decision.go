@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+)
+
+type SwitchAction int
+
+const (
+	SwitchActionNone SwitchAction = iota
+	SwitchActionOn
+	SwitchActionOff
+	// Set the brightness level of a proportional load
+	SwitchActionLevel
+)
+
+func (a SwitchAction) String() string {
+	switch a {
+	case SwitchActionOn:
+		return "on"
+	case SwitchActionOff:
+		return "off"
+	case SwitchActionLevel:
+		return "level"
+	}
+	return "none"
+}
+
+// LoadInput is what the switching logic knows about a load.
+type LoadInput struct {
+	Load models.Load
+	// The actuator cannot be reached, the load is left alone until it is back
+	Unreachable bool
+	// Manual override in effect, nil in automatic mode
+	Override *LoadOverride
+	// Why the schedule of the load does not allow it to run right now, empty
+	// if it may run
+	Blocked string
+	// Why the load has to run from the grid to reach its daily target, empty
+	// if it does not have to
+	TargetDue string
+	// The load is in shadow mode, On and Level are its virtual state
+	Shadow bool
+	// Outcome of the rules of the load, nil without rule
+	OnRule  *models.RuleResult
+	OffRule *models.RuleResult
+	On      bool
+	// Brightness level of proportional loads, 0 if off
+	Level int
+	// Power measured by the actuator in W, nil without power meter
+	Power *float64
+	// Average power of the load while it is on in W, 0 if not learned yet
+	LearnedPower float64
+}
+
+// expectedPower returns the power the load is expected to draw when it is on.
+// Without a learned value the load is assumed to draw the threshold.
+func (l LoadInput) expectedPower(properties models.Properties) float64 {
+	if l.LearnedPower > 0 {
+		return l.LearnedPower
+	}
+	return properties.Threshold
+}
+
+// fullPower returns the power a proportional load draws at the highest
+// brightness level.
+func (l LoadInput) fullPower(properties models.Properties) float64 {
+	if l.Load.MaxPower > 0 {
+		return l.Load.MaxPower
+	}
+	return properties.Threshold
+}
+
+// currentDraw returns the power the load draws right now, measured if
+// possible.
+func (l LoadInput) currentDraw(properties models.Properties) float64 {
+	if !l.On {
+		return 0
+	}
+	if l.Power != nil {
+		return *l.Power
+	}
+	if l.Load.IsProportional() {
+		return float64(l.Level) / models.MaxBrightness * l.fullPower(properties)
+	}
+	return l.expectedPower(properties)
+}
+
+// meteredDraw returns the power the load draws right now from its meter, its
+// learned power or the highest power of a proportional load. Unlike
+// currentDraw it does not fall back to the threshold, it reports false if the
+// power of the load is unknown.
+func (l LoadInput) meteredDraw() (float64, bool) {
+	switch {
+	case !l.On:
+		return 0, true
+	case l.Power != nil:
+		return *l.Power, true
+	case l.Load.IsProportional():
+		return float64(l.Level) / models.MaxBrightness * l.Load.MaxPower, l.Load.MaxPower > 0
+	case l.LearnedPower > 0:
+		return l.LearnedPower, true
+	}
+	return 0, false
+}
+
+// drawAfter returns the power the load is expected to draw after the decision
+// has been applied.
+func (l LoadInput) drawAfter(decision SwitchDecision, properties models.Properties) float64 {
+	switch decision.Action {
+	case SwitchActionOn:
+		return l.expectedPower(properties)
+	case SwitchActionOff:
+		return 0
+	case SwitchActionLevel:
+		return float64(decision.Level) / models.MaxBrightness * l.fullPower(properties)
+	}
+	return l.currentDraw(properties)
+}
+
+type SwitchDecision struct {
+	Load   string
+	Action SwitchAction
+	// New brightness level for SwitchActionLevel
+	Level  int
+	Reason string
+}
+
+// DecideLoads contains the switching logic of the monitoring loop. It is free
+// of side effects, so it can be used for backtests as well.
+//
+// Proportional loads give way to the switched loads, so the power they draw
+// counts as surplus for the switched loads. While power is taken from the
+// grid, switched loads are switched off starting with the last one, until the
+// surplus plus the draw of the switched off loads covers the consumption.
+// Otherwise switched loads that are off are switched on in order while the
+// surplus exceeds both the threshold and the power they are expected to draw.
+// The remaining surplus is then distributed over the proportional loads.
+// Unreachable loads are left out, loads with a manual override are switched to
+// the forced state. Loads their schedule does not allow to run are switched
+// off, a manual override takes precedence over the schedule. Loads that have
+// to run to reach their daily target are switched on regardless of the
+// surplus. A load with a rule for its current state is switched by the rule
+// instead of the surplus. With a PV forecast, switched loads are only
+// switched on if the surplus expected for the next hour is high enough as
+// well, so they do not run into the evening.
+func DecideLoads(inverterData InverterData, loads []LoadInput, properties models.Properties) []SwitchDecision {
+	decisions := make([]SwitchDecision, len(loads))
+	surplus := inverterData.Overproduction
+	var switched, proportional []int
+	for i, load := range loads {
+		decisions[i] = SwitchDecision{Load: load.Load.Name, Action: SwitchActionNone}
+		if load.Unreachable {
+			decisions[i].Reason = fmt.Sprintf("%s is unreachable, decisions are paused", load.Load.Name)
+			continue
+		}
+		if load.Override != nil {
+			decisions[i] = decideOverride(load)
+			if decisions[i].Action != SwitchActionNone {
+				surplus += load.currentDraw(properties) - load.drawAfter(decisions[i], properties)
+			}
+			continue
+		}
+		if load.Blocked != "" {
+			decisions[i].Reason = fmt.Sprintf("%s is %s", load.Load.Name, load.Blocked)
+			if load.On {
+				decisions[i].Action = SwitchActionOff
+				decisions[i].Reason += ", switching off"
+				surplus += load.currentDraw(properties)
+			}
+			continue
+		}
+		if load.TargetDue != "" {
+			decisions[i] = decideForcedOn(load, load.Load.Name+": "+load.TargetDue)
+			if decisions[i].Action != SwitchActionNone {
+				surplus += load.currentDraw(properties) - load.drawAfter(decisions[i], properties)
+			}
+			continue
+		}
+		if rule := load.activeRule(); rule != nil {
+			decisions[i] = decideRule(load, *rule)
+			surplus += load.currentDraw(properties) - load.drawAfter(decisions[i], properties)
+			continue
+		}
+		if load.Load.IsProportional() {
+			proportional = append(proportional, i)
+			surplus += load.currentDraw(properties)
+		} else {
+			switched = append(switched, i)
+		}
+	}
+
+	if surplus < 0 {
+		for j := len(switched) - 1; j >= 0; j-- {
+			i := switched[j]
+			load := loads[i]
+			switch {
+			case !load.On:
+				decisions[i].Reason = fmt.Sprintf("Grid consumption: %.0f W, %s is off", -surplus, load.Load.Name)
+			case surplus >= 0:
+				decisions[i].Reason = fmt.Sprintf("Surplus of %.0f W after switching off other loads, keeping %s on",
+					surplus, load.Load.Name)
+			default:
+				draw := load.currentDraw(properties)
+				decisions[i].Action = SwitchActionOff
+				decisions[i].Reason = fmt.Sprintf("Grid consumption: %.0f W, switching off %s drawing %.0f W",
+					-surplus, load.Load.Name, draw)
+				surplus += draw
+			}
+		}
+	} else {
+		// Surplus if the PV power changes to the forecast at the current
+		// consumption
+		forecastSurplus := surplus
+		if inverterData.ForecastPVPower != nil {
+			forecastSurplus += *inverterData.ForecastPVPower - inverterData.PVPower
+		}
+		for _, i := range switched {
+			load := loads[i]
+			if load.On {
+				draw := load.currentDraw(properties)
+				decisions[i].Reason = fmt.Sprintf("Surplus: %.0f W, %s is on and draws %.0f W",
+					surplus, load.Load.Name, draw)
+				continue
+			}
+			expected := load.expectedPower(properties)
+			required := properties.Threshold
+			if expected > required {
+				required = expected
+			}
+			switch {
+			case surplus <= required:
+				decisions[i].Reason = fmt.Sprintf("Surplus: %.0f W, %s needs %.0f W", surplus, load.Load.Name, required)
+			case forecastSurplus <= required:
+				decisions[i].Reason = fmt.Sprintf("Surplus: %.0f W, but %.0f W expected in the next hour, %s needs %.0f W",
+					surplus, forecastSurplus, load.Load.Name, required)
+			default:
+				decisions[i].Action = SwitchActionOn
+				decisions[i].Reason = fmt.Sprintf("Surplus: %.0f W, switching on %s expected to draw %.0f W",
+					surplus, load.Load.Name, expected)
+				surplus -= expected
+				forecastSurplus -= expected
+			}
+		}
+	}
+
+	for _, i := range proportional {
+		available := surplus
+		if available < 0 {
+			available = 0
+		}
+		decisions[i] = decideLevel(loads[i], available, properties)
+		surplus -= float64(decisions[i].Level) / models.MaxBrightness * loads[i].fullPower(properties)
+	}
+	return decisions
+}
+
+// activeRule returns the outcome of the rule that decides on the load in its
+// current state, the off rule while it is on and the on rule while it is off.
+func (l LoadInput) activeRule() *models.RuleResult {
+	if l.On {
+		return l.OffRule
+	}
+	return l.OnRule
+}
+
+// decideRule switches a load by the outcome of its rule.
+func decideRule(load LoadInput, rule models.RuleResult) SwitchDecision {
+	decision := SwitchDecision{Load: load.Load.Name, Action: SwitchActionNone}
+	kind := "On"
+	if load.On {
+		kind = "Off"
+	}
+	decision.Reason = fmt.Sprintf("%s rule of %s (%s)", kind, load.Load.Name, rule)
+	switch {
+	case !rule.Matched:
+		decision.Reason += " does not hold"
+	case load.On:
+		decision.Action = SwitchActionOff
+		decision.Reason += " holds, switching off"
+	default:
+		decision.Action = SwitchActionOn
+		decision.Reason += " holds, switching on"
+	}
+	return decision
+}
+
+// decideOverride switches a load with a manual override to the forced state.
+func decideOverride(load LoadInput) SwitchDecision {
+	reason := fmt.Sprintf("Manual override of %s: %s", load.Load.Name, load.Override)
+	if load.Override.Mode == OverrideModeOn {
+		return decideForcedOn(load, reason)
+	}
+	decision := SwitchDecision{Load: load.Load.Name, Action: SwitchActionNone, Level: load.Level, Reason: reason}
+	if load.On {
+		decision.Action = SwitchActionOff
+		decision.Level = 0
+		decision.Reason += ", switching off"
+	}
+	return decision
+}
+
+// decideForcedOn switches a load on regardless of the surplus, proportional
+// loads at their highest level.
+func decideForcedOn(load LoadInput, reason string) SwitchDecision {
+	decision := SwitchDecision{Load: load.Load.Name, Action: SwitchActionNone, Level: load.Level, Reason: reason}
+	switch {
+	case load.Load.IsProportional():
+		_, maxLevel := load.Load.LevelRange()
+		if !load.On || load.Level != maxLevel {
+			decision.Action = SwitchActionLevel
+			decision.Level = maxLevel
+			decision.Reason += fmt.Sprintf(", setting level %d", maxLevel)
+		}
+	case !load.On:
+		decision.Action = SwitchActionOn
+		decision.Reason += ", switching on"
+	}
+	return decision
+}
+
+// decideLevel sets the brightness level of a proportional load so it draws
+// the available power. The level moves towards the target with the smoothing
+// of the load and at most MaxStep per poll. Level is the resulting level in
+// any case, 0 if the load is off.
+func decideLevel(load LoadInput, available float64, properties models.Properties) SwitchDecision {
+	decision := SwitchDecision{Load: load.Load.Name, Action: SwitchActionNone}
+	current := 0
+	if load.On {
+		current = load.Level
+	}
+	fullPower := load.fullPower(properties)
+	if fullPower <= 0 {
+		decision.Level = current
+		decision.Reason = fmt.Sprintf("%s has no maximum power, keeping level %d", load.Load.Name, current)
+		return decision
+	}
+
+	target := available / fullPower * models.MaxBrightness
+	minLevel, maxLevel := load.Load.LevelRange()
+	step := func(from float64) int {
+		next := from + load.Load.SmoothingOrDefault()*(target-from)
+		maxStep := float64(load.Load.MaxStepOrDefault())
+		if next > from+maxStep {
+			next = from + maxStep
+		} else if next < from-maxStep {
+			next = from - maxStep
+		}
+		return int(math.Round(next))
+	}
+	level := step(float64(current))
+	// Smoothing and the step limit would keep a load that is off below its
+	// minimum level and switch it off again every poll, so it starts there
+	if level < minLevel && current < minLevel && target >= float64(minLevel) {
+		level = step(float64(minLevel))
+	}
+	if level > maxLevel {
+		level = maxLevel
+	}
+	if level < minLevel {
+		level = 0
+	}
+
+	decision.Level = level
+	switch {
+	case level == current:
+		decision.Reason = fmt.Sprintf("Available: %.0f W, keeping %s at level %d", available, load.Load.Name, level)
+	case level == 0:
+		decision.Action = SwitchActionOff
+		decision.Reason = fmt.Sprintf("Available: %.0f W, below the minimum level of %s, switching off",
+			available, load.Load.Name)
+	default:
+		decision.Action = SwitchActionLevel
+		decision.Reason = fmt.Sprintf("Available: %.0f W, setting %s from level %d to %d (target %.0f)",
+			available, load.Load.Name, current, level, target)
+	}
+	return decision
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"sync"
+	"time"
+)
+
+const (
+	// Records kept in memory, an hour at the default poll duration
+	decisionLogSize = 360
+	// Records returned by getDecisions without a limit
+	defaultDecisionLimit = 100
+	historyKindDecision  = "decision"
+)
+
+// DecisionRecord explains the decisions of a monitoring tick.
+type DecisionRecord struct {
+	Time time.Time `json:"time"`
+	// Filtered readings the decisions are based on, with the virtual state of
+	// the loads in shadow mode
+	Inputs InverterData `json:"inputs"`
+	// Filtered readings with the real state of the loads, nil if no load is in
+	// shadow mode
+	MeasuredInputs *InverterData `json:"measuredInputs,omitempty"`
+	// Readings before filtering, nil without filter
+	RawInputs *InverterData        `json:"rawInputs,omitempty"`
+	Threshold float64              `json:"threshold"`
+	Loads     []LoadDecisionRecord `json:"loads"`
+}
+
+// LoadDecisionRecord is what was known about a load, what was decided and why.
+type LoadDecisionRecord struct {
+	Load string `json:"load"`
+	// The action is only recorded, On and Level are the virtual state
+	Shadow       bool     `json:"shadow,omitempty"`
+	Reachable    bool     `json:"reachable"`
+	On           bool     `json:"on"`
+	Level        int      `json:"level,omitempty"`
+	Power        *float64 `json:"power,omitempty"`
+	LearnedPower float64  `json:"learnedPower,omitempty"`
+	// Power the load is expected to draw when it is on
+	ExpectedPower float64       `json:"expectedPower"`
+	Override      *LoadOverride `json:"override,omitempty"`
+	// Why the schedule blocks the load, empty if it may run
+	Blocked string      `json:"blocked,omitempty"`
+	Target  *TargetPlan `json:"target,omitempty"`
+	// Outcome of the rules, with the time the conditions with a duration have held
+	OnRule  *models.RuleResult `json:"onRule,omitempty"`
+	OffRule *models.RuleResult `json:"offRule,omitempty"`
+	Action  string             `json:"action"`
+	// New brightness level of proportional loads
+	NewLevel int    `json:"newLevel,omitempty"`
+	Reason   string `json:"reason"`
+	// Whether the command was sent and its state read back
+	Applied bool `json:"applied,omitempty"`
+	// Why the command failed, it is retried at the next poll
+	Error string `json:"error,omitempty"`
+}
+
+// newDecisionRecord creates the record of the decisions on the loads at now.
+// The decisions are based on data, measured is the filtered reading before
+// the loads in shadow mode were replaced with their virtual state.
+func newDecisionRecord(now time.Time, data Data, measured InverterData, inputs []LoadInput, decisions []SwitchDecision, properties models.Properties) DecisionRecord {
+	record := DecisionRecord{
+		Time:      now,
+		Inputs:    data.InverterData,
+		RawInputs: data.RawInverterData,
+		Threshold: properties.Threshold,
+		Loads:     make([]LoadDecisionRecord, 0, len(inputs)),
+	}
+	for i, input := range inputs {
+		if input.Shadow && record.MeasuredInputs == nil {
+			record.MeasuredInputs = &measured
+		}
+		loadRecord := LoadDecisionRecord{
+			Load:          input.Load.Name,
+			Shadow:        input.Shadow,
+			Reachable:     !input.Unreachable,
+			On:            input.On,
+			Level:         input.Level,
+			Power:         input.Power,
+			LearnedPower:  input.LearnedPower,
+			ExpectedPower: input.expectedPower(properties),
+			Override:      input.Override,
+			Blocked:       input.Blocked,
+			OnRule:        input.OnRule,
+			OffRule:       input.OffRule,
+		}
+		if i < len(data.Loads) {
+			loadRecord.Target = data.Loads[i].Target
+		}
+		if i < len(decisions) {
+			loadRecord.Action = decisions[i].Action.String()
+			loadRecord.Reason = decisions[i].Reason
+			if decisions[i].Action == SwitchActionLevel {
+				loadRecord.NewLevel = decisions[i].Level
+			}
+		}
+		record.Loads = append(record.Loads, loadRecord)
+	}
+	return record
+}
+
+// setOutcome records the outcome of the commands sent to the loads, loads
+// without an entry were not switched.
+func (r *DecisionRecord) setOutcome(outcome map[string]error) {
+	for i := range r.Loads {
+		err, ok := outcome[r.Loads[i].Load]
+		if !ok {
+			continue
+		}
+		r.Loads[i].Applied = err == nil
+		if err != nil {
+			r.Loads[i].Error = err.Error()
+		}
+	}
+}
+
+// forLoad returns the record restricted to the load, false if the load is not
+// part of it.
+func (r DecisionRecord) forLoad(name string) (DecisionRecord, bool) {
+	for _, load := range r.Loads {
+		if load.Load == name {
+			r.Loads = []LoadDecisionRecord{load}
+			return r, true
+		}
+	}
+	return r, false
+}
+
+// DecisionLog keeps the last decisionLogSize records in memory.
+type DecisionLog struct {
+	mutex   sync.Mutex
+	size    int
+	records []DecisionRecord
+	// Index of the oldest record once the buffer is full
+	next int
+}
+
+func NewDecisionLog() *DecisionLog {
+	return newDecisionRing(decisionLogSize)
+}
+
+// newDecisionRing creates a log that keeps the last size records.
+func newDecisionRing(size int) *DecisionLog {
+	return &DecisionLog{size: size}
+}
+
+// Add adds the record, replacing the oldest one if the log is full.
+func (l *DecisionLog) Add(record DecisionRecord) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.records) < l.size {
+		l.records = append(l.records, record)
+		return
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % l.size
+}
+
+// Records returns the records in chronological order.
+func (l *DecisionLog) Records() []DecisionRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	records := make([]DecisionRecord, 0, len(l.records))
+	records = append(records, l.records[l.next:]...)
+	return append(records, l.records[:l.next]...)
+}
+
+// queryDecisions returns the records selected by the params, from the log if
+// it reaches back far enough and from the history otherwise. Only the last
+// limit records of the load are kept while the history is read.
+func queryDecisions(decisionLog *DecisionLog, history *HistoryStore, params models.GetDecisionsParams, now time.Time) ([]DecisionRecord, error) {
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultDecisionLimit
+	}
+	from, to := time.Time{}, now
+	if params.From == "" && params.To != "" {
+		return nil, fmt.Errorf("to requires from, the recent records have no range")
+	}
+	if params.From != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, params.From); err != nil {
+			return nil, fmt.Errorf("invalid from %q, use e.g. 2006-01-02T15:04:05+01:00", params.From)
+		}
+		if params.To != "" {
+			if to, err = time.Parse(time.RFC3339, params.To); err != nil {
+				return nil, fmt.Errorf("invalid to %q, use e.g. 2006-01-02T15:04:05+01:00", params.To)
+			}
+		}
+	}
+
+	selected := newDecisionRing(limit)
+	add := func(record DecisionRecord) {
+		if params.From != "" && (record.Time.Before(from) || record.Time.After(to)) {
+			return
+		}
+		if params.Load != "" {
+			var ok bool
+			if record, ok = record.forLoad(params.Load); !ok {
+				return
+			}
+		}
+		selected.Add(record)
+	}
+	records := decisionLog.Records()
+	if params.From != "" && (len(records) == 0 || from.Before(records[0].Time)) {
+		err := history.Read(historyKindDecision, from, to, func(entry HistoryEntry) {
+			var record DecisionRecord
+			if json.Unmarshal(entry.Data, &record) == nil {
+				add(record)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return selected.Records(), nil
+	}
+	for _, record := range records {
+		add(record)
+	}
+	return selected.Records(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+	"time"
+)
+
+func TestDecisionLog(t *testing.T) {
+	decisionLog := NewDecisionLog()
+	history := OpenHistoryStore(t.TempDir())
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	inputs := []LoadInput{{Load: models.Load{Name: "boiler"}}, {Load: models.Load{Name: "pump"}, On: true}}
+	properties := models.Properties{Threshold: 500}
+	for i := 0; i < decisionLogSize+10; i++ {
+		now := start.Add(time.Duration(i) * 10 * time.Second)
+		decisions := DecideLoads(InverterData{Overproduction: 1000}, inputs, properties)
+		record := newDecisionRecord(now, Data{}, InverterData{}, inputs, decisions, properties)
+		decisionLog.Add(record)
+		history.Append(historyKindDecision, now, record)
+	}
+
+	// Test case 1: The log keeps the latest records in order
+	records := decisionLog.Records()
+	if len(records) != decisionLogSize || !records[0].Time.Equal(start.Add(100*time.Second)) {
+		t.Errorf("Test case 1: Expected %d records from 12:01:40 but got %d from %v", decisionLogSize, len(records), records[0].Time)
+	}
+
+	// Test case 2: The record explains the decision of each load
+	if load := records[0].Loads[0]; load.Action != "on" || load.Reason == "" || load.ExpectedPower != 500 {
+		t.Errorf("Test case 2: Expected boiler to be switched on with a reason but got %+v", load)
+	}
+
+	// Test case 3: The recent records of a load
+	now := start.Add(time.Hour)
+	selected, err := queryDecisions(decisionLog, history, models.GetDecisionsParams{Load: "pump", Limit: 5}, now)
+	if err != nil || len(selected) != 5 || len(selected[0].Loads) != 1 || selected[0].Loads[0].Load != "pump" {
+		t.Errorf("Test case 3: Expected 5 records of pump but got %+v, %v", selected, err)
+	}
+
+	// Test case 4: Records older than the log are read from the history
+	params := models.GetDecisionsParams{From: start.Format(time.RFC3339), To: start.Add(time.Minute).Format(time.RFC3339)}
+	selected, err = queryDecisions(decisionLog, history, params, now)
+	if err != nil || len(selected) != 7 || !selected[0].Time.Equal(start) {
+		t.Errorf("Test case 4: Expected 7 records from the history but got %d, %v", len(selected), err)
+	}
+
+	// Test case 5: Only the last records of the load are returned from the history
+	params = models.GetDecisionsParams{Load: "pump", Limit: 3, From: start.Format(time.RFC3339), To: start.Add(time.Minute).Format(time.RFC3339)}
+	selected, err = queryDecisions(decisionLog, history, params, now)
+	if err != nil || len(selected) != 3 || !selected[0].Time.Equal(start.Add(40*time.Second)) || len(selected[2].Loads) != 1 {
+		t.Errorf("Test case 5: Expected 3 records of pump from 12:00:40 but got %+v, %v", selected, err)
+	}
+
+	// Test case 6: The outcome of the commands is recorded
+	record := records[0]
+	record.Loads = append([]LoadDecisionRecord(nil), record.Loads...)
+	record.setOutcome(map[string]error{"boiler": ErrActuatorUnreachable})
+	if load := record.Loads[0]; load.Applied || load.Error != ErrActuatorUnreachable.Error() {
+		t.Errorf("Test case 6: Expected the error of boiler but got %+v", load)
+	}
+	if load := record.Loads[1]; load.Applied || load.Error != "" {
+		t.Errorf("Test case 6: Expected no outcome of pump but got %+v", load)
+	}
+	record.setOutcome(map[string]error{"pump": nil})
+	if !record.Loads[1].Applied {
+		t.Errorf("Test case 6: Expected the command to pump to be applied")
+	}
+
+	// Test case 7: to is not ignored without from
+	if _, err = queryDecisions(decisionLog, history, models.GetDecisionsParams{To: start.Format(time.RFC3339)}, now); err == nil {
+		t.Errorf("Test case 7: Expected an error but got nil")
+	}
+}
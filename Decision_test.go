@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+)
+
+func TestDecideLoads(t *testing.T) {
+	properties := models.Properties{Threshold: 500}
+	power := func(watt float64) *float64 {
+		return &watt
+	}
+	boiler := models.Load{Name: "boiler"}
+	pump := models.Load{Name: "pump"}
+	forcedOn := &LoadOverride{Mode: OverrideModeOn}
+	forcedOff := &LoadOverride{Mode: OverrideModeOff}
+
+	tests := []struct {
+		overproduction float64
+		loads          []LoadInput
+		expected       []SwitchAction
+	}{
+		// Test case 1: Enough surplus for the learned power of the first load only
+		{2500, []LoadInput{{Load: boiler, LearnedPower: 2000}, {Load: pump, LearnedPower: 800}},
+			[]SwitchAction{SwitchActionOn, SwitchActionNone}},
+		// Test case 2: Surplus above the threshold but below the learned power
+		{1500, []LoadInput{{Load: boiler, LearnedPower: 2000}},
+			[]SwitchAction{SwitchActionNone}},
+		// Test case 3: Without learned power the threshold is used
+		{600, []LoadInput{{Load: boiler}}, []SwitchAction{SwitchActionOn}},
+		// Test case 4: Switching off the last load covers the grid consumption
+		{-300, []LoadInput{{Load: boiler, On: true, Power: power(2000)}, {Load: pump, On: true, Power: power(800)}},
+			[]SwitchAction{SwitchActionNone, SwitchActionOff}},
+		// Test case 5: The measured draw of the last load is not enough
+		{-300, []LoadInput{{Load: boiler, On: true, Power: power(2000)}, {Load: pump, On: true, Power: power(100)}},
+			[]SwitchAction{SwitchActionOff, SwitchActionOff}},
+		// Test case 6: Small surplus keeps the loads as they are
+		{100, []LoadInput{{Load: boiler, On: true, Power: power(2000)}, {Load: pump}},
+			[]SwitchAction{SwitchActionNone, SwitchActionNone}},
+		// Test case 7: An unreachable load is paused, the next one is switched off instead
+		{-300, []LoadInput{{Load: boiler, On: true, Power: power(2000)}, {Load: pump, On: true, Unreachable: true}},
+			[]SwitchAction{SwitchActionOff, SwitchActionNone}},
+		// Test case 8: A load forced on is kept on, the next one is switched off instead
+		{-300, []LoadInput{{Load: boiler, On: true, Power: power(2000)}, {Load: pump, On: true, Power: power(800), Override: forcedOn}},
+			[]SwitchAction{SwitchActionOff, SwitchActionNone}},
+		// Test case 9: Overrides take precedence over the surplus
+		{3000, []LoadInput{{Load: boiler, Override: forcedOff, On: true}, {Load: pump, Override: forcedOn}},
+			[]SwitchAction{SwitchActionOff, SwitchActionOn}},
+		// Test case 10: A load outside of its schedule is switched off and not switched on
+		{3000, []LoadInput{{Load: boiler, On: true, Blocked: "out of season"}, {Load: pump, Blocked: "out of season"}},
+			[]SwitchAction{SwitchActionOff, SwitchActionNone}},
+		// Test case 11: A load due for its daily target runs from the grid, the next one is switched off instead
+		{-300, []LoadInput{{Load: boiler, TargetDue: "daily target", LearnedPower: 2000}, {Load: pump, On: true, Power: power(800)}},
+			[]SwitchAction{SwitchActionOn, SwitchActionOff}},
+		// Test case 12: Rules replace the surplus logic, a load without rule for its state uses the surplus
+		{-300, []LoadInput{{Load: boiler, OnRule: &models.RuleResult{Matched: true}},
+			{Load: pump, On: true, Power: power(800), OffRule: &models.RuleResult{Matched: false}},
+			{Load: models.Load{Name: "heater"}, On: true, Power: power(1000), OnRule: &models.RuleResult{Matched: true}}},
+			[]SwitchAction{SwitchActionOn, SwitchActionNone, SwitchActionOff}},
+	}
+	for i, test := range tests {
+		decisions := DecideLoads(InverterData{Overproduction: test.overproduction}, test.loads, properties)
+		for j, expected := range test.expected {
+			if decisions[j].Action != expected {
+				t.Errorf("Test case %d: Expected action %d for %s but got %d (%s)",
+					i+1, expected, decisions[j].Load, decisions[j].Action, decisions[j].Reason)
+			}
+		}
+	}
+}
+
+func TestDecideLoadsForecast(t *testing.T) {
+	properties := models.Properties{Threshold: 500}
+	boiler := LoadInput{Load: models.Load{Name: "boiler"}, LearnedPower: 1000}
+	pump := LoadInput{Load: models.Load{Name: "pump"}, LearnedPower: 800}
+	forecast := func(watt float64) *float64 {
+		return &watt
+	}
+
+	tests := []struct {
+		inverterData InverterData
+		expected     []SwitchAction
+	}{
+		// Test case 1: Without forecast the current surplus decides
+		{InverterData{PVPower: 3000, Overproduction: 2000}, []SwitchAction{SwitchActionOn, SwitchActionOn}},
+		// Test case 2: A falling forecast leaves room for the first load only
+		{InverterData{PVPower: 3000, Overproduction: 2000, ForecastPVPower: forecast(2500)},
+			[]SwitchAction{SwitchActionOn, SwitchActionNone}},
+		// Test case 3: The surplus is unlikely to last for any load
+		{InverterData{PVPower: 3000, Overproduction: 2000, ForecastPVPower: forecast(1500)},
+			[]SwitchAction{SwitchActionNone, SwitchActionNone}},
+	}
+	for i, test := range tests {
+		decisions := DecideLoads(test.inverterData, []LoadInput{boiler, pump}, properties)
+		for j, expected := range test.expected {
+			if decisions[j].Action != expected {
+				t.Errorf("Test case %d: Expected action %d for %s but got %d (%s)",
+					i+1, expected, decisions[j].Load, decisions[j].Action, decisions[j].Reason)
+			}
+		}
+	}
+}
+
+func TestDecideLoadsProportional(t *testing.T) {
+	properties := models.Properties{Threshold: 500}
+	heater := models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, Smoothing: 1, MaxStep: 255}
+	boiler := models.Load{Name: "boiler"}
+
+	tests := []struct {
+		overproduction float64
+		loads          []LoadInput
+		expected       []SwitchAction
+		level          int
+	}{
+		// Test case 1: The level follows the surplus
+		{500, []LoadInput{{Load: heater}}, []SwitchAction{SwitchActionLevel}, 128},
+		// Test case 2: The step is limited
+		{1000, []LoadInput{{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, Smoothing: 1, MaxStep: 10}}},
+			[]SwitchAction{SwitchActionLevel}, 10},
+		// Test case 3: Below the minimum level the load is switched off
+		{-100, []LoadInput{{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, Smoothing: 1, MaxStep: 255, MinLevel: 50},
+			On: true, Level: 60}}, []SwitchAction{SwitchActionOff}, 0},
+		// Test case 4: The power of the proportional load is given to the switched load
+		{200, []LoadInput{{Load: boiler, LearnedPower: 600}, {Load: heater, On: true, Level: 255}},
+			[]SwitchAction{SwitchActionOn, SwitchActionLevel}, 153},
+		// Test case 5: With the default smoothing and step a load that is off starts at its minimum level
+		{500, []LoadInput{{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, MinLevel: 100}}},
+			[]SwitchAction{SwitchActionLevel}, 114},
+		// Test case 6: A target just above the minimum level switches the load on as well
+		{400, []LoadInput{{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, MinLevel: 100}}},
+			[]SwitchAction{SwitchActionLevel}, 101},
+		// Test case 7: A target below the minimum level keeps the load off
+		{300, []LoadInput{{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000, MinLevel: 100}}},
+			[]SwitchAction{SwitchActionNone}, 0},
+	}
+	for i, test := range tests {
+		decisions := DecideLoads(InverterData{Overproduction: test.overproduction}, test.loads, properties)
+		for j, expected := range test.expected {
+			if decisions[j].Action != expected {
+				t.Errorf("Test case %d: Expected action %d for %s but got %d (%s)",
+					i+1, expected, decisions[j].Load, decisions[j].Action, decisions[j].Reason)
+			}
+		}
+		last := decisions[len(decisions)-1]
+		if last.Level != test.level {
+			t.Errorf("Test case %d: Expected level %d but got %d (%s)", i+1, test.level, last.Level, last.Reason)
+		}
+	}
+}
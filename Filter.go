@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+)
+
+// Spikes that persist for more samples are accepted as a real change
+const maxRejectedSpikes = 2
+
+// sampleFilter smooths a single reading.
+type sampleFilter struct {
+	window   []float64
+	ema      float64
+	rejected int
+}
+
+// InverterFilter smooths the readings of the inverter and rejects spikes, so
+// a kettle or a passing cloud does not switch the loads. The surplus is
+// derived from the filtered PV power and consumption.
+type InverterFilter struct {
+	mutex          sync.Mutex
+	kind           string
+	size           int
+	alpha          float64
+	spikeThreshold float64
+	pv             sampleFilter
+	consumption    sampleFilter
+}
+
+// NewInverterFilter creates the filter configured in the properties, nil if
+// the readings are used as they are.
+func NewInverterFilter(properties models.Properties) *InverterFilter {
+	kind := properties.Filter
+	if kind == "" {
+		kind = models.FilterNone
+	}
+	if kind == models.FilterNone && properties.SpikeThreshold == 0 {
+		return nil
+	}
+	return &InverterFilter{
+		kind:           kind,
+		size:           properties.FilterWindowOrDefault(),
+		alpha:          properties.FilterAlphaOrDefault(),
+		spikeThreshold: properties.SpikeThreshold,
+	}
+}
+
+// Apply returns the filtered readings. With update false the sample is not
+// added to the filter, e.g. for readings outside of the poll interval.
+func (f *InverterFilter) Apply(raw InverterData, update bool) InverterData {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	filtered := raw
+	filtered.PVPower = f.pv.apply(raw.PVPower, f, update, "PV power")
+	filtered.HousePowerConsumption = f.consumption.apply(raw.HousePowerConsumption, f, update, "consumption")
+	filtered.Overproduction = filtered.PVPower - filtered.HousePowerConsumption
+	return filtered
+}
+
+func (s *sampleFilter) apply(value float64, f *InverterFilter, update bool, name string) float64 {
+	if !update {
+		s = &sampleFilter{window: append([]float64(nil), s.window...), ema: s.ema, rejected: s.rejected}
+	}
+	if f.spikeThreshold > 0 && len(s.window) > 0 {
+		reference := median(s.window)
+		if (value-reference > f.spikeThreshold || reference-value > f.spikeThreshold) && s.rejected < maxRejectedSpikes {
+			if update {
+				log.Debug().Msgf("Rejecting a spike of the %s: %.0f W, median %.0f W", name, value, reference)
+			}
+			s.rejected++
+			value = reference
+		} else {
+			s.rejected = 0
+		}
+	}
+
+	s.window = append(s.window, value)
+	if len(s.window) > f.size {
+		s.window = s.window[len(s.window)-f.size:]
+	}
+	if len(s.window) == 1 {
+		s.ema = value
+	} else {
+		s.ema += f.alpha * (value - s.ema)
+	}
+
+	switch f.kind {
+	case models.FilterAverage:
+		var sum float64
+		for _, sample := range s.window {
+			sum += sample
+		}
+		return sum / float64(len(s.window))
+	case models.FilterEMA:
+		return s.ema
+	case models.FilterMedian:
+		return median(s.window)
+	}
+	return value
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+	"testing"
+)
+
+func TestInverterFilter(t *testing.T) {
+	feed := func(filter *InverterFilter, pvValues ...float64) InverterData {
+		var filtered InverterData
+		for _, pv := range pvValues {
+			filtered = filter.Apply(InverterData{PVPower: pv, HousePowerConsumption: 500, Overproduction: pv - 500}, true)
+		}
+		return filtered
+	}
+
+	// Test case 1: Without filter and spike rejection the readings are used as they are
+	if filter := NewInverterFilter(models.Properties{Filter: models.FilterNone}); filter != nil {
+		t.Errorf("Test case 1: Expected no filter but got %+v", filter)
+	}
+
+	// Test case 2: Moving average over the window
+	filtered := feed(NewInverterFilter(models.Properties{Filter: models.FilterAverage, FilterWindow: 3}), 1000, 2000, 3000, 4000)
+	if filtered.PVPower != 3000 || filtered.Overproduction != 2500 {
+		t.Errorf("Test case 2: Expected 3000 W PV and 2500 W surplus but got %+v", filtered)
+	}
+
+	// Test case 3: The median ignores a single outlier
+	filtered = feed(NewInverterFilter(models.Properties{Filter: models.FilterMedian, FilterWindow: 3}), 1000, 5000, 1100)
+	if filtered.PVPower != 1100 {
+		t.Errorf("Test case 3: Expected 1100 W but got %+v", filtered)
+	}
+
+	// Test case 4: The EMA moves by alpha towards a new reading
+	filtered = feed(NewInverterFilter(models.Properties{Filter: models.FilterEMA, FilterAlpha: 0.5}), 1000, 2000)
+	if filtered.PVPower != 1500 {
+		t.Errorf("Test case 4: Expected 1500 W but got %+v", filtered)
+	}
+
+	// Test case 5: A spike is rejected, a lasting change is accepted
+	filter := NewInverterFilter(models.Properties{SpikeThreshold: 1000})
+	filtered = feed(filter, 1000, 1000, 4000)
+	if filtered.PVPower != 1000 {
+		t.Errorf("Test case 5: Expected the spike to be rejected but got %+v", filtered)
+	}
+	filtered = feed(filter, 4000, 4000)
+	if filtered.PVPower != 4000 {
+		t.Errorf("Test case 5: Expected the lasting change to be accepted but got %+v", filtered)
+	}
+
+	// Test case 6: Readings outside of the poll interval do not change the filter
+	filter = NewInverterFilter(models.Properties{Filter: models.FilterAverage, FilterWindow: 2})
+	feed(filter, 1000)
+	filter.Apply(InverterData{PVPower: 3000}, false)
+	filtered = feed(filter, 2000)
+	if math.Abs(filtered.PVPower-1500) > 0.001 {
+		t.Errorf("Test case 6: Expected 1500 W but got %+v", filtered)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Days of PV power history the calibration is based on
+	calibrationDays = 14
+	// The calibration is repeated after this time
+	calibrationInterval = 24 * time.Hour
+	// Fewer samples keep the uncalibrated model
+	minCalibrationSamples = 100
+	// Only samples with at least this share of the peak power are used, low
+	// sun is dominated by shading and the horizon
+	minCalibrationShare = 0.1
+	// Share of the samples that are below the clear-sky level, the others are
+	// clear moments
+	calibrationPercentile = 0.9
+	forecastHorizon       = time.Hour
+	forecastStep          = 15 * time.Minute
+)
+
+// Forecaster estimates the PV power from the clear-sky model of the plant,
+// calibrated against the measured PV power, or from the forecast of an
+// external service if one is configured and available.
+type Forecaster struct {
+	plant PVPlant
+	// External forecast, nil without service
+	provider *ForecastProvider
+	mutex    sync.Mutex
+	// Measured divided by modelled clear-sky power, 1 until calibrated
+	calibration        float64
+	calibrationSamples int
+	calibratedAt       time.Time
+}
+
+// NewForecaster creates the forecaster of the plant in the properties, nil if
+// none is configured. The forecast of the service is cached at cachePath.
+func NewForecaster(properties models.Properties, cachePath string) *Forecaster {
+	if properties.ForecastKWp <= 0 {
+		return nil
+	}
+	return &Forecaster{
+		plant: PVPlant{
+			Latitude:  properties.ForecastLatitude,
+			Longitude: properties.ForecastLongitude,
+			Tilt:      properties.ForecastTilt,
+			Azimuth:   properties.ForecastAzimuth,
+			KWp:       properties.ForecastKWp,
+		},
+		provider:    NewForecastProvider(properties, cachePath),
+		calibration: 1,
+	}
+}
+
+// Calibrate compares the measured PV power of the last calibrationDays in the
+// history with the model. Shading, soiling and a wrong orientation lower the
+// measured power on clear days, which are the high percentile of the ratios.
+func (f *Forecaster) Calibrate(history *HistoryStore, now time.Time) error {
+	minPower := minCalibrationShare * f.plant.KWp * 1000
+	var ratios []float64
+	err := history.Read(historyKindDecision, now.AddDate(0, 0, -calibrationDays), now, func(entry HistoryEntry) {
+		var record DecisionRecord
+		if json.Unmarshal(entry.Data, &record) != nil {
+			return
+		}
+		measured := record.Inputs.PVPower
+		if record.RawInputs != nil {
+			measured = record.RawInputs.PVPower
+		}
+		if modelled := f.plant.clearSkyPower(record.Time); modelled >= minPower {
+			ratios = append(ratios, measured/modelled)
+		}
+	})
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calibratedAt = now
+	if err != nil {
+		return err
+	}
+	f.calibrationSamples = len(ratios)
+	if len(ratios) < minCalibrationSamples {
+		f.calibration = 1
+		return nil
+	}
+	sort.Float64s(ratios)
+	calibration := ratios[int(calibrationPercentile*float64(len(ratios)-1))]
+	// Limits against a broken history, e.g. a meter that reported nothing
+	if calibration < 0.2 {
+		calibration = 0.2
+	}
+	if calibration > 1.5 {
+		calibration = 1.5
+	}
+	f.calibration = calibration
+	return nil
+}
+
+// CalibrateIfDue calibrates if the last calibration is calibrationInterval
+// ago. It reports false if it is not due or already running.
+func (f *Forecaster) CalibrateIfDue(history *HistoryStore, now time.Time) (bool, error) {
+	f.mutex.Lock()
+	due := now.Sub(f.calibratedAt) >= calibrationInterval
+	if due {
+		f.calibratedAt = now
+	}
+	f.mutex.Unlock()
+	if !due {
+		return false, nil
+	}
+	return true, f.Calibrate(history, now)
+}
+
+// RefreshIfDue fetches the forecast of the service if it is due, it reports
+// false if it is not due or there is no service.
+func (f *Forecaster) RefreshIfDue(now time.Time) (bool, error) {
+	if f.provider == nil {
+		return false, nil
+	}
+	return f.provider.RefreshIfDue(now)
+}
+
+// Expected returns the calibrated clear-sky power at t in W.
+func (f *Forecaster) Expected(t time.Time) float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.plant.clearSkyPower(t) * f.calibration
+}
+
+// Clearness returns the measured PV power relative to the expected one
+// between 0 and 1, 1 while the sun is too low to tell.
+func (f *Forecaster) Clearness(now time.Time, measured float64) float64 {
+	expected := f.Expected(now)
+	if expected < minCalibrationShare*f.plant.KWp*1000 {
+		return 1
+	}
+	clearness := measured / expected
+	if clearness < 0 {
+		clearness = 0
+	}
+	if clearness > 1 {
+		clearness = 1
+	}
+	return clearness
+}
+
+// NextHour returns the mean PV power expected in the next hour in W. The
+// forecast of the service is corrected by the measured power, the correction
+// fades out over the hour. Without it the sky is assumed to stay as clear as
+// it is now.
+func (f *Forecaster) NextHour(now time.Time, measured float64) float64 {
+	if forecast, ok := f.externalNextHour(now, measured); ok {
+		return forecast
+	}
+	var sum float64
+	steps := 0
+	for t := now; t.Before(now.Add(forecastHorizon)); t = t.Add(time.Minute) {
+		sum += f.Expected(t)
+		steps++
+	}
+	return sum / float64(steps) * f.Clearness(now, measured)
+}
+
+// externalNextHour returns the mean of the forecast of the service in the
+// next hour, false if it does not cover the hour.
+func (f *Forecaster) externalNextHour(now time.Time, measured float64) (float64, bool) {
+	if f.provider == nil {
+		return 0, false
+	}
+	current, ok := f.provider.Power(now)
+	if !ok {
+		return 0, false
+	}
+	correction := 1.0
+	if current >= minCalibrationShare*f.plant.KWp*1000 {
+		correction = measured / current
+		if correction < 1/maxForecastCorrection {
+			correction = 1 / maxForecastCorrection
+		}
+		if correction > maxForecastCorrection {
+			correction = maxForecastCorrection
+		}
+	}
+	var sum float64
+	steps := 0
+	for t := now; t.Before(now.Add(forecastHorizon)); t = t.Add(time.Minute) {
+		power, ok := f.provider.Power(t)
+		if !ok {
+			return 0, false
+		}
+		fade := float64(t.Sub(now)) / float64(forecastHorizon)
+		sum += power * (correction + (1-correction)*fade)
+		steps++
+	}
+	return sum / float64(steps), true
+}
+
+// ForecastPoint is the expected PV power at a time.
+type ForecastPoint struct {
+	Time time.Time `json:"time"`
+	// Model without clouds and without calibration
+	ClearSky float64 `json:"clearSky"`
+	// Calibrated clear-sky power
+	Expected float64 `json:"expected"`
+	// Forecast of the service, nil where it has none
+	External *float64 `json:"external,omitempty"`
+}
+
+// ForecastResult is the forecast curve and the calibration it is based on.
+type ForecastResult struct {
+	Plant              PVPlant   `json:"plant"`
+	Calibration        float64   `json:"calibration"`
+	CalibrationSamples int       `json:"calibrationSamples"`
+	CalibratedAt       time.Time `json:"calibratedAt"`
+	// Service of the external forecast, nil without
+	Provider *ForecastProviderStatus `json:"provider,omitempty"`
+	Points   []ForecastPoint         `json:"points"`
+}
+
+// Curve returns the forecast for hours in steps of step, starting with the
+// step from is in.
+func (f *Forecaster) Curve(from time.Time, hours int, step time.Duration) ForecastResult {
+	f.mutex.Lock()
+	result := ForecastResult{
+		Plant:              f.plant,
+		Calibration:        f.calibration,
+		CalibrationSamples: f.calibrationSamples,
+		CalibratedAt:       f.calibratedAt,
+		Points:             []ForecastPoint{},
+	}
+	f.mutex.Unlock()
+	if f.provider != nil {
+		status := f.provider.Status()
+		result.Provider = &status
+	}
+	start := from.Truncate(step)
+	end := start.Add(time.Duration(hours) * time.Hour)
+	for t := start; t.Before(end); t = t.Add(step) {
+		clearSky := f.plant.clearSkyPower(t)
+		point := ForecastPoint{Time: t, ClearSky: clearSky, Expected: clearSky * result.Calibration}
+		if f.provider != nil {
+			if external, ok := f.provider.Power(t); ok {
+				point.External = &external
+			}
+		}
+		result.Points = append(result.Points, point)
+	}
+	return result
+}
+
+// standaloneForecaster is the forecaster of getForecast while the monitoring
+// does not run one. It is kept across requests, so the history is not read and
+// the service is not asked on every request.
+var standaloneForecaster struct {
+	mutex sync.Mutex
+	// Properties the forecaster has been created with, see forecasterKey
+	key        string
+	forecaster *Forecaster
+}
+
+// forecasterKey identifies the forecaster of the properties, it changes if
+// they need a new one.
+func forecasterKey(properties models.Properties, cachePath string) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%v|%s|%s|%v|%v|%s", properties.ForecastLatitude, properties.ForecastLongitude,
+		properties.ForecastTilt, properties.ForecastAzimuth, properties.ForecastKWp, properties.ForecastURL,
+		properties.ForecastApiKey, properties.ForecastRefreshOrDefault(), properties.Location(), cachePath)
+}
+
+// getStandaloneForecaster returns the kept forecaster of the properties, nil
+// if none is configured.
+func getStandaloneForecaster(properties models.Properties, cachePath string) *Forecaster {
+	standaloneForecaster.mutex.Lock()
+	defer standaloneForecaster.mutex.Unlock()
+	key := forecasterKey(properties, cachePath)
+	if standaloneForecaster.forecaster == nil || standaloneForecaster.key != key {
+		standaloneForecaster.forecaster = NewForecaster(properties, cachePath)
+		standaloneForecaster.key = key
+	}
+	return standaloneForecaster.forecaster
+}
+
+// getForecast returns the forecast curve, calibrated with the history and
+// with the forecast of the service from cachePath if the monitoring does not
+// run a forecaster. The calibration and the fetch run in the background, until
+// they are done the curve is uncalibrated or without the service. The service
+// being unavailable is not an error.
+func getForecast(properties models.Properties, forecaster *Forecaster, history *HistoryStore, cachePath string,
+	params models.GetForecastParams, now time.Time) (ForecastResult, error) {
+	if forecaster == nil {
+		forecaster = getStandaloneForecaster(properties, cachePath)
+		if forecaster == nil {
+			return ForecastResult{}, fmt.Errorf("no PV system configured for the forecast, set forecastKWp")
+		}
+		go func() {
+			if _, err := forecaster.CalibrateIfDue(history, now); err != nil {
+				log.Warn().Err(err).Msg("Could not calibrate the PV forecast")
+			}
+			if _, err := forecaster.RefreshIfDue(now); err != nil {
+				log.Warn().Err(err).Msg("Could not fetch the PV forecast, using the cached one")
+			}
+		}()
+	}
+	hours := params.Hours
+	if hours <= 0 {
+		hours = 24
+	}
+	if hours > 72 {
+		return ForecastResult{}, fmt.Errorf("at most 72 hours can be forecast")
+	}
+	step := forecastStep
+	if params.StepMinutes > 0 {
+		step = time.Duration(params.StepMinutes) * time.Minute
+	}
+	return forecaster.Curve(now.In(properties.Location()), hours, step), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/db-tech/SolarKostalConbee2Controller/safefile"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// forecastCacheFileName is the file next to the config file that keeps
+	// the last forecast of the service across restarts.
+	forecastCacheFileName = "forecast.json"
+	forecastTimeout       = 10 * time.Second
+	// The measured power corrects the external forecast by at most this factor
+	maxForecastCorrection = 2.0
+)
+
+// ExternalForecastPoint is the PV power the service expects at a time.
+type ExternalForecastPoint struct {
+	Time  time.Time `json:"time"`
+	Watts float64   `json:"watts"`
+}
+
+// ExternalForecast is a forecast fetched from the service, the points are in
+// ascending order.
+type ExternalForecast struct {
+	// URL of the request without the API key, a cached forecast of another
+	// PV system or service is not used
+	Request   string    `json:"request"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	// Time of the last request, successful or not, only set in the cache
+	AttemptedAt time.Time               `json:"attemptedAt,omitempty"`
+	Points      []ExternalForecastPoint `json:"points"`
+}
+
+// forecastSolarResponse is the response of the estimate endpoint of
+// forecast.solar, the times of watts are local times of the PV system.
+type forecastSolarResponse struct {
+	Result *struct {
+		Watts map[string]float64 `json:"watts"`
+	} `json:"result"`
+	Message struct {
+		Code int    `json:"code"`
+		Type string `json:"type"`
+		Text string `json:"text"`
+		Info struct {
+			Timezone string `json:"timezone"`
+		} `json:"info"`
+	} `json:"message"`
+}
+
+// ForecastProvider fetches the forecast of the PV system from a
+// forecast.solar compatible service. The last forecast is kept on disk and
+// used while the service is unavailable, as far as it reaches.
+type ForecastProvider struct {
+	baseURL    string
+	restClient *resty.Client
+	path       string
+	// URL of the request without the API key
+	requestURL string
+	cachePath  string
+	refresh    time.Duration
+	// Timezone of the times in the response if it names none
+	location *time.Location
+
+	mutex    sync.Mutex
+	forecast ExternalForecast
+	// Time of the last fetch, successful or not, and its error
+	attemptedAt time.Time
+	err         error
+}
+
+// forecastCachePath returns the path of the forecast cache in the directory
+// of the config file.
+func forecastCachePath() string {
+	return filepath.Join(filepath.Dir(configPath), forecastCacheFileName)
+}
+
+// NewForecastProvider creates the provider of the service in the properties,
+// nil if none is configured. The forecast is read from the cache at
+// cachePath, it is not cached if cachePath is empty.
+func NewForecastProvider(properties models.Properties, cachePath string) *ForecastProvider {
+	if properties.ForecastURL == "" || properties.ForecastKWp <= 0 {
+		return nil
+	}
+	restClient := resty.New()
+	restClient.SetBaseURL(strings.TrimSuffix(properties.ForecastURL, "/"))
+	restClient.SetTimeout(forecastTimeout)
+
+	// forecast.solar counts the azimuth from south, -90 is east
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	path := fmt.Sprintf("/estimate/%s/%s/%s/%s/%s", format(properties.ForecastLatitude), format(properties.ForecastLongitude),
+		format(properties.ForecastTilt), format(properties.ForecastAzimuth-180), format(properties.ForecastKWp))
+	requestURL := restClient.BaseURL + path
+	if properties.ForecastApiKey != "" {
+		path = "/" + properties.ForecastApiKey + path
+	}
+
+	provider := &ForecastProvider{
+		baseURL:    properties.ForecastURL,
+		restClient: restClient,
+		path:       path,
+		requestURL: requestURL,
+		cachePath:  cachePath,
+		refresh:    properties.ForecastRefreshOrDefault(),
+		location:   properties.Location(),
+	}
+	provider.readCache()
+	return provider
+}
+
+// readCache reads the cached forecast, a fresh cache or a recent failed
+// request is not fetched again on a restart. A missing or broken cache or one
+// of another request is ignored.
+func (p *ForecastProvider) readCache() {
+	if p.cachePath == "" {
+		return
+	}
+	data, err := os.ReadFile(p.cachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("Could not read %s", p.cachePath)
+		}
+		return
+	}
+	var forecast ExternalForecast
+	if err := json.Unmarshal(data, &forecast); err != nil {
+		log.Warn().Err(err).Msgf("Ignoring broken forecast cache %s", p.cachePath)
+		return
+	}
+	if forecast.Request != p.requestURL {
+		log.Info().Msgf("Ignoring forecast cache %s of %s", p.cachePath, forecast.Request)
+		return
+	}
+	p.attemptedAt = forecast.FetchedAt
+	if forecast.AttemptedAt.After(p.attemptedAt) {
+		p.attemptedAt = forecast.AttemptedAt
+	}
+	forecast.AttemptedAt = time.Time{}
+	p.forecast = forecast
+}
+
+// Fetch requests the forecast from the service and caches it. On errors the
+// last forecast is kept, the cache keeps the time of the failed request to
+// respect the rate limit of the service across restarts.
+func (p *ForecastProvider) Fetch(now time.Time) error {
+	forecast, err := p.request(now)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.attemptedAt = now
+	p.err = err
+	if err == nil {
+		p.forecast = forecast
+	}
+	if cacheErr := p.writeCache(); err == nil {
+		err = cacheErr
+	}
+	return err
+}
+
+// writeCache writes the forecast and the time of the last request to the
+// cache, p.mutex has to be locked.
+func (p *ForecastProvider) writeCache() error {
+	if p.cachePath == "" {
+		return nil
+	}
+	cached := p.forecast
+	cached.Request = p.requestURL
+	cached.AttemptedAt = p.attemptedAt
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return safefile.WriteFile(p.cachePath, data, 0600, 0)
+}
+
+func (p *ForecastProvider) request(now time.Time) (ExternalForecast, error) {
+	response, err := p.restClient.R().SetHeader("Accept", "application/json").Get(p.path)
+	if err != nil {
+		// The URL contains the API key, the error is logged and reported to
+		// the clients
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return ExternalForecast{}, fmt.Errorf("%s %s: %v", urlErr.Op, p.requestURL, urlErr.Err)
+		}
+		return ExternalForecast{}, err
+	}
+	var decoded forecastSolarResponse
+	decodeErr := json.Unmarshal(response.Body(), &decoded)
+	if response.StatusCode() != 200 {
+		if decodeErr == nil && decoded.Message.Text != "" {
+			return ExternalForecast{}, fmt.Errorf("unexpected status code %d: %s", response.StatusCode(), decoded.Message.Text)
+		}
+		return ExternalForecast{}, fmt.Errorf("unexpected status code %d", response.StatusCode())
+	}
+	if decodeErr != nil {
+		return ExternalForecast{}, fmt.Errorf("invalid response: %v", decodeErr)
+	}
+	if decoded.Result == nil || len(decoded.Result.Watts) == 0 {
+		return ExternalForecast{}, fmt.Errorf("the response contains no forecast: %s", decoded.Message.Text)
+	}
+
+	location := p.location
+	if decoded.Message.Info.Timezone != "" {
+		if named, err := time.LoadLocation(decoded.Message.Info.Timezone); err == nil {
+			location = named
+		}
+	}
+	forecast := ExternalForecast{Request: p.requestURL, FetchedAt: now, Points: make([]ExternalForecastPoint, 0, len(decoded.Result.Watts))}
+	for local, watts := range decoded.Result.Watts {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", local, location)
+		if err != nil {
+			return ExternalForecast{}, fmt.Errorf("invalid time %q in the response", local)
+		}
+		forecast.Points = append(forecast.Points, ExternalForecastPoint{Time: t, Watts: watts})
+	}
+	sort.Slice(forecast.Points, func(i, j int) bool {
+		return forecast.Points[i].Time.Before(forecast.Points[j].Time)
+	})
+	return forecast, nil
+}
+
+// RefreshIfDue fetches the forecast if the last attempt is the refresh
+// interval ago, failed attempts are not retried earlier to respect the rate
+// limit of the service. It reports false if no fetch was due.
+func (p *ForecastProvider) RefreshIfDue(now time.Time) (bool, error) {
+	p.mutex.Lock()
+	due := now.Sub(p.attemptedAt) >= p.refresh
+	if due {
+		p.attemptedAt = now
+	}
+	p.mutex.Unlock()
+	if !due {
+		return false, nil
+	}
+	return true, p.Fetch(now)
+}
+
+// Power returns the PV power the service expects at t, interpolated between
+// its points. It reports false if the forecast does not cover t.
+func (p *ForecastProvider) Power(t time.Time) (float64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	points := p.forecast.Points
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(t)
+	})
+	switch {
+	case i == len(points):
+		return 0, false
+	case points[i].Time.Equal(t):
+		return points[i].Watts, true
+	case i == 0:
+		return 0, false
+	}
+	before, after := points[i-1], points[i]
+	share := float64(t.Sub(before.Time)) / float64(after.Time.Sub(before.Time))
+	return before.Watts + share*(after.Watts-before.Watts), true
+}
+
+// ForecastProviderStatus tells whether the forecast of the service is
+// available.
+type ForecastProviderStatus struct {
+	URL string `json:"url"`
+	// Time of the forecast in use, zero without forecast
+	FetchedAt time.Time `json:"fetchedAt"`
+	// Error of the last fetch, the last forecast is used meanwhile
+	Error string `json:"error,omitempty"`
+}
+
+func (p *ForecastProvider) Status() ForecastProviderStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := ForecastProviderStatus{URL: p.baseURL, FetchedAt: p.forecast.FetchedAt}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeForecastSolar answers the estimate endpoint like forecast.solar with
+// watts rising by 1000 W per hour from 06:00 local time.
+type fakeForecastSolar struct {
+	requests []string
+	// Status code of the next responses, 200 if 0
+	status int
+}
+
+func newFakeForecastSolar(t *testing.T, service *fakeForecastSolar) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.requests = append(service.requests, r.URL.Path)
+		if service.status != 0 && service.status != http.StatusOK {
+			w.WriteHeader(service.status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"result":  nil,
+				"message": map[string]interface{}{"code": service.status, "type": "error", "text": "Rate limit for API calls reached."},
+			})
+			return
+		}
+		if !strings.Contains(r.URL.Path, "/estimate/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": map[string]interface{}{
+				"watts": map[string]float64{
+					"2024-06-21 06:00:00": 0,
+					"2024-06-21 07:00:00": 1000,
+					"2024-06-21 08:00:00": 2000,
+					"2024-06-21 09:00:00": 3000,
+				},
+			},
+			"message": map[string]interface{}{"code": 0, "type": "success", "text": "",
+				"info": map[string]interface{}{"timezone": "Europe/Berlin"}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func forecastSolarProperties(url string) models.Properties {
+	return models.Properties{ForecastLatitude: 52.5, ForecastLongitude: 13.4, ForecastTilt: 30, ForecastAzimuth: 90,
+		ForecastKWp: 5, ForecastURL: url}
+}
+
+func TestForecastProvider(t *testing.T) {
+	service := &fakeForecastSolar{}
+	server := newFakeForecastSolar(t, service)
+	cachePath := filepath.Join(t.TempDir(), forecastCacheFileName)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	now := time.Date(2024, 6, 21, 5, 0, 0, 0, berlin)
+
+	// Test case 1: The forecast is fetched for the PV system, the azimuth is counted from south
+	provider := NewForecastProvider(forecastSolarProperties(server.URL+"/"), cachePath)
+	if err := provider.Fetch(now); err != nil {
+		t.Fatalf("Test case 1: Expected nil error but got %v", err)
+	}
+	if len(service.requests) != 1 || service.requests[0] != "/estimate/52.5/13.4/30/-90/5" {
+		t.Errorf("Test case 1: Expected a request of /estimate/52.5/13.4/30/-90/5 but got %v", service.requests)
+	}
+
+	// Test case 2: The times are local times of the PV system, the power is interpolated
+	if power, ok := provider.Power(time.Date(2024, 6, 21, 5, 30, 0, 0, time.UTC)); !ok || power != 1500 {
+		t.Errorf("Test case 2: Expected 1500 W but got %.0f W (%v)", power, ok)
+	}
+
+	// Test case 3: No forecast outside of the points
+	if _, ok := provider.Power(time.Date(2024, 6, 21, 10, 0, 0, 0, berlin)); ok {
+		t.Errorf("Test case 3: Expected no forecast after the last point")
+	}
+
+	// Test case 4: After a restart the cached forecast is used without fetching it again
+	provider = NewForecastProvider(forecastSolarProperties(server.URL), cachePath)
+	if fetched, _ := provider.RefreshIfDue(now.Add(10 * time.Minute)); fetched || len(service.requests) != 1 {
+		t.Errorf("Test case 4: Expected no further request but got %v", service.requests)
+	}
+	if power, ok := provider.Power(time.Date(2024, 6, 21, 8, 0, 0, 0, berlin)); !ok || power != 2000 {
+		t.Errorf("Test case 4: Expected 2000 W from the cache but got %.0f W (%v)", power, ok)
+	}
+
+	// Test case 5: While the service fails the last forecast is kept and the error is reported
+	service.status = http.StatusTooManyRequests
+	fetched, err := provider.RefreshIfDue(now.Add(2 * time.Hour))
+	if !fetched || err == nil || !strings.Contains(err.Error(), "Rate limit") {
+		t.Errorf("Test case 5: Expected the rate limit error but got %v", err)
+	}
+	if _, ok := provider.Power(time.Date(2024, 6, 21, 8, 0, 0, 0, berlin)); !ok {
+		t.Errorf("Test case 5: Expected the last forecast to be kept")
+	}
+	if status := provider.Status(); status.Error == "" || status.FetchedAt.IsZero() {
+		t.Errorf("Test case 5: Expected the error and the time of the last forecast but got %+v", status)
+	}
+
+	// Test case 6: Failed fetches are not retried before the refresh interval, also not after a restart
+	if fetched, _ := provider.RefreshIfDue(now.Add(2*time.Hour + time.Minute)); fetched {
+		t.Errorf("Test case 6: Expected no retry within the refresh interval")
+	}
+	provider = NewForecastProvider(forecastSolarProperties(server.URL), cachePath)
+	if fetched, _ := provider.RefreshIfDue(now.Add(2*time.Hour + time.Minute)); fetched {
+		t.Errorf("Test case 6: Expected no retry within the refresh interval after a restart")
+	}
+	if _, ok := provider.Power(time.Date(2024, 6, 21, 8, 0, 0, 0, berlin)); !ok {
+		t.Errorf("Test case 6: Expected the last forecast in the cache")
+	}
+
+	// Test case 7: The API key is part of the path
+	properties := forecastSolarProperties(server.URL)
+	properties.ForecastApiKey = "secret"
+	service.status = 0
+	if err := NewForecastProvider(properties, "").Fetch(now); err != nil || !strings.HasPrefix(service.requests[len(service.requests)-1], "/secret/estimate/") {
+		t.Errorf("Test case 7: Expected a request with the API key but got %v (%v)", service.requests, err)
+	}
+
+	// Test case 8: The API key is not part of errors
+	properties.ForecastURL = "http://127.0.0.1:1"
+	if err := NewForecastProvider(properties, "").Fetch(now); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Test case 8: Expected an error without the API key but got %v", err)
+	}
+
+	// Test case 9: The cache of another PV system is not used
+	properties = forecastSolarProperties(server.URL)
+	properties.ForecastKWp = 10
+	if _, ok := NewForecastProvider(properties, cachePath).Power(time.Date(2024, 6, 21, 8, 0, 0, 0, berlin)); ok {
+		t.Errorf("Test case 9: Expected no forecast from the cache of another request")
+	}
+
+	// Test case 10: Without URL there is no provider
+	if provider := NewForecastProvider(forecastSolarProperties(""), cachePath); provider != nil {
+		t.Errorf("Test case 10: Expected no provider but got %+v", provider)
+	}
+}
+
+func TestForecasterExternal(t *testing.T) {
+	service := &fakeForecastSolar{}
+	server := newFakeForecastSolar(t, service)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	now := time.Date(2024, 6, 21, 7, 0, 0, 0, berlin)
+	forecaster := NewForecaster(forecastSolarProperties(server.URL), "")
+	model := NewForecaster(forecastSolarProperties(""), "")
+
+	// Test case 1: Until the forecast is fetched the local model is used
+	if forecast := forecaster.NextHour(now, 1000); forecast != model.NextHour(now, 1000) {
+		t.Errorf("Test case 1: Expected %.0f W of the local model but got %.0f W", model.NextHour(now, 1000), forecast)
+	}
+	if fetched, err := forecaster.RefreshIfDue(now); !fetched || err != nil {
+		t.Fatalf("Test case 1: Expected a fetch but got %v", err)
+	}
+
+	// Test case 2: The forecast of the service is used if it matches the measured power
+	if forecast := forecaster.NextHour(now, 1000); math.Abs(forecast-1500) > 20 {
+		t.Errorf("Test case 2: Expected about 1500 W but got %.0f W", forecast)
+	}
+
+	// Test case 3: The measured power corrects the forecast, fading out over the hour
+	if forecast := forecaster.NextHour(now, 500); forecast <= 750 || forecast >= 1500 {
+		t.Errorf("Test case 3: Expected between 750 and 1500 W but got %.0f W", forecast)
+	}
+
+	// Test case 4: The curve contains the forecast of the service and its status
+	result := forecaster.Curve(now, 1, 30*time.Minute)
+	if result.Provider == nil || len(result.Points) != 2 || result.Points[1].External == nil || *result.Points[1].External != 1500 {
+		t.Errorf("Test case 4: Expected 1500 W at 07:30 but got %+v", result)
+	}
+
+	// Test case 5: Beyond the forecast of the service the local model is used
+	late := time.Date(2024, 6, 21, 12, 0, 0, 0, berlin)
+	if forecast := forecaster.NextHour(late, 0); forecast != model.NextHour(late, 0) {
+		t.Errorf("Test case 5: Expected %.0f W of the local model but got %.0f W", model.NextHour(late, 0), forecast)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecasterCalibrate(t *testing.T) {
+	properties := models.Properties{ForecastLatitude: 48, ForecastLongitude: 11, ForecastTilt: 30, ForecastAzimuth: 180, ForecastKWp: 8}
+	now := time.Date(2024, 5, 10, 20, 0, 0, 0, time.UTC)
+	history := OpenHistoryStore(t.TempDir())
+	forecaster := NewForecaster(properties, "")
+
+	// Test case 1: Without history the model is used as it is
+	if err := forecaster.Calibrate(history, now); err != nil {
+		t.Fatalf("Test case 1: Expected nil error but got %v", err)
+	}
+	if result := forecaster.Curve(now, 1, time.Hour); result.Calibration != 1 || result.CalibrationSamples != 0 {
+		t.Errorf("Test case 1: Expected calibration 1 without samples but got %.2f with %d", result.Calibration, result.CalibrationSamples)
+	}
+
+	// Test case 2: A plant that delivers 80% of the model on clear days
+	for day := 3; day > 0; day-- {
+		for minute := 0; minute < 24*60; minute += 10 {
+			at := time.Date(2024, 5, 10-day, 0, minute, 0, 0, time.UTC)
+			pv := 0.8 * forecaster.plant.clearSkyPower(at)
+			if day == 2 {
+				// A cloudy day
+				pv /= 3
+			}
+			history.Append(historyKindDecision, at, DecisionRecord{Time: at, Inputs: InverterData{PVPower: pv}})
+		}
+	}
+	if err := forecaster.Calibrate(history, now); err != nil {
+		t.Fatalf("Test case 2: Expected nil error but got %v", err)
+	}
+	if result := forecaster.Curve(now, 1, time.Hour); math.Abs(result.Calibration-0.8) > 0.01 || result.CalibrationSamples < minCalibrationSamples {
+		t.Errorf("Test case 2: Expected calibration 0.8 but got %.2f with %d samples", result.Calibration, result.CalibrationSamples)
+	}
+
+	// Test case 3: The calibration is not repeated within a day
+	if calibrated, _ := forecaster.CalibrateIfDue(history, now.Add(time.Hour)); calibrated {
+		t.Errorf("Test case 3: Expected no calibration")
+	}
+}
+
+func TestForecasterNextHour(t *testing.T) {
+	forecaster := NewForecaster(models.Properties{ForecastLatitude: 48, ForecastLongitude: 11, ForecastTilt: 30, ForecastAzimuth: 180, ForecastKWp: 8}, "")
+	noon := time.Date(2024, 6, 21, 11, 0, 0, 0, time.UTC)
+	expected := forecaster.Expected(noon)
+
+	// Test case 1: Under a clear sky the next hour around noon is close to the current power
+	if forecast := forecaster.NextHour(noon, expected); math.Abs(forecast-expected) > 0.05*expected {
+		t.Errorf("Test case 1: Expected about %.0f W but got %.0f W", expected, forecast)
+	}
+
+	// Test case 2: Clouds are assumed to stay
+	if forecast := forecaster.NextHour(noon, expected/2); math.Abs(forecast-expected/2) > 0.05*expected {
+		t.Errorf("Test case 2: Expected about %.0f W but got %.0f W", expected/2, forecast)
+	}
+
+	// Test case 3: In the evening the power is expected to drop
+	evening := time.Date(2024, 6, 21, 18, 0, 0, 0, time.UTC)
+	if forecast := forecaster.NextHour(evening, forecaster.Expected(evening)); forecast >= forecaster.Expected(evening) {
+		t.Errorf("Test case 3: Expected less than %.0f W but got %.0f W", forecaster.Expected(evening), forecast)
+	}
+}
+
+func TestGetForecast(t *testing.T) {
+	history := OpenHistoryStore(t.TempDir())
+	now := time.Date(2024, 6, 21, 10, 7, 0, 0, time.UTC)
+
+	// Test case 1: Without PV system there is no forecast
+	if _, err := getForecast(models.Properties{}, nil, history, "", models.GetForecastParams{}, now); err == nil {
+		t.Errorf("Test case 1: Expected an error but got nil")
+	}
+
+	// Test case 2: A day in steps of 15 minutes by default, starting at the current step
+	properties := models.Properties{ForecastLatitude: 48, ForecastLongitude: 11, ForecastTilt: 30, ForecastAzimuth: 180, ForecastKWp: 8}
+	result, err := getForecast(properties, nil, history, "", models.GetForecastParams{}, now)
+	if err != nil {
+		t.Fatalf("Test case 2: Expected nil error but got %v", err)
+	}
+	if len(result.Points) != 96 || !result.Points[0].Time.Equal(time.Date(2024, 6, 21, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Test case 2: Expected 96 points from 10:00 but got %d from %v", len(result.Points), result.Points[0].Time)
+	}
+
+	// Test case 3: Too many hours
+	if _, err := getForecast(properties, nil, history, "", models.GetForecastParams{Hours: 100}, now); err == nil {
+		t.Errorf("Test case 3: Expected an error but got nil")
+	}
+
+	// Test case 4: The forecaster is kept across requests
+	kept := getStandaloneForecaster(properties, "")
+	getForecast(properties, nil, history, "", models.GetForecastParams{}, now)
+	if forecaster := getStandaloneForecaster(properties, ""); forecaster != kept {
+		t.Errorf("Test case 4: Expected the kept forecaster but got a new one")
+	}
+
+	// Test case 5: Changed properties need a new forecaster
+	properties.ForecastKWp = 10
+	if forecaster := getStandaloneForecaster(properties, ""); forecaster == kept || forecaster.plant.KWp != 10 {
+		t.Errorf("Test case 5: Expected a new forecaster of 10 kWp but got %+v", forecaster.plant)
+	}
+}
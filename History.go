@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/db-tech/SolarKostalConbee2Controller/safefile"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// historyDirName is the directory next to the config file that keeps the
+	// history, one JSON lines file per day.
+	historyDirName = "history"
+	// Days of history that are kept
+	historyRetentionDays = 30
+)
+
+// HistoryEntry is a line of a history file.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// Type of the data, e.g. decision
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+// HistoryStore appends entries to daily files and reads them back. Old files
+// are removed after historyRetentionDays.
+type HistoryStore struct {
+	dir   string
+	mutex sync.Mutex
+	// Day of the last append, the files are pruned when it changes
+	day string
+}
+
+// historyPath returns the path of the history directory in the directory of
+// the config file.
+func historyPath() string {
+	return filepath.Join(filepath.Dir(configPath), historyDirName)
+}
+
+func OpenHistoryStore(dir string) *HistoryStore {
+	return &HistoryStore{dir: dir}
+}
+
+// Append writes the data as an entry of the kind at t.
+func (h *HistoryStore) Append(kind string, t time.Time, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(HistoryEntry{Time: t, Kind: kind, Data: raw})
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	day := t.Format("2006-01-02")
+	if day != h.day {
+		if err := os.MkdirAll(h.dir, 0700); err != nil {
+			return err
+		}
+		h.day = day
+		h.prune(t)
+	}
+	file, err := os.OpenFile(filepath.Join(h.dir, day+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// prune removes the files older than historyRetentionDays.
+func (h *HistoryStore) prune(now time.Time) {
+	oldest := now.AddDate(0, 0, -historyRetentionDays).Format("2006-01-02")
+	for _, day := range h.days() {
+		if day < oldest {
+			if err := os.Remove(filepath.Join(h.dir, day+".jsonl")); err != nil {
+				log.Warn().Err(err).Msgf("Could not remove the history of %s", day)
+			}
+		}
+	}
+}
+
+// days returns the days with a history file in ascending order.
+func (h *HistoryStore) days() []string {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil
+	}
+	var days []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".jsonl") {
+			days = append(days, strings.TrimSuffix(entry.Name(), ".jsonl"))
+		}
+	}
+	sort.Strings(days)
+	return days
+}
+
+// Read calls visit with the entries of the kind from from until to in
+// chronological order. Broken lines, e.g. from a power cut while writing,
+// are skipped. Appends are not blocked, a line that is being written is
+// skipped as well.
+func (h *HistoryStore) Read(kind string, from time.Time, to time.Time, visit func(entry HistoryEntry)) error {
+	// Files are named by the local day, so the range is widened by a day on
+	// both ends to be safe across timezones
+	first := from.AddDate(0, 0, -1).Format("2006-01-02")
+	last := to.AddDate(0, 0, 1).Format("2006-01-02")
+	for _, day := range h.days() {
+		if day < first || day > last {
+			continue
+		}
+		file, err := os.Open(filepath.Join(h.dir, day+".jsonl"))
+		if os.IsNotExist(err) {
+			// Pruned meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if entry.Kind == kind && !entry.Time.Before(from) && !entry.Time.After(to) {
+				visit(entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export returns the content of the history files by day.
+func (h *HistoryStore) Export() (map[string]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	files := make(map[string]string)
+	for _, day := range h.days() {
+		data, err := os.ReadFile(filepath.Join(h.dir, day+".jsonl"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[day] = string(data)
+	}
+	return files, nil
+}
+
+// Restore writes the history files of the days as returned by Export. Files
+// of the same days are replaced, the other ones are kept.
+func (h *HistoryStore) Restore(files map[string]string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return err
+	}
+	for day, data := range files {
+		err := safefile.WriteFile(filepath.Join(h.dir, day+".jsonl"), []byte(data), 0600, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+	history := OpenHistoryStore(dir)
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := history.Append("sample", start.Add(time.Duration(i)*time.Hour), i); err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+	}
+	history.Append("other", start, "ignored")
+
+	read := func(from, to time.Time) []string {
+		var values []string
+		err := history.Read("sample", from, to, func(entry HistoryEntry) {
+			values = append(values, string(entry.Data))
+		})
+		if err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+		return values
+	}
+
+	// Test case 1: Only the entries of the kind in the range are read
+	if values := read(start.Add(30*time.Minute), start.Add(2*time.Hour)); len(values) != 2 || values[0] != "1" {
+		t.Errorf("Test case 1: Expected the entries 1 and 2 but got %v", values)
+	}
+
+	// Test case 2: Broken lines are skipped
+	file, _ := os.OpenFile(filepath.Join(dir, "2024-05-10.jsonl"), os.O_APPEND|os.O_WRONLY, 0600)
+	file.WriteString("{\"time\":\n")
+	file.Close()
+	history.Append("sample", start.Add(3*time.Hour), 3)
+	if values := read(start, start.Add(4*time.Hour)); len(values) != 4 {
+		t.Errorf("Test case 2: Expected 4 entries but got %v", values)
+	}
+
+	// Test case 3: Files older than the retention are removed on a new day
+	history.Append("sample", start.AddDate(0, 0, historyRetentionDays+1), 4)
+	if _, err := os.Stat(filepath.Join(dir, "2024-05-10.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("Test case 3: Expected the old file to be removed but got %v", err)
+	}
+}
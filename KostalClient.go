@@ -3,8 +3,9 @@ package main
 import (
 	"errors"
 	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
 	"github.com/geschke/golrackpi"
-	"math/rand"
+	"github.com/rs/zerolog/log"
 )
 
 type InverterData struct {
@@ -20,6 +21,12 @@ type InverterData struct {
 	// if < 0: Power taken from the grid
 	// Netzbezug
 	Overproduction float64 `json:"Overproduction"`
+
+	// State of charge of the battery in %, nil without battery
+	BatterySoc *float64 `json:"BatterySoc,omitempty"`
+
+	// Mean PV power expected in the next hour, nil without forecast
+	ForecastPVPower *float64 `json:"ForecastPVPower,omitempty"`
 }
 
 type Inverter interface {
@@ -73,6 +80,10 @@ func (k *KostalClient) GetInverterData() (InverterData, error) {
 		return inverterData, err
 	}
 	inverterData.Overproduction = inverterData.PVPower - inverterData.HousePowerConsumption
+	// Only inverters with a battery report it
+	if soc, err := GetProcessData(k.AuthClient, "devices:local:battery", "SoC"); err == nil {
+		inverterData.BatterySoc = &soc
+	}
 	return inverterData, nil
 }
 
@@ -96,56 +107,19 @@ func (k *KostalClient) IsConnected() bool {
 	return k.AuthClient != nil
 }
 
-type KostalTestClient struct {
-	KostalClient
-	connected bool
-}
-
-func NewInverterClient(address string, password string, clientType string) Inverter {
-	if password == "test" {
-		return NewKostalTestClient(address, password)
-	} else {
-		return NewKostalClient(address, password)
-	}
-}
-
-func NewKostalTestClient(address string, password string) *KostalTestClient {
-	kostal := &KostalTestClient{
-		KostalClient: KostalClient{
-			Address:  address,
-			Scheme:   "http",
-			Password: password,
-		},
-	}
-	if password == "test" {
-		kostal.connected = true
-	} else {
-		kostal.connected = false
-	}
-	return kostal
-}
-
-func (k *KostalTestClient) GetInverterData() (InverterData, error) {
-	randomHousePowerConsumption := rand.Float64() * 1000
-	randomPVPower := rand.Float64() * 1000
-	randomGridConsumption := randomHousePowerConsumption - randomPVPower
-
-	return InverterData{
-		HousePowerConsumption: randomHousePowerConsumption,
-		PVPower:               randomPVPower,
-		Overproduction:        randomGridConsumption,
-	}, nil
-}
-
-func (k *KostalTestClient) Connect() error {
-	if k.Password == "test" {
-		k.connected = true
-	} else {
-		k.connected = false
+// NewInverterClient creates the inverter selected by KostalType. An empty type
+// is treated as a Kostal inverter.
+func NewInverterClient(properties models.Properties) Inverter {
+	switch properties.KostalType {
+	case models.InverterTypeSimulator:
+		config, err := SimulatorConfigFromProperties(properties)
+		if err != nil {
+			log.Error().Err(err).Msg("Simulating today instead")
+		}
+		return NewSimulatorInverter(config)
+	case models.InverterTypeReplay:
+		return NewReplayInverter(properties.ReplayFile, nil)
+	default:
+		return NewKostalClient(properties.KostalAddress, properties.KostalPassword)
 	}
-	return nil
-}
-
-func (k *KostalTestClient) IsConnected() bool {
-	return k.connected
 }
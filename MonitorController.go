@@ -2,67 +2,308 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/db-tech/JsonRpcWebsocketServer/jrws"
 	"github.com/db-tech/SolarKostalConbee2Controller/models"
 	"github.com/rs/zerolog/log"
+	"sync"
 	"time"
 )
 
 const (
 	MonitoringEventPropertiesUpdated = "PropertiesUpdated"
+	MonitoringEventStartMonitoring   = "StartMonitoring"
 	MonitoringEventStopMonitoring    = "StopMonitoring"
+	// Events queued while the monitoring is busy with a tick, starting and
+	// stopping does not wait for it
+	monitoringEventQueue = 16
+)
+
+// monitoringEvent asks the monitoring to start with the properties or to
+// stop. Starts and stops share a queue, so they are handled in order.
+type monitoringEvent struct {
+	name       string
+	properties models.Properties
+}
+
+const (
+	// Measurements below are standby or a thermostat that has cut off
+	minLearnedPower = 10
+	// Weight of a new measurement in the learned average power
+	learnedPowerWeight = 0.05
+	stateSaveInterval  = 5 * time.Minute
 )
 
 type MonitoringController struct {
 	conbeeClient    *ConbeeClient
 	inverter        Inverter
 	websocketServer *jrws.WebsocketServer
-	eventChan       chan string
-	startEventChan  chan models.Properties
+	eventChan       chan monitoringEvent
 	isRunning       bool
+	clientsMutex    sync.Mutex
+	stateStore      *StateStore
+	history         *HistoryStore
+	decisionLog     *DecisionLog
+	// Actuators of the loads by load name, created on first use
+	actuators map[string]loadActuator
+	// Loads whose actuator was unreachable at the last check
+	unreachable map[string]bool
+	// The command to a load that has failed in the last polls, it is retried
+	// at the next poll instead of waiting for the device
+	switchFailures map[string]switchFailure
+	// Since when the conditions with a duration hold, by load and rule. Only
+	// used by the monitoring loop.
+	ruleTimers map[string]map[int]time.Time
+	// Smoothing of the inverter readings, nil if they are used as they are
+	filter *InverterFilter
+	// Forecast of the PV power, nil without configured PV system
+	forecaster *Forecaster
+	// Virtual states of the loads in shadow mode
+	shadow      map[string]*ShadowState
+	shadowMutex sync.Mutex
 }
 
-func NewMonitoringController(conbeeClient *ConbeeClient, inverter Inverter, websocketServer *jrws.WebsocketServer) *MonitoringController {
+type loadActuator struct {
+	load     models.Load
+	actuator Actuator
+}
+
+func NewMonitoringController(conbeeClient *ConbeeClient, inverter Inverter, stateStore *StateStore, history *HistoryStore,
+	decisionLog *DecisionLog, websocketServer *jrws.WebsocketServer) *MonitoringController {
 	monitoring := &MonitoringController{
 		conbeeClient:    conbeeClient,
 		inverter:        inverter,
+		stateStore:      stateStore,
+		history:         history,
+		decisionLog:     decisionLog,
 		websocketServer: websocketServer,
-		eventChan:       make(chan string),
-		startEventChan:  make(chan models.Properties),
+		eventChan:       make(chan monitoringEvent, monitoringEventQueue),
 		isRunning:       false,
+		actuators:       make(map[string]loadActuator),
+		unreachable:     make(map[string]bool),
+		switchFailures:  make(map[string]switchFailure),
+		ruleTimers:      make(map[string]map[int]time.Time),
+		shadow:          make(map[string]*ShadowState),
 	}
 	monitoring.run()
 	return monitoring
 }
 
+// SetClients replaces the clients used by the monitoring, e.g. after the
+// config file has been changed.
+func (m *MonitoringController) SetClients(conbeeClient *ConbeeClient, inverter Inverter) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	m.conbeeClient = conbeeClient
+	m.inverter = inverter
+	m.actuators = make(map[string]loadActuator)
+}
+
+func (m *MonitoringController) inverterFilter() *InverterFilter {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	return m.filter
+}
+
+// Forecaster returns the forecaster of the monitoring, nil without configured
+// PV system.
+func (m *MonitoringController) Forecaster() *Forecaster {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	return m.forecaster
+}
+
+// updateForecast calibrates the forecast once a day, which reads two weeks of
+// history, and fetches the forecast of the service when it is due. Both run
+// in the background, so a slow service does not delay the monitoring.
+func (m *MonitoringController) updateForecast(now time.Time) {
+	forecaster := m.Forecaster()
+	if forecaster == nil {
+		return
+	}
+	go func() {
+		if fetched, err := forecaster.RefreshIfDue(now); err != nil {
+			log.Warn().Err(err).Msg("Could not fetch the PV forecast, using the cached one or the local model")
+		} else if fetched {
+			log.Info().Msg("Fetched the PV forecast")
+		}
+		calibrated, err := forecaster.CalibrateIfDue(m.history, now)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not calibrate the forecast")
+		} else if calibrated {
+			result := forecaster.Curve(now, 0, forecastStep)
+			log.Info().Msgf("Calibrated the forecast with %d samples: %.2f", result.CalibrationSamples, result.Calibration)
+		}
+	}()
+}
+
+func (m *MonitoringController) clients() (*ConbeeClient, Inverter) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	return m.conbeeClient, m.inverter
+}
+
+// actuator returns the actuator of the load. It is recreated when the
+// configuration of the load has changed.
+func (m *MonitoringController) actuator(load models.Load) (Actuator, error) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	if cached, ok := m.actuators[load.Name]; ok && cached.load == load {
+		return cached.actuator, nil
+	}
+	actuator, err := NewActuator(load, m.conbeeClient)
+	if err != nil {
+		return nil, err
+	}
+	m.actuators[load.Name] = loadActuator{load: load, actuator: actuator}
+	return actuator, nil
+}
+
+// switchFailure is a command to a load that has failed in polls in a row.
+type switchFailure struct {
+	action SwitchAction
+	level  int
+	count  int
+}
+
+// switchFailed counts a failed command to the load, which is retried at the
+// next poll if the decision still holds. It returns the number of failures in
+// a row.
+func (m *MonitoringController) switchFailed(decision SwitchDecision, err error) int {
+	m.clientsMutex.Lock()
+	failure := m.switchFailures[decision.Load]
+	if failure.action != decision.Action || failure.level != decision.Level {
+		failure = switchFailure{action: decision.Action, level: decision.Level}
+	}
+	failure.count++
+	m.switchFailures[decision.Load] = failure
+	m.clientsMutex.Unlock()
+	if failure.count < switchAttempts {
+		log.Warn().Err(err).Msgf("Could not switch load %s, attempt %d of %d, retrying at the next poll",
+			decision.Load, failure.count, switchAttempts)
+	} else {
+		log.Error().Err(err).Msgf("Could not switch load %s in %d attempts, giving up until the decision changes",
+			decision.Load, failure.count)
+	}
+	return failure.count
+}
+
+// switchGivenUp reports whether the command of the decision has already
+// failed switchAttempts times in a row, so it is not sent again.
+func (m *MonitoringController) switchGivenUp(decision SwitchDecision) bool {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	failure := m.switchFailures[decision.Load]
+	return failure.action == decision.Action && failure.level == decision.Level && failure.count >= switchAttempts
+}
+
+// resetSwitchFailures forgets the failed commands to the load, after a
+// successful command or when no command is due any more.
+func (m *MonitoringController) resetSwitchFailures(name string) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	delete(m.switchFailures, name)
+}
+
+// switchFailing reports whether the commands to the load have failed in
+// switchAttempts polls in a row.
+func (m *MonitoringController) switchFailing(name string) bool {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	return m.switchFailures[name].count >= switchAttempts
+}
+
+// setReachable records whether the actuator of the load is reachable and
+// logs when this changes.
+func (m *MonitoringController) setReachable(name string, reachable bool) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	if m.unreachable[name] == !reachable {
+		return
+	}
+	if reachable {
+		log.Info().Msgf("Load %s is reachable again, resuming decisions", name)
+		delete(m.unreachable, name)
+		// Commands given up while the load was unreachable are sent again
+		delete(m.switchFailures, name)
+	} else {
+		log.Warn().Msgf("Load %s is unreachable, pausing decisions until it is back", name)
+		m.unreachable[name] = true
+	}
+}
+
+// LoadState is the state of a switched load.
+type LoadState struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	On      bool   `json:"on"`
+	// False while the actuator cannot be reached, On is unknown then
+	Reachable bool `json:"reachable"`
+	// "actuator unreachable", "switching failed" or empty
+	Status string `json:"status,omitempty"`
+	// Power drawn by the load in W, if the actuator measures it
+	Power *float64 `json:"power,omitempty"`
+	// Average power of the load while it is on in W, 0 if not learned yet
+	LearnedPower float64 `json:"learnedPower,omitempty"`
+	// Brightness level of proportional loads
+	Level *int `json:"level,omitempty"`
+	// Manual override in effect, nil in automatic mode
+	Override *LoadOverride `json:"override,omitempty"`
+	// Progress towards the daily target, nil without target
+	Target *TargetPlan `json:"target,omitempty"`
+	// Virtual state in shadow mode, nil if the load is switched
+	Shadow *ShadowState `json:"shadow,omitempty"`
+}
+
 type Data struct {
+	// Filtered readings of the inverter, see InverterFilter
 	InverterData InverterData `json:"inverterData"`
-	SocketState  bool         `json:"socketState"`
+	// Readings before filtering, nil without filter
+	RawInverterData *InverterData `json:"rawInverterData,omitempty"`
+	// State of the first load, kept for clients that only know a single plug
+	SocketState bool        `json:"socketState"`
+	Loads       []LoadState `json:"loads"`
 }
 
+// RequestDataAndSendWsNotification reads the inverter and the loads and sends
+// the data to the clients. The reading is not added to the filter, as it is
+// not taken at the poll interval.
 func (m *MonitoringController) RequestDataAndSendWsNotification(properties models.Properties) (Data, error) {
+	return m.requestData(properties, false)
+}
+
+// requestData reads the inverter and the loads and sends the data to the
+// clients. With sample the reading is added to the filter.
+func (m *MonitoringController) requestData(properties models.Properties, sample bool) (Data, error) {
 	log.Info().Msg("Get inverter data")
-	if m.inverter == nil {
+	_, inverter := m.clients()
+	if inverter == nil {
 		log.Error().Msg("Inverter is nil")
 		return Data{}, errors.New("inverter is nil")
 	}
-	inverterData, err := m.inverter.GetInverterData()
+	inverterData, err := inverter.GetInverterData()
 	if err != nil {
 		log.Error().Err(err).Msg("Could not get inverter data")
 		return Data{}, err
 	}
 
-	socketState, err := m.conbeeClient.IsLightOn(properties.PlugName)
+	data := Data{
+		InverterData: inverterData,
+	}
+	if filter := m.inverterFilter(); filter != nil {
+		data.InverterData = filter.Apply(inverterData, sample)
+		data.RawInverterData = &inverterData
+	}
+	if forecaster := m.Forecaster(); forecaster != nil {
+		forecast := forecaster.NextHour(time.Now(), data.InverterData.PVPower)
+		data.InverterData.ForecastPVPower = &forecast
+	}
+	err = m.updateLoadStates(&data, properties)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not get socket state")
 		return Data{}, err
 	}
 
-	data := Data{
-		InverterData: inverterData,
-		SocketState:  socketState,
-	}
-
 	err = m.websocketServer.WriteNotificationToAllMembers("data", data)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not write notification to all members")
@@ -71,11 +312,311 @@ func (m *MonitoringController) RequestDataAndSendWsNotification(properties model
 	return data, nil
 }
 
+// updateLoadStates reads the state of all loads into data. Loads whose
+// actuator cannot be reached are marked as unreachable.
+func (m *MonitoringController) updateLoadStates(data *Data, properties models.Properties) error {
+	data.Loads = nil
+	now := time.Now().In(properties.Location())
+	for _, load := range properties.SwitchedLoads() {
+		actuator, err := m.actuator(load)
+		if err != nil {
+			return err
+		}
+		state := LoadState{
+			Name:         load.Name,
+			Backend:      load.BackendOrDefault(),
+			LearnedPower: m.stateStore.Load(load.Name).LearnedPower,
+			Override:     m.stateStore.ActiveOverride(load.Name, now),
+			Shadow:       m.shadowState(load.Name),
+		}
+		if IsActuatorReachable(actuator) {
+			state.On, err = actuator.IsOn()
+			if err == nil {
+				if dimmer, ok := actuator.(Dimmer); ok && load.IsProportional() {
+					var level int
+					level, err = dimmer.Level()
+					state.Level = &level
+				}
+			}
+			if err != nil {
+				log.Error().Err(err).Msgf("Could not read the state of load %s", load.Name)
+			}
+			state.Reachable = err == nil
+		}
+		m.setReachable(load.Name, state.Reachable)
+		if state.Reachable && m.switchFailing(load.Name) {
+			state.Status = errSwitchFailing
+		}
+		if !state.Reachable {
+			state.Status = ErrActuatorUnreachable.Error()
+			m.updateTarget(load, &state, properties, now)
+			data.Loads = append(data.Loads, state)
+			continue
+		}
+		if meter, ok := actuator.(PowerMeter); ok {
+			power, err := meter.GetPower()
+			if err != nil {
+				// Not every relay has a power meter
+				log.Debug().Err(err).Msgf("Could not read the power of load %s", load.Name)
+			} else {
+				state.Power = &power
+			}
+		}
+		m.updateTarget(load, &state, properties, now)
+		data.Loads = append(data.Loads, state)
+	}
+	data.SocketState = len(data.Loads) > 0 && data.Loads[0].On
+	return nil
+}
+
+// updateTarget adds the runtime and energy since the last update to the daily
+// progress of a load with a target and plans when it has to run from the grid.
+func (m *MonitoringController) updateTarget(load models.Load, state *LoadState, properties models.Properties, now time.Time) {
+	if !load.HasTarget() {
+		return
+	}
+	input := LoadInput{Load: load, On: state.On, Power: state.Power, LearnedPower: state.LearnedPower}
+	if state.Level != nil {
+		input.Level = *state.Level
+	}
+	// The energy is only counted while the power of the load is known, the
+	// threshold says nothing about what it draws
+	power, _ := input.meteredDraw()
+	progress := m.stateStore.trackProgress(load.Name, state.On && state.Reachable, power, now.Format("2006-01-02"), now)
+	margin := time.Duration(properties.PollDuration) * time.Second
+	plan := planTarget(load, progress, input.expectedPower(properties), now, margin)
+	state.Target = &plan
+}
+
+// loadInputs combines the configuration and the state of the loads for the
+// switching logic at now.
+func loadInputs(data Data, properties models.Properties, now time.Time) []LoadInput {
+	loads := properties.SwitchedLoads()
+	localNow := now.In(properties.Location())
+	inputs := make([]LoadInput, 0, len(loads))
+	for i, load := range loads {
+		if i >= len(data.Loads) {
+			break
+		}
+		inputs = append(inputs, LoadInput{
+			Load:         load,
+			Unreachable:  !data.Loads[i].Reachable,
+			Override:     data.Loads[i].Override,
+			On:           data.Loads[i].On,
+			Power:        data.Loads[i].Power,
+			LearnedPower: data.Loads[i].LearnedPower,
+		})
+		if data.Loads[i].Level != nil {
+			inputs[len(inputs)-1].Level = *data.Loads[i].Level
+		}
+		inputs[len(inputs)-1].Blocked = scheduleBlock(load, localNow)
+		if target := data.Loads[i].Target; target != nil && target.Due {
+			inputs[len(inputs)-1].TargetDue = target.targetReason()
+		}
+	}
+	return inputs
+}
+
+// evaluateRules evaluates the rules of the loads against the inverter data and
+// the power of each load at now.
+func (m *MonitoringController) evaluateRules(inputs []LoadInput, data Data, properties models.Properties, now time.Time) {
+	var sensorValues models.RuleValues
+	for i := range inputs {
+		onRule, offRule, err := inputs[i].Load.Rules()
+		if err != nil {
+			// Validated when the config is loaded
+			log.Error().Err(err).Msgf("Invalid rule of load %s", inputs[i].Load.Name)
+			continue
+		}
+		values := ruleValues(data.InverterData)
+		values["power"] = inputs[i].currentDraw(properties)
+		if (onRule != nil && onRule.UsesSensors()) || (offRule != nil && offRule.UsesSensors()) {
+			if sensorValues == nil {
+				sensorValues = m.sensorValues()
+			}
+			for name, value := range sensorValues {
+				values[name] = value
+			}
+		}
+		for _, rule := range []*models.Rule{onRule, offRule} {
+			if rule == nil {
+				continue
+			}
+			key := inputs[i].Load.Name + "/" + rule.Text
+			if m.ruleTimers[key] == nil {
+				m.ruleTimers[key] = make(map[int]time.Time)
+			}
+			result := rule.Evaluate(values, now, m.ruleTimers[key])
+			if rule == onRule {
+				inputs[i].OnRule = &result
+			} else {
+				inputs[i].OffRule = &result
+			}
+		}
+	}
+}
+
+// sensorValues returns the values of the deCONZ sensors for the rules, none if
+// they cannot be read.
+func (m *MonitoringController) sensorValues() models.RuleValues {
+	conbeeClient, _ := m.clients()
+	if conbeeClient == nil {
+		return models.RuleValues{}
+	}
+	sensors, restErrResp, err := conbeeClient.GetSensors()
+	if err == nil && restErrResp != nil {
+		err = fmt.Errorf("unexpected status code: %d", restErrResp.Code)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read the sensors for the rules")
+		return models.RuleValues{}
+	}
+	return models.SensorRuleValues(sensors)
+}
+
+// ruleValues returns the rule variables known from the inverter data.
+func ruleValues(data InverterData) models.RuleValues {
+	values := models.RuleValues{
+		"surplus":     data.Overproduction,
+		"pv":          data.PVPower,
+		"consumption": data.HousePowerConsumption,
+	}
+	if data.BatterySoc != nil {
+		values["soc"] = *data.BatterySoc
+	}
+	if data.ForecastPVPower != nil {
+		values["forecast"] = *data.ForecastPVPower
+	}
+	return values
+}
+
+// scheduleBlock returns why the schedule of the load does not allow it to run
+// at now, empty if it may run.
+func scheduleBlock(load models.Load, now time.Time) string {
+	if !load.HasSchedule() {
+		return ""
+	}
+	schedule, err := load.Schedule()
+	if err != nil {
+		// Validated when the config is loaded
+		log.Error().Err(err).Msgf("Invalid schedule of load %s", load.Name)
+		return "blocked by an invalid schedule"
+	}
+	if allowed, reason := schedule.Allows(now); !allowed {
+		return reason
+	}
+	return ""
+}
+
+// learnLoadPower updates the learned average power of the loads that are on
+// with their measured power.
+func (m *MonitoringController) learnLoadPower(data Data) {
+	for _, state := range data.Loads {
+		if !state.On || state.Power == nil || *state.Power < minLearnedPower {
+			continue
+		}
+		power := *state.Power
+		m.stateStore.UpdateLoad(state.Name, func(loadState *LoadRuntimeState) {
+			loadState.LearnedSamples++
+			// Plain mean for the first samples, then an exponential moving
+			// average that follows slowly changing loads
+			weight := 1 / float64(loadState.LearnedSamples)
+			if weight < learnedPowerWeight {
+				weight = learnedPowerWeight
+			}
+			loadState.LearnedPower += weight * (power - loadState.LearnedPower)
+		})
+	}
+	err := m.stateStore.SaveAfter(stateSaveInterval)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save the state")
+	}
+}
+
+// expireOverrides switches the loads whose manual override has ended back to
+// automatic mode.
+func (m *MonitoringController) expireOverrides() {
+	expired := m.stateStore.ExpireOverrides(time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	for _, name := range expired {
+		log.Info().Msgf("Manual override of load %s has ended, back to automatic mode", name)
+	}
+	err := m.stateStore.Save()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save the state")
+	}
+}
+
+// recordDecisions keeps the record in the decision log and the history and
+// sends it to the clients.
+func (m *MonitoringController) recordDecisions(record DecisionRecord) {
+	for _, load := range record.Loads {
+		if load.Action == SwitchActionNone.String() {
+			log.Debug().Msg(load.Reason)
+		}
+	}
+	m.decisionLog.Add(record)
+	if err := m.history.Append(historyKindDecision, record.Time, record); err != nil {
+		log.Error().Err(err).Msg("Could not write the decision to the history")
+	}
+	if err := m.websocketServer.WriteNotificationToAllMembers("decision", record); err != nil {
+		log.Error().Err(err).Msg("Could not write notification to all members")
+	}
+}
+
+// applyDecisions switches the loads according to the decisions. Every command
+// is verified once, a load that cannot be switched is retried at the next
+// poll, which pauses it while it is unreachable, up to switchAttempts times.
+// It returns the outcome of the command of each switched load, nil if it was
+// applied.
+func (m *MonitoringController) applyDecisions(decisions []SwitchDecision, properties models.Properties) (map[string]error, error) {
+	outcome := make(map[string]error)
+	for _, decision := range decisions {
+		if decision.Action == SwitchActionNone {
+			m.resetSwitchFailures(decision.Load)
+			continue
+		}
+		log.Info().Msg(decision.Reason)
+		load, ok := properties.FindLoad(decision.Load)
+		if !ok {
+			continue
+		}
+		if m.switchGivenUp(decision) {
+			outcome[load.Name] = ErrSwitchGivenUp
+			continue
+		}
+		actuator, err := m.actuator(load)
+		if err != nil {
+			return outcome, err
+		}
+		switch decision.Action {
+		case SwitchActionOn:
+			err = SwitchVerified(actuator, true)
+		case SwitchActionOff:
+			err = SwitchVerified(actuator, false)
+		case SwitchActionLevel:
+			err = SetLevelVerified(actuator, decision.Level)
+		}
+		if err != nil {
+			m.switchFailed(decision, err)
+			if errors.Is(err, ErrActuatorUnreachable) {
+				m.setReachable(load.Name, false)
+			}
+		} else {
+			m.resetSwitchFailures(load.Name)
+		}
+		outcome[load.Name] = err
+	}
+	return outcome, nil
+}
+
 func (m *MonitoringController) run() {
 	go func() {
 		defer func() {
 			log.Info().Msg("MonitoringController: stopped monitoring")
-			m.isRunning = false
+			m.setRunning(false)
 			m.websocketServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: false})
 		}()
 		log.Info().Msg("MonitoringController: started monitoring")
@@ -89,70 +630,112 @@ func (m *MonitoringController) run() {
 			select {
 			case <-ticker.C:
 				log.Info().Msg("MonitoringController: tick")
-				data, err := m.RequestDataAndSendWsNotification(properties)
+				m.expireOverrides()
+				m.updateForecast(time.Now())
+				// Errors only skip the tick, the monitoring goes on with the
+				// next one
+				data, err := m.requestData(properties, true)
 				if err != nil {
 					log.Error().Err(err).Msg("Could not request data and send ws notification")
-					return
-				}
-				housePowerConsumption := data.InverterData.HousePowerConsumption
-				if data.SocketState == true {
-					housePowerConsumption -= properties.Threshold
+					continue
 				}
-
-				if data.InverterData.Overproduction > properties.Threshold {
-					log.Info().Msgf("Grid consumption: %f, so switching lights on", data.InverterData.Overproduction)
-					err := m.conbeeClient.SwitchOnLight(properties.PlugName)
-					if err != nil {
-						log.Error().Err(err).Msg("Could not switch on light")
-						return
-					}
-				} else if data.InverterData.Overproduction < 0 {
-					log.Info().Msgf("Grid consumption: %f, so switching lights off", data.InverterData.Overproduction)
-					err := m.conbeeClient.SwitchOffLight(properties.PlugName)
-					if err != nil {
-						log.Error().Err(err).Msg("Could not switch off light")
-						return
-					}
+				m.learnLoadPower(data)
+				now := time.Now()
+				inputs := loadInputs(data, properties, now)
+				decisionData := data
+				decisionData.InverterData = m.applyShadow(inputs, data.InverterData, properties, now)
+				m.evaluateRules(inputs, decisionData, properties, now.In(properties.Location()))
+				decisions := DecideLoads(decisionData.InverterData, inputs, properties)
+				record := newDecisionRecord(now, decisionData, data.InverterData, inputs, decisions, properties)
+				outcome, err := m.applyDecisions(m.applyShadowDecisions(decisions), properties)
+				record.setOutcome(outcome)
+				m.recordDecisions(record)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not switch loads")
+					continue
 				}
-				data.SocketState, err = m.conbeeClient.IsLightOn(properties.PlugName)
+				err = m.updateLoadStates(&data, properties)
 				if err != nil {
 					log.Error().Err(err).Msg("Could not get socket state")
-					return
+					continue
 				}
 				err = m.websocketServer.WriteNotificationToAllMembers("data", data)
 				if err != nil {
 					log.Error().Err(err).Msg("Could not write notification to all members")
-					return
 				}
 			case event := <-m.eventChan:
-				switch event {
+				switch event.name {
+				case MonitoringEventStartMonitoring:
+					log.Info().Msg("Start monitoring")
+					properties = event.properties
+					m.ruleTimers = make(map[string]map[int]time.Time)
+					m.clientsMutex.Lock()
+					m.filter = NewInverterFilter(properties)
+					m.switchFailures = make(map[string]switchFailure)
+					m.forecaster = NewForecaster(properties, forecastCachePath())
+					m.clientsMutex.Unlock()
+					ticker.Reset(time.Duration(properties.PollDuration) * time.Second)
+					m.websocketServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: true})
 				case MonitoringEventStopMonitoring:
 					ticker.Stop()
 					log.Info().Msg("Stop monitoring")
-					m.isRunning = false
+					if err := m.stateStore.Save(); err != nil {
+						log.Error().Err(err).Msg("Could not save the state")
+					}
 					m.websocketServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: false})
 				default:
-					log.Error().Msgf("Unknown event: %s", event)
+					log.Error().Msgf("Unknown event: %s", event.name)
 				}
-			case properties = <-m.startEventChan:
-				log.Info().Msg("Start monitoring")
-				m.isRunning = true
-				ticker.Reset(time.Duration(properties.PollDuration) * time.Second)
-				m.websocketServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: true})
 			}
 
 		}
 	}()
 }
 
+// StopMonitoring stops the monitoring after the current tick, it does not wait
+// for it.
 func (m *MonitoringController) StopMonitoring() {
-	m.eventChan <- MonitoringEventStopMonitoring
+	if err := m.sendEvent(monitoringEvent{name: MonitoringEventStopMonitoring}); err != nil {
+		log.Error().Err(err).Msg("Could not stop monitoring")
+		return
+	}
+	m.setRunning(false)
+}
+
+// StartMonitoring (re)starts the monitoring with the given properties after
+// the current tick, it does not wait for it. It refuses to start with invalid
+// properties.
+func (m *MonitoringController) StartMonitoring(properties models.Properties) error {
+	if errs := properties.Validate(); len(errs) > 0 {
+		log.Error().Err(errs).Msg("Refusing to start monitoring with invalid properties")
+		return errs
+	}
+	if err := m.sendEvent(monitoringEvent{name: MonitoringEventStartMonitoring, properties: properties}); err != nil {
+		return err
+	}
+	m.setRunning(true)
+	return nil
+}
+
+// sendEvent queues the event for the monitoring without blocking the caller,
+// which may hold appMutex.
+func (m *MonitoringController) sendEvent(event monitoringEvent) error {
+	select {
+	case m.eventChan <- event:
+		return nil
+	default:
+		return errors.New("the monitoring is not handling its events")
+	}
 }
 
-func (m *MonitoringController) StartMonitoring(properties models.Properties) {
-	m.startEventChan <- properties
+func (m *MonitoringController) setRunning(running bool) {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
+	m.isRunning = running
 }
 
 func (m *MonitoringController) IsRunning() bool {
+	m.clientsMutex.Lock()
+	defer m.clientsMutex.Unlock()
 	return m.isRunning
 }
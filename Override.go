@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"time"
+)
+
+const (
+	OverrideModeAuto = "auto"
+	OverrideModeOn   = "on"
+	OverrideModeOff  = "off"
+)
+
+// defaultOverrideDuration is how long a load that is switched by hand stays
+// in the state it was switched to, unless a duration or an end is given.
+const defaultOverrideDuration = 2 * time.Hour
+
+// LoadOverride forces a load on or off instead of switching it depending on
+// the surplus.
+type LoadOverride struct {
+	// OverrideModeOn or OverrideModeOff
+	Mode string `json:"mode"`
+	// End of the override, nil if it lasts until it is set back to auto
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Active reports whether the override is in effect at now.
+func (o *LoadOverride) Active(now time.Time) bool {
+	return o != nil && (o.Until == nil || now.Before(*o.Until))
+}
+
+// String describes the override for the logs and the decision reasons.
+func (o *LoadOverride) String() string {
+	if o.Until == nil {
+		return "forced " + o.Mode
+	}
+	return fmt.Sprintf("forced %s until %s", o.Mode, o.Until.Local().Format("2006-01-02 15:04"))
+}
+
+// NewLoadOverride creates the override with the mode, nil for auto. The end is
+// given either by a duration like 2h30m or by until, which is a RFC 3339 time
+// or a time of day like 06:00 that means its next occurrence. Without either
+// the override lasts until it is set back to auto.
+func NewLoadOverride(mode string, duration string, until string, now time.Time) (*LoadOverride, error) {
+	switch mode {
+	case OverrideModeAuto, "":
+		return nil, nil
+	case OverrideModeOn, OverrideModeOff:
+	default:
+		return nil, fmt.Errorf("unknown override mode %q, use %s, %s or %s", mode, OverrideModeOn, OverrideModeOff, OverrideModeAuto)
+	}
+	override := &LoadOverride{Mode: mode}
+	switch {
+	case duration != "" && until != "":
+		return nil, fmt.Errorf("either a duration or an end can be given")
+	case duration != "":
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", duration)
+		}
+		end := now.Add(d)
+		override.Until = &end
+	case until != "":
+		end, err := parseOverrideEnd(until, now)
+		if err != nil {
+			return nil, err
+		}
+		override.Until = &end
+	}
+	return override, nil
+}
+
+func parseOverrideEnd(until string, now time.Time) (time.Time, error) {
+	if end, err := time.Parse(time.RFC3339, until); err == nil {
+		if !end.After(now) {
+			return time.Time{}, fmt.Errorf("the end %s is in the past", until)
+		}
+		return end, nil
+	}
+	clock, err := time.ParseInLocation("15:04", until, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid end %q, use a time like 06:00 or 2006-01-02T06:00:00+01:00", until)
+	}
+	end := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !end.After(now) {
+		end = time.Date(now.Year(), now.Month(), now.Day()+1, clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	}
+	return end, nil
+}
+
+// SetOverride sets the override of the load, nil switches it back to
+// automatic mode. The state file is written right away.
+func (s *StateStore) SetOverride(name string, override *LoadOverride) error {
+	s.UpdateLoad(name, func(state *LoadRuntimeState) {
+		state.Override = override
+	})
+	return s.Save()
+}
+
+// ActiveOverride returns the override of the load that is in effect at now,
+// nil if the load is switched automatically.
+func (s *StateStore) ActiveOverride(name string, now time.Time) *LoadOverride {
+	override := s.Load(name).Override
+	if !override.Active(now) {
+		return nil
+	}
+	return override
+}
+
+// ExpireOverrides removes the overrides that have ended before now and
+// returns the names of their loads.
+func (s *StateStore) ExpireOverrides(now time.Time) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var expired []string
+	for name, state := range s.state.Loads {
+		if state.Override != nil && !state.Override.Active(now) {
+			state.Override = nil
+			expired = append(expired, name)
+			s.dirty = true
+		}
+	}
+	return expired
+}
+
+// overrideFromParams creates the override of a load that is switched on or
+// off by hand, for defaultOverrideDuration if no end is given.
+func overrideFromParams(on bool, params models.SwitchLightParams, now time.Time) (*LoadOverride, error) {
+	mode := OverrideModeOff
+	if on {
+		mode = OverrideModeOn
+	}
+	duration := params.Duration
+	if duration == "" && params.Until == "" {
+		duration = defaultOverrideDuration.String()
+	}
+	return NewLoadOverride(mode, duration, params.Until, now)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewLoadOverride(t *testing.T) {
+	now := time.Date(2024, 5, 10, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		mode     string
+		duration string
+		until    string
+		expected *time.Time
+		err      bool
+	}{
+		// Test case 1: Forced on for two hours
+		{OverrideModeOn, "2h", "", timePointer(now.Add(2 * time.Hour)), false},
+		// Test case 2: Forced off until 06:00 the next day
+		{OverrideModeOff, "", "06:00", timePointer(time.Date(2024, 5, 11, 6, 0, 0, 0, time.UTC)), false},
+		// Test case 3: Forced on until a time later today
+		{OverrideModeOn, "", "2024-05-10T22:30:00Z", timePointer(time.Date(2024, 5, 10, 22, 30, 0, 0, time.UTC)), false},
+		// Test case 4: Forced on without end
+		{OverrideModeOn, "", "", nil, false},
+		// Test case 5: End in the past
+		{OverrideModeOn, "", "2024-05-10T19:00:00Z", nil, true},
+		// Test case 6: Unknown mode
+		{"sometimes", "", "", nil, true},
+		// Test case 7: Negative duration
+		{OverrideModeOff, "-1h", "", nil, true},
+	}
+	for i, test := range tests {
+		override, err := NewLoadOverride(test.mode, test.duration, test.until, now)
+		if (err != nil) != test.err {
+			t.Errorf("Test case %d: Expected error %t but got %v", i+1, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if override.Mode != test.mode {
+			t.Errorf("Test case %d: Expected mode %s but got %s", i+1, test.mode, override.Mode)
+		}
+		if (override.Until == nil) != (test.expected == nil) || (test.expected != nil && !override.Until.Equal(*test.expected)) {
+			t.Errorf("Test case %d: Expected end %v but got %v", i+1, test.expected, override.Until)
+		}
+	}
+
+	// Test case 8: Auto removes the override
+	override, err := NewLoadOverride(OverrideModeAuto, "", "", now)
+	if override != nil || err != nil {
+		t.Errorf("Test case 8: Expected no override but got %v, %v", override, err)
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
+
+func TestOverrideExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFileName)
+	store := OpenStateStore(path)
+	now := time.Now()
+	override, _ := NewLoadOverride(OverrideModeOn, "1h", "", now)
+	err := store.SetOverride("boiler", override)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: The override survives a restart
+	store = OpenStateStore(path)
+	if active := store.ActiveOverride("boiler", now); active == nil || active.Mode != OverrideModeOn {
+		t.Errorf("Test case 1: Expected the load to be forced on but got %v", active)
+	}
+
+	// Test case 2: The override expires
+	later := now.Add(2 * time.Hour)
+	if active := store.ActiveOverride("boiler", later); active != nil {
+		t.Errorf("Test case 2: Expected no active override but got %v", active)
+	}
+	expired := store.ExpireOverrides(later)
+	if len(expired) != 1 || expired[0] != "boiler" || store.Load("boiler").Override != nil {
+		t.Errorf("Test case 2: Expected the override of boiler to be removed but got %v", expired)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/go-resty/resty/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Wi-Fi relays answer quickly or not at all
+const relayTimeout = 5 * time.Second
+
+func newRelayRestClient(address string) *resty.Client {
+	client := resty.New()
+	client.SetBaseURL("http://" + address)
+	client.SetTimeout(relayTimeout)
+	return client
+}
+
+// getRelayJson sends a GET request to a relay and decodes the JSON response
+// into result.
+func getRelayJson(request *resty.Request, path string, result interface{}) error {
+	response, err := request.Get(path)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode() != 200 {
+		return fmt.Errorf("unexpected status code %d: %s", response.StatusCode(), response.String())
+	}
+	err = json.Unmarshal(response.Body(), result)
+	if err != nil {
+		return fmt.Errorf("invalid response %q: %v", response.String(), err)
+	}
+	return nil
+}
+
+// ShellyActuator switches a relay of a Shelly device of the first generation
+// with the HTTP API, e.g. GET /relay/0?turn=on.
+type ShellyActuator struct {
+	restClient *resty.Client
+	channel    int
+}
+
+func NewShellyActuator(load models.Load) *ShellyActuator {
+	restClient := newRelayRestClient(load.Address)
+	if load.Username != "" {
+		restClient.SetBasicAuth(load.Username, load.Password)
+	}
+	return &ShellyActuator{
+		restClient: restClient,
+		channel:    load.Channel,
+	}
+}
+
+type shellyRelayStatus struct {
+	IsOn bool `json:"ison"`
+}
+
+type shellyMeterStatus struct {
+	Power float64 `json:"power"`
+}
+
+func (a *ShellyActuator) relayPath() string {
+	return "/relay/" + strconv.Itoa(a.channel)
+}
+
+func (a *ShellyActuator) turn(value string) error {
+	var status shellyRelayStatus
+	err := getRelayJson(a.restClient.R().SetQueryParam("turn", value), a.relayPath(), &status)
+	if err != nil {
+		return err
+	}
+	if status.IsOn != (value == "on") {
+		return fmt.Errorf("relay %d did not turn %s", a.channel, value)
+	}
+	return nil
+}
+
+func (a *ShellyActuator) SwitchOn() error {
+	return a.turn("on")
+}
+
+func (a *ShellyActuator) SwitchOff() error {
+	return a.turn("off")
+}
+
+func (a *ShellyActuator) IsOn() (bool, error) {
+	var status shellyRelayStatus
+	err := getRelayJson(a.restClient.R(), a.relayPath(), &status)
+	return status.IsOn, err
+}
+
+func (a *ShellyActuator) GetPower() (float64, error) {
+	var status shellyMeterStatus
+	err := getRelayJson(a.restClient.R(), "/meter/"+strconv.Itoa(a.channel), &status)
+	return status.Power, err
+}
+
+// ShellyGen2Actuator switches a Shelly device of the second generation with
+// the RPC API, e.g. GET /rpc/Switch.Set?id=0&on=true. Authentication is not
+// supported, it has to be disabled on the device.
+type ShellyGen2Actuator struct {
+	restClient *resty.Client
+	channel    int
+}
+
+func NewShellyGen2Actuator(load models.Load) *ShellyGen2Actuator {
+	return &ShellyGen2Actuator{
+		restClient: newRelayRestClient(load.Address),
+		channel:    load.Channel,
+	}
+}
+
+type shellySwitchStatus struct {
+	Output bool    `json:"output"`
+	APower float64 `json:"apower"`
+}
+
+func (a *ShellyGen2Actuator) set(on bool) error {
+	var result struct {
+		WasOn bool `json:"was_on"`
+	}
+	request := a.restClient.R().
+		SetQueryParam("id", strconv.Itoa(a.channel)).
+		SetQueryParam("on", strconv.FormatBool(on))
+	return getRelayJson(request, "/rpc/Switch.Set", &result)
+}
+
+func (a *ShellyGen2Actuator) status() (shellySwitchStatus, error) {
+	var status shellySwitchStatus
+	request := a.restClient.R().SetQueryParam("id", strconv.Itoa(a.channel))
+	err := getRelayJson(request, "/rpc/Switch.GetStatus", &status)
+	return status, err
+}
+
+func (a *ShellyGen2Actuator) SwitchOn() error {
+	return a.set(true)
+}
+
+func (a *ShellyGen2Actuator) SwitchOff() error {
+	return a.set(false)
+}
+
+func (a *ShellyGen2Actuator) IsOn() (bool, error) {
+	status, err := a.status()
+	return status.Output, err
+}
+
+func (a *ShellyGen2Actuator) GetPower() (float64, error) {
+	status, err := a.status()
+	return status.APower, err
+}
+
+// TasmotaActuator switches a device running Tasmota with its command API,
+// e.g. GET /cm?cmnd=Power%20On.
+type TasmotaActuator struct {
+	restClient *resty.Client
+	username   string
+	password   string
+	// Power for the first relay, Power2 for the second and so on
+	powerCommand string
+}
+
+func NewTasmotaActuator(load models.Load) *TasmotaActuator {
+	powerCommand := "Power"
+	if load.Channel > 0 {
+		powerCommand += strconv.Itoa(load.Channel + 1)
+	}
+	return &TasmotaActuator{
+		restClient:   newRelayRestClient(load.Address),
+		username:     load.Username,
+		password:     load.Password,
+		powerCommand: powerCommand,
+	}
+}
+
+func (a *TasmotaActuator) command(command string, result interface{}) error {
+	request := a.restClient.R().SetQueryParam("cmnd", command)
+	if a.username != "" {
+		request.SetQueryParam("user", a.username).SetQueryParam("password", a.password)
+	}
+	return getRelayJson(request, "/cm", result)
+}
+
+// power sends a power command and returns the new state of the relay.
+func (a *TasmotaActuator) power(argument string) (bool, error) {
+	command := a.powerCommand
+	if argument != "" {
+		command += " " + argument
+	}
+	var result map[string]interface{}
+	err := a.command(command, &result)
+	if err != nil {
+		return false, err
+	}
+	// The first relay answers with POWER or POWER1, depending on the device,
+	// the POWER1 of another relay is not its state
+	keys := []string{strings.ToUpper(a.powerCommand)}
+	if a.powerCommand == "Power" {
+		keys = append(keys, "POWER1")
+	}
+	for _, key := range keys {
+		if state, ok := result[key].(string); ok {
+			return state == "ON", nil
+		}
+	}
+	return false, fmt.Errorf("no power state in response %v", result)
+}
+
+func (a *TasmotaActuator) SwitchOn() error {
+	on, err := a.power("On")
+	if err == nil && !on {
+		err = fmt.Errorf("%s did not turn on", a.powerCommand)
+	}
+	return err
+}
+
+func (a *TasmotaActuator) SwitchOff() error {
+	on, err := a.power("Off")
+	if err == nil && on {
+		err = fmt.Errorf("%s did not turn off", a.powerCommand)
+	}
+	return err
+}
+
+func (a *TasmotaActuator) IsOn() (bool, error) {
+	return a.power("")
+}
+
+func (a *TasmotaActuator) GetPower() (float64, error) {
+	var result struct {
+		StatusSNS struct {
+			Energy *struct {
+				Power float64 `json:"Power"`
+			} `json:"ENERGY"`
+		} `json:"StatusSNS"`
+	}
+	err := a.command("Status 8", &result)
+	if err != nil {
+		return 0, err
+	}
+	if result.StatusSNS.Energy == nil {
+		return 0, fmt.Errorf("device has no power meter")
+	}
+	return result.StatusSNS.Energy.Power, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeRelay simulates a single relay with a power meter that draws power
+// while it is on.
+type fakeRelay struct {
+	on    bool
+	power float64
+}
+
+func (r *fakeRelay) currentPower() float64 {
+	if r.on {
+		return r.power
+	}
+	return 0
+}
+
+func newFakeShelly(t *testing.T, relay *fakeRelay) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/relay/0":
+			switch r.URL.Query().Get("turn") {
+			case "on":
+				relay.on = true
+			case "off":
+				relay.on = false
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"ison": relay.on, "has_timer": false})
+		case "/meter/0":
+			json.NewEncoder(w).Encode(map[string]interface{}{"power": relay.currentPower(), "is_valid": true})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newFakeShellyGen2(t *testing.T, relay *fakeRelay) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Path {
+		case "/rpc/Switch.Set":
+			wasOn := relay.on
+			relay.on = r.URL.Query().Get("on") == "true"
+			json.NewEncoder(w).Encode(map[string]interface{}{"was_on": wasOn})
+		case "/rpc/Switch.GetStatus":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "output": relay.on, "apower": relay.currentPower()})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newFakeTasmota(t *testing.T, relay *fakeRelay) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cm" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		command := strings.ToLower(r.URL.Query().Get("cmnd"))
+		switch command {
+		case "power on":
+			relay.on = true
+		case "power off":
+			relay.on = false
+		case "power":
+		case "status 8":
+			fmt.Fprintf(w, `{"StatusSNS":{"Time":"2023-06-01T12:00:00","ENERGY":{"Power":%g,"Voltage":230}}}`, relay.currentPower())
+			return
+		default:
+			fmt.Fprint(w, `{"Command":"Unknown"}`)
+			return
+		}
+		state := "OFF"
+		if relay.on {
+			state = "ON"
+		}
+		fmt.Fprintf(w, `{"POWER":"%s"}`, state)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRelayActuators(t *testing.T) {
+	fakes := map[string]func(*testing.T, *fakeRelay) *httptest.Server{
+		models.ActuatorBackendShelly:     newFakeShelly,
+		models.ActuatorBackendShellyGen2: newFakeShellyGen2,
+		models.ActuatorBackendTasmota:    newFakeTasmota,
+	}
+	for backend, newFake := range fakes {
+		relay := &fakeRelay{power: 1800}
+		server := newFake(t, relay)
+		load := models.Load{Name: "boiler", Backend: backend, Address: strings.TrimPrefix(server.URL, "http://")}
+		actuator, err := NewActuator(load, nil)
+		if err != nil {
+			t.Fatalf("%s: Expected nil error but got %v", backend, err)
+		}
+
+		// Test case 1: Switch on
+		err = actuator.SwitchOn()
+		if err != nil || !relay.on {
+			t.Errorf("%s: Test case 1: Expected the relay to be on but got %t, %v", backend, relay.on, err)
+		}
+		on, err := actuator.IsOn()
+		if err != nil || !on {
+			t.Errorf("%s: Test case 1: Expected IsOn to be true but got %t, %v", backend, on, err)
+		}
+
+		// Test case 2: Power meter
+		meter, ok := actuator.(PowerMeter)
+		if !ok {
+			t.Fatalf("%s: Test case 2: Expected a power meter", backend)
+		}
+		power, err := meter.GetPower()
+		if err != nil || power != 1800 {
+			t.Errorf("%s: Test case 2: Expected 1800 W but got %f, %v", backend, power, err)
+		}
+
+		// Test case 3: Switch off
+		err = actuator.SwitchOff()
+		if err != nil || relay.on {
+			t.Errorf("%s: Test case 3: Expected the relay to be off but got %t, %v", backend, relay.on, err)
+		}
+		power, err = meter.GetPower()
+		if err != nil || power != 0 {
+			t.Errorf("%s: Test case 3: Expected 0 W but got %f, %v", backend, power, err)
+		}
+	}
+}
+
+func TestTasmotaPowerResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"POWER1":"ON"}`)
+	}))
+	t.Cleanup(server.Close)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	// Test case 1: The first relay accepts POWER1 as the answer
+	on, err := NewTasmotaActuator(models.Load{Address: address}).IsOn()
+	if err != nil || !on {
+		t.Errorf("Test case 1: Expected the relay to be on but got %t, %v", on, err)
+	}
+
+	// Test case 2: POWER1 is not the state of the second relay
+	if _, err := NewTasmotaActuator(models.Load{Address: address, Channel: 1}).IsOn(); err == nil {
+		t.Errorf("Test case 2: Expected an error but got nil")
+	}
+}
+
+func TestGetLightsWithRelays(t *testing.T) {
+	fake := newFakeDeconz(t, map[string]models.Light{"1": {Name: "Heating rod"}})
+	relay := &fakeRelay{on: true}
+	shelly := newFakeShelly(t, relay)
+	properties := &models.Properties{
+		PlugName: "Heating rod",
+		Loads: []models.Load{
+			{Name: "pump", Backend: models.ActuatorBackendShelly, Address: strings.TrimPrefix(shelly.URL, "http://")},
+			{Name: "heater", Backend: models.ActuatorBackendTasmota, Address: "127.0.0.1:1"},
+		},
+	}
+
+	lights, restErrResp, err := GetLights(properties, fake.client())
+	if err != nil || restErrResp != nil {
+		t.Fatalf("Expected nil error but got %v, %v", restErrResp, err)
+	}
+	if len(lights) != 3 {
+		t.Errorf("Expected 3 lights but got %v", lights)
+	}
+	if light := lights["shelly:pump"]; light.Name != "pump" || !light.State.On || !light.State.Reachable {
+		t.Errorf("Expected the reachable shelly relay pump to be on but got %+v", light)
+	}
+	if light := lights["tasmota:heater"]; light.State.Reachable {
+		t.Errorf("Expected the tasmota relay heater to be unreachable but got %+v", light)
+	}
+
+	actuator, err := NewLightActuator(properties, fake.client(), "pump")
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	err = actuator.SwitchOff()
+	if err != nil || relay.on {
+		t.Errorf("Expected the relay to be switched off but got %t, %v", relay.on, err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordedSample is one inverter reading of a recording.
+type RecordedSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	InverterData
+}
+
+// LoadRecording reads a recording of inverter samples from a CSV or JSON file.
+//
+// CSV files need a header line with the columns timestamp, HousePowerConsumption
+// and PVPower, Overproduction is optional and calculated if missing.
+// Timestamps are RFC 3339, "2006-01-02 15:04:05" in local time or unix seconds.
+//
+// JSON files contain an array of objects with the same keys and RFC 3339
+// timestamps.
+func LoadRecording(path string) ([]RecordedSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var samples []RecordedSample
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		samples, err = readJsonRecording(file)
+	case ".csv":
+		samples, err = readCsvRecording(file)
+	default:
+		return nil, fmt.Errorf("unsupported recording format %s, use .csv or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording %s: %v", path, err)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("recording %s contains no samples", path)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+	return samples, nil
+}
+
+func readJsonRecording(reader io.Reader) ([]RecordedSample, error) {
+	var records []struct {
+		Timestamp             time.Time `json:"timestamp"`
+		HousePowerConsumption float64   `json:"HousePowerConsumption"`
+		PVPower               float64   `json:"PVPower"`
+		Overproduction        *float64  `json:"Overproduction"`
+	}
+	err := json.NewDecoder(reader).Decode(&records)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]RecordedSample, 0, len(records))
+	for _, record := range records {
+		sample := RecordedSample{
+			Timestamp: record.Timestamp,
+			InverterData: InverterData{
+				HousePowerConsumption: record.HousePowerConsumption,
+				PVPower:               record.PVPower,
+				Overproduction:        record.PVPower - record.HousePowerConsumption,
+			},
+		}
+		if record.Overproduction != nil {
+			sample.Overproduction = *record.Overproduction
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func readCsvRecording(reader io.Reader) ([]RecordedSample, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"timestamp", "housepowerconsumption", "pvpower"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+	overproductionColumn, hasOverproduction := columns["overproduction"]
+
+	var samples []RecordedSample
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sample := RecordedSample{}
+		sample.Timestamp, err = parseRecordingTimestamp(record[columns["timestamp"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		sample.HousePowerConsumption, err = strconv.ParseFloat(record[columns["housepowerconsumption"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		sample.PVPower, err = strconv.ParseFloat(record[columns["pvpower"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		sample.Overproduction = sample.PVPower - sample.HousePowerConsumption
+		if hasOverproduction && record[overproductionColumn] != "" {
+			sample.Overproduction, err = strconv.ParseFloat(record[overproductionColumn], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func parseRecordingTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+	if timestamp, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+		return timestamp, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// ReplayInverter returns the recorded sample that was current at the time of
+// its clock. When no clock is given, the recording is played back in real time
+// from its first sample and starts over at the end.
+type ReplayInverter struct {
+	path      string
+	samples   []RecordedSample
+	clock     Clock
+	connected bool
+}
+
+func NewReplayInverter(path string, clock Clock) *ReplayInverter {
+	return &ReplayInverter{
+		path:  path,
+		clock: clock,
+	}
+}
+
+// NewReplayInverterFromSamples creates a ReplayInverter from an already loaded recording.
+func NewReplayInverterFromSamples(samples []RecordedSample, clock Clock) *ReplayInverter {
+	return &ReplayInverter{
+		samples: samples,
+		clock:   clock,
+	}
+}
+
+func (r *ReplayInverter) Connect() error {
+	if r.samples == nil {
+		samples, err := LoadRecording(r.path)
+		if err != nil {
+			return err
+		}
+		r.samples = samples
+	}
+	if len(r.samples) == 0 {
+		return errors.New("recording contains no samples")
+	}
+	if r.clock == nil {
+		r.clock = newLoopingClock(r.samples[0].Timestamp, r.samples[len(r.samples)-1].Timestamp)
+	}
+	r.connected = true
+	return nil
+}
+
+func (r *ReplayInverter) IsConnected() bool {
+	return r.connected
+}
+
+func (r *ReplayInverter) GetInverterData() (InverterData, error) {
+	if !r.connected {
+		return InverterData{}, errors.New("ReplayInverter not connected")
+	}
+	now := r.clock.Now()
+	// Index of the first sample after now, the one before is the current one
+	index := sort.Search(len(r.samples), func(i int) bool {
+		return r.samples[i].Timestamp.After(now)
+	})
+	if index == 0 {
+		return InverterData{}, fmt.Errorf("no recorded sample before %v", now)
+	}
+	return r.samples[index-1].InverterData, nil
+}
+
+// loopingClock maps the wall clock onto the time span of a recording.
+type loopingClock struct {
+	realStart time.Time
+	start     time.Time
+	length    time.Duration
+}
+
+func newLoopingClock(start time.Time, end time.Time) *loopingClock {
+	return &loopingClock{
+		realStart: time.Now(),
+		start:     start,
+		length:    end.Sub(start),
+	}
+}
+
+func (c *loopingClock) Now() time.Time {
+	if c.length <= 0 {
+		return c.start
+	}
+	return c.start.Add(time.Since(c.realStart) % c.length)
+}
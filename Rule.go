@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"time"
+)
+
+// evaluateRule evaluates a rule as a dry run against the inverter data and
+// the deCONZ sensors, nil if they are not available, and now. Durations are
+// not checked, as there is no history of the conditions.
+func evaluateRule(params models.EvaluateRuleParams, inverterData *InverterData, sensors map[string]models.Sensor, now time.Time) (models.EvaluateRuleResult, error) {
+	result := models.EvaluateRuleResult{Values: models.RuleValues{}}
+	if params.Time != "" {
+		parsed, err := time.Parse(time.RFC3339, params.Time)
+		if err != nil {
+			return result, fmt.Errorf("invalid time %q, use e.g. 2006-01-02T15:04:05+01:00", params.Time)
+		}
+		now = parsed.In(now.Location())
+	}
+	result.Time = now.Format(time.RFC3339)
+	if inverterData != nil {
+		result.Values = ruleValues(*inverterData)
+	}
+	for name, value := range models.SensorRuleValues(sensors) {
+		result.Values[name] = value
+	}
+	for name, value := range params.Values {
+		if !models.IsRuleVariable(name) {
+			return result, fmt.Errorf("unknown variable %q", name)
+		}
+		result.Values[name] = value
+	}
+
+	rule, err := models.ParseRule(params.Rule)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Valid = true
+	result.RuleResult = rule.Evaluate(result.Values, now, nil)
+	result.Explanation = result.RuleResult.String()
+	return result, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+	"time"
+)
+
+func TestEvaluateRule(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	data := &InverterData{Overproduction: 1800, PVPower: 2500, HousePowerConsumption: 700}
+
+	// Test case 1: The rule is evaluated against the inverter data
+	result, err := evaluateRule(models.EvaluateRuleParams{Rule: "surplus > 1500 for 5m and time between 10:00-17:00"}, data, nil, now)
+	if err != nil || !result.Valid || !result.Matched {
+		t.Errorf("Test case 1: Expected the rule to hold but got %+v, %v", result, err)
+	}
+
+	// Test case 2: Values replace the inverter data
+	result, err = evaluateRule(models.EvaluateRuleParams{Rule: "surplus > 1500", Values: map[string]float64{"surplus": 100}}, data, nil, now)
+	if err != nil || result.Matched {
+		t.Errorf("Test case 2: Expected the rule not to hold but got %+v, %v", result, err)
+	}
+
+	// Test case 3: An invalid rule is reported in the result
+	result, err = evaluateRule(models.EvaluateRuleParams{Rule: "surplus >> 1500"}, data, nil, now)
+	if err != nil || result.Valid || result.Error == "" {
+		t.Errorf("Test case 3: Expected an invalid rule but got %+v, %v", result, err)
+	}
+
+	// Test case 4: Unknown variables in the values are rejected
+	_, err = evaluateRule(models.EvaluateRuleParams{Rule: "surplus > 1500", Values: map[string]float64{"temperature": 20}}, nil, nil, now)
+	if err == nil {
+		t.Error("Test case 4: Expected an error for an unknown variable")
+	}
+
+	// Test case 5: The rule is evaluated against the sensors
+	temperature := 1850.0
+	sensors := map[string]models.Sensor{"1": {Name: "Living room", State: models.SensorState{Temperature: &temperature}}}
+	result, err = evaluateRule(models.EvaluateRuleParams{Rule: "sensor.living_room.temperature < 20"}, data, sensors, now)
+	if err != nil || !result.Matched || result.Values["sensor.living_room.temperature"] != 18.5 {
+		t.Errorf("Test case 5: Expected the rule to hold at 18.5 °C but got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"time"
+)
+
+// getSchedules returns the schedules of all loads and whether they allow the
+// loads to run at now.
+func getSchedules(properties *models.Properties, now time.Time) models.SchedulesResult {
+	localNow := now.In(properties.Location())
+	result := models.SchedulesResult{
+		Timezone: localNow.Location().String(),
+		Now:      localNow.Format(time.RFC3339),
+		Loads:    []models.LoadSchedule{},
+	}
+	for _, load := range properties.SwitchedLoads() {
+		reason := scheduleBlock(load, localNow)
+		result.Loads = append(result.Loads, models.LoadSchedule{
+			Load:    load.Name,
+			Allow:   load.Allow,
+			Forbid:  load.Forbid,
+			Season:  load.Season,
+			Allowed: reason == "",
+			Reason:  reason,
+		})
+	}
+	return result
+}
+
+// setSchedule returns a copy of the properties with the schedule of the load
+// replaced. Only loads with their own section have a schedule.
+func setSchedule(properties *models.Properties, params models.SetScheduleParams) (*models.Properties, error) {
+	updated := *properties
+	updated.Loads = append([]models.Load(nil), properties.Loads...)
+	for i := range updated.Loads {
+		if updated.Loads[i].Name == params.Load {
+			updated.Loads[i].Allow = params.Allow
+			updated.Loads[i].Forbid = params.Forbid
+			updated.Loads[i].Season = params.Season
+			return &updated, nil
+		}
+	}
+	if params.Load == models.DefaultLoadName {
+		return nil, fmt.Errorf("the plug of plugName has no schedule, configure it as [%s%s] instead",
+			models.SectionLoadPrefix, models.DefaultLoadName)
+	}
+	return nil, fmt.Errorf("unknown load %s", params.Load)
+}
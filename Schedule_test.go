@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+	"time"
+)
+
+func TestSetSchedule(t *testing.T) {
+	properties := &models.Properties{
+		PlugName: "Heating rod",
+		Timezone: "Europe/Berlin",
+		Loads:    []models.Load{{Name: "pump", Light: "Pump plug"}},
+	}
+
+	// Test case 1: The schedule is set on a copy
+	updated, err := setSchedule(properties, models.SetScheduleParams{Load: "pump", Forbid: "22:00-06:00"})
+	if err != nil || updated.Loads[0].Forbid != "22:00-06:00" || properties.Loads[0].Forbid != "" {
+		t.Errorf("Test case 1: Expected the schedule on the copy only but got %v, %v", updated, err)
+	}
+
+	// Test case 2: The schedule is evaluated in the configured timezone
+	night := time.Date(2024, 5, 10, 21, 30, 0, 0, time.UTC)
+	schedules := getSchedules(updated, night)
+	if schedules.Timezone != "Europe/Berlin" || len(schedules.Loads) != 2 || schedules.Loads[1].Allowed {
+		t.Errorf("Test case 2: Expected pump to be blocked at 23:30 in Berlin but got %+v", schedules)
+	}
+
+	// Test case 3: The plug of plugName has no section
+	_, err = setSchedule(properties, models.SetScheduleParams{Load: models.DefaultLoadName})
+	if err == nil {
+		t.Error("Test case 3: Expected an error for the plug of plugName")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// ShadowState is the state a load in shadow mode would have if the decisions
+// were applied, and what it would have drawn since shadow mode started.
+type ShadowState struct {
+	On    bool `json:"on"`
+	Level int  `json:"level,omitempty"`
+	// Number of times the load would have been switched
+	Switches  int     `json:"switches"`
+	OnSeconds float64 `json:"onSeconds"`
+	// Energy the load would have drawn in Wh
+	EnergyWh float64 `json:"energyWh"`
+	// Part of EnergyWh that would have been covered by the surplus
+	DivertedWh float64   `json:"divertedWh"`
+	Since      time.Time `json:"since"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// isShadow reports whether the decisions on the load are only recorded.
+func isShadow(load models.Load, properties models.Properties) bool {
+	return properties.ShadowMode || load.Shadow
+}
+
+// shadowState returns a copy of the state of a load in shadow mode, nil if
+// the load is not in shadow mode.
+func (m *MonitoringController) shadowState(name string) *ShadowState {
+	m.shadowMutex.Lock()
+	defer m.shadowMutex.Unlock()
+	state, ok := m.shadow[name]
+	if !ok {
+		return nil
+	}
+	copied := *state
+	return &copied
+}
+
+// applyShadow replaces the state of the loads in shadow mode with their
+// virtual state and returns the inverter data as if the virtual states were
+// real. The energy since the last poll is added to the virtual states. The
+// states of loads that have left shadow mode are dropped.
+func (m *MonitoringController) applyShadow(inputs []LoadInput, data InverterData, properties models.Properties, now time.Time) InverterData {
+	m.shadowMutex.Lock()
+	defer m.shadowMutex.Unlock()
+	var draws []float64
+	var shadowed []int
+	for i := range inputs {
+		if !isShadow(inputs[i].Load, properties) {
+			delete(m.shadow, inputs[i].Load.Name)
+			continue
+		}
+		state, ok := m.shadow[inputs[i].Load.Name]
+		if !ok {
+			state = &ShadowState{Since: now}
+			m.shadow[inputs[i].Load.Name] = state
+		}
+		measured := inputs[i].currentDraw(properties)
+		inputs[i].Shadow = true
+		inputs[i].On = state.On
+		inputs[i].Level = state.Level
+		inputs[i].Power = nil
+		virtual := inputs[i].currentDraw(properties)
+		data.Overproduction += measured - virtual
+		shadowed = append(shadowed, i)
+		draws = append(draws, virtual)
+	}
+
+	for j, i := range shadowed {
+		state := m.shadow[inputs[i].Load.Name]
+		elapsed := now.Sub(state.LastUpdate)
+		if state.On && !state.LastUpdate.IsZero() && elapsed > 0 && elapsed <= maxProgressGap {
+			// The surplus the load would have been drawing from
+			available := data.Overproduction + draws[j]
+			if available < 0 {
+				available = 0
+			}
+			if available > draws[j] {
+				available = draws[j]
+			}
+			state.OnSeconds += elapsed.Seconds()
+			state.EnergyWh += draws[j] * elapsed.Hours()
+			state.DivertedWh += available * elapsed.Hours()
+		}
+		state.LastUpdate = now
+	}
+	return data
+}
+
+// applyShadowDecisions applies the decisions on loads in shadow mode to their
+// virtual state and returns the decisions on the other loads.
+func (m *MonitoringController) applyShadowDecisions(decisions []SwitchDecision) []SwitchDecision {
+	m.shadowMutex.Lock()
+	defer m.shadowMutex.Unlock()
+	applied := make([]SwitchDecision, 0, len(decisions))
+	for _, decision := range decisions {
+		state, ok := m.shadow[decision.Load]
+		if !ok {
+			applied = append(applied, decision)
+			continue
+		}
+		if decision.Action == SwitchActionNone {
+			continue
+		}
+		log.Info().Msgf("Shadow mode, not applied: %s", decision.Reason)
+		wasOn := state.On
+		switch decision.Action {
+		case SwitchActionOn:
+			state.On = true
+		case SwitchActionOff:
+			state.On = false
+			state.Level = 0
+		case SwitchActionLevel:
+			state.On = decision.Level > 0
+			state.Level = decision.Level
+		}
+		if state.On != wasOn {
+			state.Switches++
+		}
+	}
+	return applied
+}
+
+// ShadowModeResult is the shadow mode of the app and of each load.
+type ShadowModeResult struct {
+	// All loads are in shadow mode
+	Global bool         `json:"global"`
+	Loads  []LoadShadow `json:"loads"`
+}
+
+type LoadShadow struct {
+	Load    string `json:"load"`
+	Enabled bool   `json:"enabled"`
+	// Virtual state while the monitoring runs in shadow mode
+	State *ShadowState `json:"state,omitempty"`
+}
+
+// getShadowMode returns the shadow mode of all loads, monitoring may be nil.
+func getShadowMode(properties *models.Properties, monitoring *MonitoringController) ShadowModeResult {
+	result := ShadowModeResult{Global: properties.ShadowMode, Loads: []LoadShadow{}}
+	for _, load := range properties.SwitchedLoads() {
+		loadShadow := LoadShadow{Load: load.Name, Enabled: isShadow(load, *properties)}
+		if monitoring != nil {
+			loadShadow.State = monitoring.shadowState(load.Name)
+		}
+		result.Loads = append(result.Loads, loadShadow)
+	}
+	return result
+}
+
+// setShadowMode returns a copy of the properties with the shadow mode of the
+// load changed, of the app without a load.
+func setShadowMode(properties *models.Properties, params models.SetShadowModeParams) (*models.Properties, error) {
+	updated := *properties
+	if params.Load == "" {
+		updated.ShadowMode = params.Enabled
+		return &updated, nil
+	}
+	updated.Loads = append([]models.Load(nil), properties.Loads...)
+	for i := range updated.Loads {
+		if updated.Loads[i].Name == params.Load {
+			updated.Loads[i].Shadow = params.Enabled
+			return &updated, nil
+		}
+	}
+	if params.Load == models.DefaultLoadName {
+		return nil, fmt.Errorf("the plug of plugName has no shadow mode of its own, configure it as [%s%s] instead",
+			models.SectionLoadPrefix, models.DefaultLoadName)
+	}
+	return nil, fmt.Errorf("unknown load %s", params.Load)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+	"time"
+)
+
+func TestShadowMode(t *testing.T) {
+	m := &MonitoringController{shadow: make(map[string]*ShadowState)}
+	properties := models.Properties{Threshold: 500, Loads: []models.Load{{Name: "boiler", Shadow: true}, {Name: "pump"}}}
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tick := func(now time.Time, surplus float64) []SwitchDecision {
+		inputs := []LoadInput{{Load: properties.Loads[0], LearnedPower: 2000}, {Load: properties.Loads[1], LearnedPower: 800}}
+		data := m.applyShadow(inputs, InverterData{Overproduction: surplus}, properties, now)
+		return m.applyShadowDecisions(DecideLoads(data, inputs, properties))
+	}
+
+	// Test case 1: The load in shadow mode is not switched, the other load is
+	decisions := tick(start, 2500)
+	if len(decisions) != 1 || decisions[0].Load != "pump" {
+		t.Errorf("Test case 1: Expected only the decision on pump but got %+v", decisions)
+	}
+	if state := m.shadowState("boiler"); state == nil || !state.On || state.Switches != 1 {
+		t.Errorf("Test case 1: Expected boiler to be virtually on but got %+v", state)
+	}
+
+	// Test case 2: The virtual draw counts against the surplus, so the load stays on
+	tick(start.Add(time.Minute), 2500)
+	if state := m.shadowState("boiler"); !state.On || state.OnSeconds != 60 {
+		t.Errorf("Test case 2: Expected boiler to be on for 60 s but got %+v", state)
+	}
+
+	// Test case 3: Only the surplus part of the would-be draw is diverted
+	tick(start.Add(2*time.Minute), 1000)
+	state := m.shadowState("boiler")
+	if state.EnergyWh < 66.6 || state.EnergyWh > 66.7 || state.DivertedWh < 49.9 || state.DivertedWh > 50.1 {
+		t.Errorf("Test case 3: Expected 66.7 Wh with 50 Wh diverted but got %+v", state)
+	}
+
+	// Test case 4: The state is dropped when the load leaves shadow mode
+	updated, err := setShadowMode(&properties, models.SetShadowModeParams{Load: "boiler", Enabled: false})
+	if err != nil || updated.Loads[0].Shadow || !properties.Loads[0].Shadow {
+		t.Fatalf("Test case 4: Expected shadow mode disabled on the copy but got %+v, %v", updated, err)
+	}
+	properties = *updated
+	tick(start.Add(3*time.Minute), 2500)
+	if state := m.shadowState("boiler"); state != nil {
+		t.Errorf("Test case 4: Expected no virtual state but got %+v", state)
+	}
+
+	// Test case 5: The global shadow mode covers all loads
+	properties.ShadowMode = true
+	if decisions := tick(start.Add(4*time.Minute), 2500); len(decisions) != 0 {
+		t.Errorf("Test case 5: Expected no decision to be applied but got %+v", decisions)
+	}
+
+	// Test case 6: The record holds the data the decisions are based on and the measured data
+	inputs := []LoadInput{{Load: properties.Loads[0], LearnedPower: 2000}, {Load: properties.Loads[1], LearnedPower: 800}}
+	measured := InverterData{Overproduction: 2500}
+	data := m.applyShadow(inputs, measured, properties, start.Add(5*time.Minute))
+	record := newDecisionRecord(start, Data{InverterData: data}, measured, inputs, DecideLoads(data, inputs, properties), properties)
+	if record.Inputs != data || record.MeasuredInputs == nil || *record.MeasuredInputs != measured {
+		t.Errorf("Test case 6: Expected %+v with the measured %+v but got %+v, %+v", data, measured, record.Inputs, record.MeasuredInputs)
+	}
+}
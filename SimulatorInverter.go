@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SimulatorConfig describes the simulated plant and household.
+type SimulatorConfig struct {
+	// Latitude of the simulated plant in degrees, positive values are north
+	Latitude float64
+	// Date of the simulated day, the zero value means today
+	Date time.Time
+	// Installed peak power in kWp
+	KWp float64
+	// 0 = always clear sky, 1 = heavily overcast with strong fluctuations
+	Cloudiness float64
+	// Base load of the household in W
+	BaseLoad float64
+	// Simulated seconds per real second, 60 plays a whole day in 24 minutes
+	TimeAcceleration float64
+	// Seed for the random generator, 0 means seeded from the current time
+	Seed int64
+}
+
+// SimulatorConfigFromProperties returns the simulator config of the
+// properties, it fails if simDate is not a date.
+func SimulatorConfigFromProperties(properties models.Properties) (SimulatorConfig, error) {
+	config := SimulatorConfig{
+		Latitude:         properties.SimLatitude,
+		KWp:              properties.SimKWp,
+		Cloudiness:       properties.SimCloudiness,
+		BaseLoad:         properties.SimBaseLoad,
+		TimeAcceleration: properties.SimTimeAcceleration,
+	}
+	if properties.SimDate != "" {
+		date, err := time.ParseInLocation("2006-01-02", properties.SimDate, time.Local)
+		if err != nil {
+			return config, fmt.Errorf("invalid simDate %q, use YYYY-MM-DD", properties.SimDate)
+		}
+		config.Date = date
+	}
+	return config, nil
+}
+
+type appliance struct {
+	name string
+	// Power draw in W
+	power float64
+	// Typical run time
+	duration time.Duration
+	// Expected number of starts per day
+	startsPerDay float64
+}
+
+var simulatedAppliances = []appliance{
+	{name: "kettle", power: 2000, duration: 3 * time.Minute, startsPerDay: 4},
+	{name: "microwave", power: 900, duration: 5 * time.Minute, startsPerDay: 2},
+	{name: "washing machine", power: 2100, duration: 40 * time.Minute, startsPerDay: 0.6},
+	{name: "dishwasher", power: 1800, duration: 30 * time.Minute, startsPerDay: 0.8},
+	{name: "oven", power: 2500, duration: 45 * time.Minute, startsPerDay: 0.5},
+	{name: "vacuum cleaner", power: 700, duration: 20 * time.Minute, startsPerDay: 0.4},
+}
+
+type runningAppliance struct {
+	appliance
+	until time.Time
+}
+
+// SimulatorInverter generates plausible inverter readings for demos and
+// development without a real Kostal inverter.
+type SimulatorInverter struct {
+	config    SimulatorConfig
+	connected bool
+	now       func() time.Time
+
+	mutex      sync.Mutex
+	random     *rand.Rand
+	realStart  time.Time
+	simStart   time.Time
+	lastSample time.Time
+	cloudCover float64
+	running    []runningAppliance
+}
+
+func NewSimulatorInverter(config SimulatorConfig) *SimulatorInverter {
+	if config.TimeAcceleration <= 0 {
+		config.TimeAcceleration = 1
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &SimulatorInverter{
+		config: config,
+		now:    time.Now,
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (s *SimulatorInverter) Connect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.realStart = s.now()
+	s.simStart = s.realStart
+	if !s.config.Date.IsZero() {
+		year, month, day := s.config.Date.Date()
+		s.simStart = time.Date(year, month, day, s.realStart.Hour(), s.realStart.Minute(), s.realStart.Second(), 0, s.realStart.Location())
+	}
+	s.lastSample = time.Time{}
+	s.cloudCover = s.config.Cloudiness
+	s.running = nil
+	s.connected = true
+	return nil
+}
+
+func (s *SimulatorInverter) IsConnected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connected
+}
+
+// SimulatedTime returns the current time of the simulated day.
+func (s *SimulatorInverter) SimulatedTime() time.Time {
+	elapsed := s.now().Sub(s.realStart)
+	return s.simStart.Add(time.Duration(float64(elapsed) * s.config.TimeAcceleration))
+}
+
+func (s *SimulatorInverter) GetInverterData() (InverterData, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.connected {
+		return InverterData{}, errors.New("SimulatorInverter not connected")
+	}
+	simTime := s.SimulatedTime()
+	step := time.Duration(0)
+	if !s.lastSample.IsZero() && simTime.After(s.lastSample) {
+		step = simTime.Sub(s.lastSample)
+	}
+	s.lastSample = simTime
+
+	pvPower := s.pvPower(simTime, step)
+	housePower := s.housePower(simTime, step)
+	return InverterData{
+		HousePowerConsumption: housePower,
+		PVPower:               pvPower,
+		Overproduction:        pvPower - housePower,
+	}, nil
+}
+
+// pvPower returns the PV output at t, attenuated by the simulated cloud cover.
+func (s *SimulatorInverter) pvPower(t time.Time, step time.Duration) float64 {
+	clearSky := clearSkyPVPower(t, s.config.Latitude, s.config.KWp)
+	if clearSky <= 0 {
+		return 0
+	}
+
+	// The cloud cover follows a mean reverting random walk, so clouds come
+	// and go over minutes instead of jumping on every sample
+	minutes := step.Minutes()
+	if minutes > 0 {
+		reversion := math.Min(1, minutes/30)
+		noise := s.random.NormFloat64() * math.Sqrt(minutes/10) * 0.3 * s.config.Cloudiness
+		s.cloudCover += (s.config.Cloudiness-s.cloudCover)*reversion + noise
+		s.cloudCover = math.Max(0, math.Min(1, s.cloudCover))
+	}
+	// Even a fully overcast sky lets about a fifth of the light through
+	return clearSky * (1 - 0.8*s.cloudCover)
+}
+
+// housePower returns the household consumption at t: base load, a daily
+// usage profile and randomly started appliances.
+func (s *SimulatorInverter) housePower(t time.Time, step time.Duration) float64 {
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+	// More activity in the morning and in the evening
+	profile := 1 + 0.6*gaussian(hour, 7.5, 1.2) + 1.2*gaussian(hour, 19, 2)
+	power := s.config.BaseLoad * profile
+
+	running := s.running[:0]
+	for _, r := range s.running {
+		if r.until.After(t) {
+			running = append(running, r)
+		}
+	}
+	s.running = running
+
+	if step > 0 {
+		// People rarely cook or vacuum at night
+		activity := 0.1
+		if hour >= 6 && hour < 23 {
+			activity = 1
+		}
+		for _, a := range simulatedAppliances {
+			probability := a.startsPerDay * activity * step.Hours() / 17
+			if s.random.Float64() < probability && !s.isRunning(a.name) {
+				s.running = append(s.running, runningAppliance{appliance: a, until: t.Add(a.duration)})
+			}
+		}
+	}
+	for _, r := range s.running {
+		power += r.power
+	}
+	// Fridges and standby devices make the base load jitter a little
+	power += s.random.NormFloat64() * 0.05 * s.config.BaseLoad
+	return math.Max(0, power)
+}
+
+func (s *SimulatorInverter) isRunning(name string) bool {
+	for _, r := range s.running {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func gaussian(x float64, mean float64, sigma float64) float64 {
+	return math.Exp(-(x - mean) * (x - mean) / (2 * sigma * sigma))
+}
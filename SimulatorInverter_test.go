@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"testing"
+	"time"
+)
+
+func TestClearSkyPVPower(t *testing.T) {
+	location := time.FixedZone("CET", 3600)
+
+	// Test case 1: No production at midnight
+	midnight := time.Date(2023, time.June, 21, 0, 0, 0, 0, location)
+	if power := clearSkyPVPower(midnight, 51, 10); power != 0 {
+		t.Errorf("Test case 1: Expected 0 W at midnight but got %f", power)
+	}
+
+	// Test case 2: Noon in summer is close to, but below, the peak power
+	noon := time.Date(2023, time.June, 21, 12, 0, 0, 0, location)
+	summerNoon := clearSkyPVPower(noon, 51, 10)
+	if summerNoon < 6000 || summerNoon > 10000 {
+		t.Errorf("Test case 2: Expected between 6000 W and 10000 W but got %f", summerNoon)
+	}
+
+	// Test case 3: Noon in winter produces less than noon in summer
+	winterNoon := clearSkyPVPower(time.Date(2023, time.December, 21, 12, 0, 0, 0, location), 51, 10)
+	if winterNoon <= 0 || winterNoon >= summerNoon {
+		t.Errorf("Test case 3: Expected winter power between 0 and %f but got %f", summerNoon, winterNoon)
+	}
+
+	// Test case 4: The morning produces less than noon
+	morning := clearSkyPVPower(time.Date(2023, time.June, 21, 8, 0, 0, 0, location), 51, 10)
+	if morning <= 0 || morning >= summerNoon {
+		t.Errorf("Test case 4: Expected morning power between 0 and %f but got %f", summerNoon, morning)
+	}
+}
+
+func TestSimulatorConfigFromProperties(t *testing.T) {
+	// Test case 1: The date of the simulated day is parsed
+	config, err := SimulatorConfigFromProperties(models.Properties{SimDate: "2023-06-21"})
+	if err != nil || config.Date.Day() != 21 {
+		t.Errorf("Test case 1: Expected the 21st but got %v, %v", config.Date, err)
+	}
+
+	// Test case 2: An invalid date is an error
+	if _, err := SimulatorConfigFromProperties(models.Properties{SimDate: "21.06.2023"}); err == nil {
+		t.Errorf("Test case 2: Expected an error but got nil")
+	}
+}
+
+func TestSimulatorInverterTimeAcceleration(t *testing.T) {
+	realTime := time.Date(2023, time.June, 21, 6, 0, 0, 0, time.Local)
+	simulator := NewSimulatorInverter(SimulatorConfig{
+		Latitude:         51,
+		KWp:              8,
+		BaseLoad:         300,
+		TimeAcceleration: 60,
+		Seed:             1,
+	})
+	simulator.now = func() time.Time { return realTime }
+
+	if _, err := simulator.GetInverterData(); err == nil {
+		t.Error("Expected an error before Connect")
+	}
+	if err := simulator.Connect(); err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Six real minutes are six simulated hours
+	realTime = realTime.Add(6 * time.Minute)
+	if simulated := simulator.SimulatedTime(); simulated.Hour() != 12 {
+		t.Errorf("Expected simulated time 12:00 but got %v", simulated)
+	}
+
+	data, err := simulator.GetInverterData()
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	if data.PVPower <= 0 || data.HousePowerConsumption <= 0 {
+		t.Errorf("Expected positive values at noon but got %+v", data)
+	}
+	if data.Overproduction != data.PVPower-data.HousePowerConsumption {
+		t.Errorf("Expected overproduction to be PV minus consumption but got %+v", data)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Solar constant in W/m²
+	solarConstant = 1361.0
+	// Share of the PV peak power that is lost in inverter, cabling and heat
+	systemLosses = 0.14
+	// Share of the direct irradiance that reaches the ground as diffuse light
+	diffuseShare = 0.1
+)
+
+// PVPlant describes the orientation and size of a PV system.
+type PVPlant struct {
+	// Degrees, positive values are north and east
+	Latitude  float64
+	Longitude float64
+	// Inclination of the panels in degrees, 0 is flat
+	Tilt float64
+	// Direction the panels face in degrees clockwise from north, 180 is south
+	Azimuth float64
+	// Installed peak power in kWp
+	KWp float64
+}
+
+// solarPosition returns the elevation of the sun above the horizon and its
+// azimuth clockwise from north, both in radians.
+func solarPosition(t time.Time, latitude float64, longitude float64) (elevation float64, azimuth float64) {
+	utc := t.UTC()
+	dayOfYear := float64(utc.YearDay())
+	declination := -23.44 * math.Pi / 180 * math.Cos(2*math.Pi/365*(dayOfYear+10))
+
+	// Equation of time in minutes, the difference between true and mean
+	// solar time over the year
+	b := 2 * math.Pi * (dayOfYear - 1) / 365
+	equationOfTime := 229.18 * (0.000075 + 0.001868*math.Cos(b) - 0.032077*math.Sin(b) -
+		0.014615*math.Cos(2*b) - 0.040849*math.Sin(2*b))
+	solarMinutes := float64(utc.Hour()*60+utc.Minute()) + float64(utc.Second())/60 + 4*longitude + equationOfTime
+	hourAngle := (solarMinutes/4 - 180) * math.Pi / 180
+
+	lat := latitude * math.Pi / 180
+	sinElevation := math.Sin(lat)*math.Sin(declination) + math.Cos(lat)*math.Cos(declination)*math.Cos(hourAngle)
+	elevation = math.Asin(sinElevation)
+
+	cosAzimuth := (math.Sin(declination) - sinElevation*math.Sin(lat)) / (math.Cos(elevation) * math.Cos(lat))
+	azimuth = math.Acos(math.Max(-1, math.Min(1, cosAzimuth)))
+	// Afternoon sun is in the west
+	if math.Sin(hourAngle) > 0 {
+		azimuth = 2*math.Pi - azimuth
+	}
+	return elevation, azimuth
+}
+
+// standardMeridian returns the longitude of the standard time of t's
+// location, where the sun is highest at about 12:00 standard time.
+func standardMeridian(t time.Time) float64 {
+	// The smaller offset of the year is the standard time, the other one DST
+	_, januaryOffset := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()).Zone()
+	_, julyOffset := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, t.Location()).Zone()
+	offset := januaryOffset
+	if julyOffset < offset {
+		offset = julyOffset
+	}
+	return float64(offset) / 3600 * 15
+}
+
+// clearSkyPower estimates the output of the plant in W at t under a cloudless
+// sky.
+func (p PVPlant) clearSkyPower(t time.Time) float64 {
+	elevation, azimuth := solarPosition(t, p.Latitude, p.Longitude)
+	if elevation <= 0 {
+		return 0
+	}
+	// Meinel model for the direct irradiance depending on the air mass
+	airMass := 1 / math.Sin(elevation)
+	directIrradiance := solarConstant * math.Pow(0.7, math.Pow(airMass, 0.678))
+
+	tilt := p.Tilt * math.Pi / 180
+	cosIncidence := math.Sin(elevation)*math.Cos(tilt) +
+		math.Cos(elevation)*math.Sin(tilt)*math.Cos(azimuth-p.Azimuth*math.Pi/180)
+	irradiance := directIrradiance * math.Max(0, cosIncidence)
+	// Diffuse light from the part of the sky the panels see
+	irradiance += diffuseShare * directIrradiance * math.Sin(elevation) * (1 + math.Cos(tilt)) / 2
+	// kWp is rated at 1000 W/m²
+	return p.KWp * irradiance * (1 - systemLosses)
+}
+
+// clearSkyPVPower estimates the PV output in W of a flat plant with kWp peak
+// power at the given time and latitude under a cloudless sky. Without a
+// longitude the plant is assumed on the standard meridian of t's location.
+func clearSkyPVPower(t time.Time, latitude float64, kWp float64) float64 {
+	plant := PVPlant{Latitude: latitude, Longitude: standardMeridian(t), Azimuth: 180, KWp: kWp}
+	return plant.clearSkyPower(t)
+}
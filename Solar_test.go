@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSolarPosition(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*3600)
+
+	// Test case 1: At solar noon of the summer solstice the sun is 90° - 52.5° + 23.44° high in the south
+	elevation, azimuth := solarPosition(time.Date(2024, 6, 21, 13, 10, 0, 0, berlin), 52.5, 13.4)
+	if degrees := elevation * 180 / math.Pi; math.Abs(degrees-60.9) > 0.5 {
+		t.Errorf("Test case 1: Expected an elevation of 60.9° but got %.1f°", degrees)
+	}
+	if degrees := azimuth * 180 / math.Pi; math.Abs(degrees-180) > 3 {
+		t.Errorf("Test case 1: Expected an azimuth of 180° but got %.1f°", degrees)
+	}
+
+	// Test case 2: In the afternoon the sun is in the west
+	if _, azimuth := solarPosition(time.Date(2024, 6, 21, 17, 0, 0, 0, berlin), 52.5, 13.4); azimuth*180/math.Pi <= 200 {
+		t.Errorf("Test case 2: Expected an azimuth beyond 200° but got %.1f°", azimuth*180/math.Pi)
+	}
+
+	// Test case 3: No power at night
+	if power := (PVPlant{Latitude: 52.5, Longitude: 13.4, KWp: 10}).clearSkyPower(time.Date(2024, 6, 21, 23, 0, 0, 0, berlin)); power != 0 {
+		t.Errorf("Test case 3: Expected 0 W but got %.0f W", power)
+	}
+}
+
+func TestClearSkyPower(t *testing.T) {
+	noon := time.Date(2024, 12, 21, 12, 0, 0, 0, time.UTC)
+	flat := PVPlant{Latitude: 52.5, Longitude: 0, Tilt: 0, Azimuth: 180, KWp: 10}
+	south := PVPlant{Latitude: 52.5, Longitude: 0, Tilt: 45, Azimuth: 180, KWp: 10}
+	north := PVPlant{Latitude: 52.5, Longitude: 0, Tilt: 45, Azimuth: 0, KWp: 10}
+
+	// Test case 1: A tilted plant facing south gets more of the low winter sun than a flat one
+	if south.clearSkyPower(noon) <= flat.clearSkyPower(noon) {
+		t.Errorf("Test case 1: Expected more than %.0f W but got %.0f W", flat.clearSkyPower(noon), south.clearSkyPower(noon))
+	}
+
+	// Test case 2: Facing north only the diffuse light is left
+	if north.clearSkyPower(noon) >= flat.clearSkyPower(noon)/2 {
+		t.Errorf("Test case 2: Expected less than %.0f W but got %.0f W", flat.clearSkyPower(noon)/2, north.clearSkyPower(noon))
+	}
+
+	// Test case 3: The power never exceeds the peak power
+	if power := south.clearSkyPower(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)); power <= 0 || power > 10000 {
+		t.Errorf("Test case 3: Expected between 0 and 10000 W but got %.0f W", power)
+	}
+}
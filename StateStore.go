@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/db-tech/SolarKostalConbee2Controller/safefile"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateFileName is the file next to the config file that keeps what the app
+// has learned at runtime.
+const stateFileName = "state.json"
+
+// LoadRuntimeState is the persisted state of a load.
+type LoadRuntimeState struct {
+	// Average power drawn by the load while it is on in W, learned from the
+	// power meter of its actuator
+	LearnedPower float64 `json:"learnedPower,omitempty"`
+	// Number of measurements the average is based on
+	LearnedSamples int `json:"learnedSamples,omitempty"`
+	// Manual override, nil in automatic mode
+	Override *LoadOverride `json:"override,omitempty"`
+	// Runtime and energy of the current day
+	Progress *DailyProgress `json:"progress,omitempty"`
+}
+
+type persistentState struct {
+	Loads map[string]*LoadRuntimeState `json:"loads"`
+}
+
+// StateStore keeps the runtime state of the loads in a JSON file. Changes are
+// kept in memory and written by Save.
+type StateStore struct {
+	path  string
+	mutex sync.Mutex
+	state persistentState
+	dirty bool
+	saved time.Time
+}
+
+// statePath returns the path of the state file in the directory of the
+// config file.
+func statePath() string {
+	return filepath.Join(filepath.Dir(configPath), stateFileName)
+}
+
+// OpenStateStore reads the state file at path. A missing or broken file
+// starts with an empty state, the state is only an optimization.
+func OpenStateStore(path string) *StateStore {
+	store := &StateStore{
+		path:  path,
+		state: persistentState{Loads: make(map[string]*LoadRuntimeState)},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("Could not read %s", path)
+		}
+		return store
+	}
+	err = json.Unmarshal(data, &store.state)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Ignoring broken state file %s", path)
+		store.state = persistentState{}
+	}
+	if store.state.Loads == nil {
+		store.state.Loads = make(map[string]*LoadRuntimeState)
+	}
+	return store
+}
+
+// Load returns a copy of the state of the load.
+func (s *StateStore) Load(name string) LoadRuntimeState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if state, ok := s.state.Loads[name]; ok {
+		return *state
+	}
+	return LoadRuntimeState{}
+}
+
+// UpdateLoad changes the state of the load with update.
+func (s *StateStore) UpdateLoad(name string, update func(state *LoadRuntimeState)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.state.Loads[name]
+	if !ok {
+		state = &LoadRuntimeState{}
+		s.state.Loads[name] = state
+	}
+	update(state)
+	s.dirty = true
+}
+
+// Save writes the state file if the state has changed.
+func (s *StateStore) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = safefile.WriteFile(s.path, data, 0600, 1)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	s.saved = time.Now()
+	return nil
+}
+
+// SaveAfter writes the state file if the state has changed and the last write
+// is at least interval ago, to spare SD cards.
+func (s *StateStore) SaveAfter(interval time.Duration) error {
+	s.mutex.Lock()
+	due := time.Since(s.saved) >= interval
+	s.mutex.Unlock()
+	if !due {
+		return nil
+	}
+	return s.Save()
+}
+
+// Snapshot returns the state as it is written to the state file.
+func (s *StateStore) Snapshot() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return json.MarshalIndent(s.state, "", "  ")
+}
+
+// Restore replaces the state with data as returned by Snapshot and writes the
+// state file.
+func (s *StateStore) Restore(data []byte) error {
+	state := persistentState{}
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if state.Loads == nil {
+		state.Loads = make(map[string]*LoadRuntimeState)
+	}
+	s.mutex.Lock()
+	s.state = state
+	s.dirty = true
+	s.mutex.Unlock()
+	return s.Save()
+}
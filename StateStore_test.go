@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFileName)
+	store := OpenStateStore(path)
+	store.UpdateLoad("boiler", func(state *LoadRuntimeState) {
+		state.LearnedPower = 1800
+		state.LearnedSamples = 3
+	})
+	err := store.Save()
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: The state survives a restart
+	reopened := OpenStateStore(path)
+	if state := reopened.Load("boiler"); state.LearnedPower != 1800 || state.LearnedSamples != 3 {
+		t.Errorf("Test case 1: Expected 1800 W from 3 samples but got %+v", state)
+	}
+
+	// Test case 2: A broken file starts with an empty state
+	os.WriteFile(path, []byte("{broken"), 0600)
+	broken := OpenStateStore(path)
+	if state := broken.Load("boiler"); state.LearnedPower != 0 {
+		t.Errorf("Test case 2: Expected an empty state but got %+v", state)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"time"
+)
+
+// DailyProgress is how long a load has run and how much energy it has drawn
+// on a day.
+type DailyProgress struct {
+	// Local date, e.g. 2024-05-10
+	Day            string    `json:"day"`
+	RuntimeSeconds float64   `json:"runtimeSeconds"`
+	EnergyWh       float64   `json:"energyWh"`
+	LastUpdate     time.Time `json:"lastUpdate"`
+}
+
+// TargetPlan is the progress of a load towards its daily target and when it
+// will be switched on from the grid to reach it.
+type TargetPlan struct {
+	Load                 string  `json:"load"`
+	TargetRuntimeSeconds float64 `json:"targetRuntimeSeconds,omitempty"`
+	TargetEnergyWh       float64 `json:"targetEnergyWh,omitempty"`
+	DailyProgress
+	Deadline time.Time `json:"deadline"`
+	// Runtime still needed to reach the target
+	RemainingSeconds float64 `json:"remainingSeconds"`
+	// Time the schedule of the load allows it to run until the deadline
+	AvailableSeconds float64 `json:"availableSeconds"`
+	// Latest time the load has to be switched on to reach the target, nil if
+	// the target is reached or cannot be reached any more
+	LatestStart *time.Time `json:"latestStart,omitempty"`
+	Reached     bool       `json:"reached"`
+	// The load runs from the grid to reach the target in time
+	Due bool `json:"due"`
+}
+
+// Ticks that are further apart do not count, e.g. after a restart
+const maxProgressGap = 5 * time.Minute
+
+// trackProgress adds the time since the last update to the daily runtime and
+// energy of the load if it is on, drawing power. The progress starts over
+// every day, day is the local date of now.
+func (s *StateStore) trackProgress(name string, on bool, power float64, day string, now time.Time) *DailyProgress {
+	var tracked DailyProgress
+	s.UpdateLoad(name, func(loadState *LoadRuntimeState) {
+		progress := loadState.Progress
+		if progress == nil || progress.Day != day {
+			progress = &DailyProgress{Day: day}
+			loadState.Progress = progress
+		}
+		elapsed := now.Sub(progress.LastUpdate)
+		if on && !progress.LastUpdate.IsZero() && elapsed > 0 && elapsed <= maxProgressGap {
+			progress.RuntimeSeconds += elapsed.Seconds()
+			progress.EnergyWh += power * elapsed.Hours()
+		}
+		progress.LastUpdate = now
+		tracked = *progress
+	})
+	return &tracked
+}
+
+// planTarget calculates the plan of a load with a daily target at now, which
+// has to be in the configured timezone. expectedPower is used to convert the
+// missing energy into runtime. The load is due if it has to run from now on to
+// reach the target, margin lets it start a bit early.
+func planTarget(load models.Load, progress *DailyProgress, expectedPower float64, now time.Time, margin time.Duration) TargetPlan {
+	plan := TargetPlan{
+		Load:                 load.Name,
+		TargetRuntimeSeconds: load.MinRuntime.Seconds(),
+		TargetEnergyWh:       load.MinEnergy,
+		Deadline:             load.DeadlineOn(now),
+	}
+	if progress != nil && progress.Day == now.Format("2006-01-02") {
+		plan.DailyProgress = *progress
+	} else {
+		plan.DailyProgress = DailyProgress{Day: now.Format("2006-01-02")}
+	}
+
+	remaining := plan.TargetRuntimeSeconds - plan.RuntimeSeconds
+	if load.MinEnergy > 0 && expectedPower > 0 {
+		energyRuntime := (load.MinEnergy - plan.EnergyWh) / expectedPower * 3600
+		if energyRuntime > remaining {
+			remaining = energyRuntime
+		}
+	}
+	if remaining <= 0 {
+		plan.Reached = true
+		return plan
+	}
+	plan.RemainingSeconds = remaining
+
+	schedule, err := load.Schedule()
+	allowed := func(t time.Time) bool {
+		ok, _ := schedule.Allows(t)
+		return err == nil && ok
+	}
+	// Walk backwards from the deadline in steps of a minute through the times
+	// the schedule allows, until they are enough for the remaining runtime
+	needed := time.Duration(remaining * float64(time.Second))
+	var collected time.Duration
+	for t := plan.Deadline.Add(-time.Minute); !t.Before(now.Truncate(time.Minute)); t = t.Add(-time.Minute) {
+		if !allowed(t) {
+			continue
+		}
+		step := time.Minute
+		if t.Before(now) {
+			step = t.Add(time.Minute).Sub(now)
+		}
+		plan.AvailableSeconds += step.Seconds()
+		if collected < needed {
+			collected += step
+			if collected >= needed {
+				start := t
+				if start.Before(now) {
+					start = now
+				}
+				plan.LatestStart = &start
+			}
+		}
+	}
+	if plan.AvailableSeconds == 0 {
+		return plan
+	}
+	plan.Due = plan.LatestStart == nil || !plan.LatestStart.After(now.Add(margin))
+	return plan
+}
+
+// targetReason explains why a load runs from the grid.
+func (p TargetPlan) targetReason() string {
+	return fmt.Sprintf("daily target needs %s more until %s with %s left",
+		formatSeconds(p.RemainingSeconds), p.Deadline.Format("15:04"), formatSeconds(p.AvailableSeconds))
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).Truncate(time.Minute).String()
+}
+
+// targetPlans returns the plans of all loads with a daily target at now.
+func targetPlans(properties models.Properties, stateStore *StateStore, now time.Time) []TargetPlan {
+	localNow := now.In(properties.Location())
+	margin := time.Duration(properties.PollDuration) * time.Second
+	plans := []TargetPlan{}
+	for _, load := range properties.SwitchedLoads() {
+		if !load.HasTarget() {
+			continue
+		}
+		state := stateStore.Load(load.Name)
+		input := LoadInput{Load: load, LearnedPower: state.LearnedPower}
+		plans = append(plans, planTarget(load, state.Progress, input.expectedPower(properties), localNow, margin))
+	}
+	return plans
+}
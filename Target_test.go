@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/db-tech/SolarKostalConbee2Controller/models"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlanTarget(t *testing.T) {
+	boiler := models.Load{Name: "boiler", MinRuntime: 2 * time.Hour, Deadline: "20:00"}
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 10, hour, minute, 0, 0, time.UTC)
+	}
+	margin := time.Minute
+
+	// Test case 1: Enough time left, the load waits for surplus
+	plan := planTarget(boiler, nil, 2000, day(12, 0), margin)
+	if plan.Due || plan.LatestStart == nil || !plan.LatestStart.Equal(day(18, 0)) {
+		t.Errorf("Test case 1: Expected the latest start at 18:00 but got %+v", plan)
+	}
+
+	// Test case 2: The load is due at the latest start
+	progress := &DailyProgress{Day: "2024-05-10", RuntimeSeconds: 3600}
+	plan = planTarget(boiler, progress, 2000, day(19, 0), margin)
+	if !plan.Due || plan.RemainingSeconds != 3600 {
+		t.Errorf("Test case 2: Expected the load to be due for 1h but got %+v", plan)
+	}
+
+	// Test case 3: The progress of yesterday does not count
+	progress = &DailyProgress{Day: "2024-05-09", RuntimeSeconds: 7200}
+	plan = planTarget(boiler, progress, 2000, day(12, 0), margin)
+	if plan.Reached || plan.RuntimeSeconds != 0 {
+		t.Errorf("Test case 3: Expected the progress to start over but got %+v", plan)
+	}
+
+	// Test case 4: The missing energy is converted into runtime with the expected power
+	heater := models.Load{Name: "heater", MinEnergy: 3000, Deadline: "20:00"}
+	progress = &DailyProgress{Day: "2024-05-10", EnergyWh: 1000}
+	plan = planTarget(heater, progress, 1000, day(17, 0), margin)
+	if plan.RemainingSeconds != 7200 || plan.Due {
+		t.Errorf("Test case 4: Expected 2h remaining but got %+v", plan)
+	}
+
+	// Test case 5: Only the times the schedule allows are available
+	limited := boiler
+	limited.Forbid = "18:00-20:00"
+	plan = planTarget(limited, nil, 2000, day(16, 0), margin)
+	if !plan.Due || plan.AvailableSeconds != 2*3600 {
+		t.Errorf("Test case 5: Expected the load to be due with 2h available but got %+v", plan)
+	}
+
+	// Test case 6: A reached target does not run the load
+	progress = &DailyProgress{Day: "2024-05-10", RuntimeSeconds: 7200}
+	plan = planTarget(boiler, progress, 2000, day(19, 0), margin)
+	if !plan.Reached || plan.Due {
+		t.Errorf("Test case 6: Expected the target to be reached but got %+v", plan)
+	}
+
+	// Test case 7: After the deadline the load is not due any more
+	plan = planTarget(boiler, nil, 2000, day(21, 0), margin)
+	if plan.Due {
+		t.Errorf("Test case 7: Expected the load not to be due after the deadline but got %+v", plan)
+	}
+}
+
+func TestTrackProgress(t *testing.T) {
+	store := OpenStateStore(filepath.Join(t.TempDir(), stateFileName))
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	store.trackProgress("boiler", true, 2000, "2024-05-10", start)
+	progress := store.trackProgress("boiler", true, 2000, "2024-05-10", start.Add(time.Minute))
+
+	// Test case 1: The time between two updates is counted while the load is on
+	if progress.RuntimeSeconds != 60 || progress.EnergyWh < 33.3 || progress.EnergyWh > 33.4 {
+		t.Errorf("Test case 1: Expected 60 s and 33.3 Wh but got %+v", progress)
+	}
+
+	// Test case 2: Long gaps are not counted
+	progress = store.trackProgress("boiler", true, 2000, "2024-05-10", start.Add(time.Hour))
+	if progress.RuntimeSeconds != 60 {
+		t.Errorf("Test case 2: Expected 60 s but got %+v", progress)
+	}
+
+	// Test case 3: The progress starts over on the next day
+	progress = store.trackProgress("boiler", true, 2000, "2024-05-11", start.Add(24*time.Hour))
+	if progress.RuntimeSeconds != 0 || progress.Day != "2024-05-11" {
+		t.Errorf("Test case 3: Expected the progress of a new day but got %+v", progress)
+	}
+}
+
+func TestMeteredDraw(t *testing.T) {
+	measured := 1800.0
+	boiler := models.Load{Name: "boiler"}
+	heater := models.Load{Name: "heater", Mode: models.LoadModeProportional}
+	tests := []struct {
+		input LoadInput
+		power float64
+		known bool
+	}{
+		// Test case 1: A load that is off draws nothing
+		{LoadInput{Load: boiler}, 0, true},
+		// Test case 2: The measured power comes first
+		{LoadInput{Load: boiler, On: true, Power: &measured, LearnedPower: 2000}, 1800, true},
+		// Test case 3: Without meter the learned power is used
+		{LoadInput{Load: boiler, On: true, LearnedPower: 2000}, 2000, true},
+		// Test case 4: A proportional load draws its share of maxPower
+		{LoadInput{Load: models.Load{Name: "heater", Mode: models.LoadModeProportional, MaxPower: 1000}, On: true, Level: 127}, 498, true},
+		// Test case 5: The power of a proportional load without maxPower is unknown
+		{LoadInput{Load: heater, On: true, Level: 127, LearnedPower: 2000}, 0, false},
+		// Test case 6: The power of a load without meter that has not been learned is unknown
+		{LoadInput{Load: boiler, On: true}, 0, false},
+	}
+	for i, test := range tests {
+		if power, known := test.input.meteredDraw(); math.Abs(power-test.power) > 0.5 || known != test.known {
+			t.Errorf("Test case %d: Expected %.0f W (%v) but got %.0f W (%v)", i+1, test.power, test.known, power, known)
+		}
+	}
+}
@@ -10,10 +10,13 @@ require (
 
 require (
 	github.com/db-tech/JsonRpcWebsocketServer v0.0.0-20230402213846-9a6046e56f8b
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/geschke/golrackpi v0.0.0-20220825184314-bfd875d824f5
 	github.com/pkg/errors v0.9.1
 	github.com/rs/zerolog v1.29.0
+	golang.org/x/crypto v0.6.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -25,7 +28,6 @@ require (
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
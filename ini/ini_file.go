@@ -1,8 +1,10 @@
 package ini
 
 import (
+	"bytes"
 	"fmt"
 	"gopkg.in/ini.v1"
+	"sort"
 )
 
 func LoadPropertiesFromFile(filepath string) (map[string]string, error) {
@@ -45,3 +47,56 @@ func SavePropertiesToFile(filepath string, properties map[string]string) error {
 
 	return nil
 }
+
+// ParseSections parses INI data into a map of sections. Keys outside of any
+// section are stored in the section "".
+func ParseSections(data []byte) (map[string]map[string]string, error) {
+	cfg, err := ini.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("error loading INI file: %v", err)
+	}
+
+	sections := make(map[string]map[string]string)
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if name == ini.DefaultSection {
+			name = ""
+		}
+		values := make(map[string]string)
+		for _, key := range section.Keys() {
+			values[key.Name()] = key.Value()
+		}
+		sections[name] = values
+	}
+	return sections, nil
+}
+
+// FormatSections creates INI data from a map of sections. Sections and keys
+// are sorted, the section "" is written first without a header.
+func FormatSections(sections map[string]map[string]string) ([]byte, error) {
+	cfg := ini.Empty()
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		section := cfg.Section(name)
+		keys := make([]string, 0, len(sections[name]))
+		for key := range sections[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			section.Key(key).SetValue(sections[name][key])
+		}
+	}
+
+	var buffer bytes.Buffer
+	_, err := cfg.WriteTo(&buffer)
+	if err != nil {
+		return nil, fmt.Errorf("error writing INI file: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
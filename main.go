@@ -2,10 +2,10 @@ package main
 
 import (
 	"encoding/base64"
+	"flag"
 	"fmt"
 	"github.com/db-tech/JsonRpcWebsocketServer/jrws"
 	models2 "github.com/db-tech/JsonRpcWebsocketServer/models"
-	"github.com/db-tech/SolarKostalConbee2Controller/ini"
 	"github.com/db-tech/SolarKostalConbee2Controller/models"
 	"github.com/db-tech/SolarKostalConbee2Controller/web"
 	"github.com/labstack/echo/v4"
@@ -16,6 +16,7 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -39,26 +40,6 @@ func createUsernamePasswordBase64Hash(username string, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(usernamePassword))
 }
 
-func loadProperties() (*models.Properties, error) {
-	log.Info().Msg("Initializing properties")
-	err := CreateIniFileIfNotExists("config.ini")
-	if err != nil {
-		return nil, err
-	}
-	log.Info().Msg("Load properties from file")
-	props, err := ini.LoadPropertiesFromFile("config.ini")
-	if err != nil {
-		return nil, err
-	}
-
-	log.Info().Msg("Create properties from map")
-	propertiesWithDefaults, err := models.FromMapWithDefaults(props)
-	if err != nil {
-		return nil, err
-	}
-	return propertiesWithDefaults, nil
-}
-
 func initDeconzHostAddress() (string, error) {
 	hostAddress, err := DiscoverDeconzHostAddress()
 	if err != nil {
@@ -86,7 +67,7 @@ func authenticateConbeeClient(properties *models.Properties, conbeeClient *Conbe
 						"Or provide a valid username and password"}
 			}
 			properties.ApiKey = apiKEy
-			saveErr := properties.SaveToFile("config.ini")
+			saveErr := saveProperties(properties)
 			if saveErr != nil {
 				log.Error().Stack().Err(errors.WithStack(saveErr)).Msg("Error saving API key to file")
 				return models.InitResponseParams{
@@ -105,7 +86,7 @@ func authenticateConbeeClient(properties *models.Properties, conbeeClient *Conbe
 				}
 			}
 			properties.ApiKey = apiKey
-			saveErr := properties.SaveToFile("config.ini")
+			saveErr := saveProperties(properties)
 			if saveErr != nil {
 				log.Error().Stack().Err(errors.WithStack(saveErr)).Msg("Error saving API key to file")
 				return models.InitResponseParams{
@@ -169,6 +150,9 @@ var (
 	inverter     Inverter
 	properties   *models.Properties
 	monitoring   *MonitoringController
+	stateStore   *StateStore
+	historyStore *HistoryStore
+	decisionLog  *DecisionLog
 )
 
 func InitConbeeInverterAndProperties() error {
@@ -189,7 +173,7 @@ func InitConbeeInverterAndProperties() error {
 			return err
 		}
 		properties.HostAddress = hostAddress
-		err = properties.SaveToFile("config.ini")
+		err = saveProperties(properties)
 		if err != nil {
 			log.Error().Stack().Err(errors.WithStack(err)).Msg("Error saving host address to file")
 			return err
@@ -205,10 +189,20 @@ func InitConbeeInverterAndProperties() error {
 			log.Error().Stack().Err(err).Msg("Error authenticating conbee client")
 			return nil
 		}
+		// Configs from before uniqueids were supported only name their lights
+		changed, err := resolveLightUniqueIds(properties, conbeeClient)
+		if err != nil {
+			log.Warn().Err(err).Msg("Could not resolve the uniqueids of the lights")
+		} else if changed {
+			err = saveProperties(properties)
+			if err != nil {
+				log.Error().Stack().Err(err).Msg("Error saving the uniqueids of the lights")
+			}
+		}
 	}
 
 	log.Info().Msg("Initializing inverter..")
-	inverter = NewInverterClient(properties.KostalAddress, properties.KostalPassword, properties.KostalType)
+	inverter = NewInverterClient(*properties)
 	err = inverter.Connect()
 	if err != nil {
 		log.Error().Stack().Err(err).Msg("Error connecting to inverter")
@@ -220,7 +214,6 @@ func InitConbeeInverterAndProperties() error {
 }
 
 func main() {
-
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	if os.Getenv("DEBUG") == "true" {
 		zerolog.TimeFieldFormat = time.RFC3339Nano
@@ -236,6 +229,27 @@ func main() {
 		log.Logger = log.Output(multiWriter)
 	}
 
+	if path, ok := os.LookupEnv("SKC_CONFIG"); ok {
+		configPath = path
+	}
+	flag.StringVar(&configPath, "config", configPath, "path of the config file, can also be set by SKC_CONFIG")
+	flag.Usage = func() {
+		runCommandHelp(nil, flag.CommandLine.Output())
+		fmt.Fprintln(flag.CommandLine.Output(), "\nGlobal flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := RunCommand(flag.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runServer starts the web server, the websocket server and the monitoring
+// and blocks until the websocket server stops.
+func runServer() {
 	log.Info().Msg("Initializing webserver..")
 	e := echo.New()
 
@@ -248,13 +262,19 @@ func main() {
 
 	wsServer := jrws.NewWebsocketServer("/ws", 8888)
 
+	stateStore = OpenStateStore(statePath())
+	historyStore = OpenHistoryStore(historyPath())
+	decisionLog = NewDecisionLog()
 	err := InitConbeeInverterAndProperties()
 
 	if err == nil {
 		startupStatus := CheckSystemStatus(properties, conbeeClient, inverter)
-		if startupStatus.Status == models.InitStatusOk {
-			monitoring = NewMonitoringController(conbeeClient, inverter, wsServer)
-			monitoring.StartMonitoring(*properties)
+		if startupStatus.IsOperational() {
+			monitoring = NewMonitoringController(conbeeClient, inverter, stateStore, historyStore, decisionLog, wsServer)
+			err = monitoring.StartMonitoring(*properties)
+			if err != nil {
+				log.Error().Err(err).Msg("Could not start monitoring")
+			}
 		}
 	}
 
@@ -263,11 +283,11 @@ func main() {
 		log.Info().Msg("Handler: status")
 		status := CheckSystemStatus(properties, conbeeClient, inverter)
 		log.Info().Int("status", status.Status).Msg(status.StatusMessage)
-		if status.Status != models.InitStatusOk {
+		if !status.IsOperational() {
 			return status, nil
 		}
 		if monitoring != nil {
-			wsServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: monitoring.isRunning})
+			wsServer.WriteNotificationToAllMembers("monitoring", models.MonitoringEnabledParams{Enabled: monitoring.IsRunning()})
 			_, err := monitoring.RequestDataAndSendWsNotification(*properties)
 			if err != nil {
 				log.Error().Stack().Err(err).Msg("Error requesting data and sending ws notification")
@@ -286,7 +306,7 @@ func main() {
 
 	wsServer.AddHandler("getLights", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
 		log.Info().Msg("Handler: getLights")
-		lights, restErrResp, err := conbeeClient.GetLights()
+		lights, restErrResp, err := GetLights(properties, conbeeClient)
 		if err != nil {
 			return nil, err
 		}
@@ -296,6 +316,35 @@ func main() {
 		return lights, nil
 	})
 
+	wsServer.AddHandler("getGroups", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getGroups")
+		groups, restErrResp, err := conbeeClient.GetGroups()
+		if err != nil {
+			return nil, err
+		}
+		if restErrResp != nil && restErrResp.Code != 200 {
+			return restErrResp, nil
+		}
+		return groups, nil
+	})
+
+	wsServer.AddHandler("getGroupScenes", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getGroupScenes")
+		groupParams := &models.GroupParams{}
+		err := jrws.CreateParamsObject(request.Params, groupParams)
+		if err != nil {
+			return nil, err
+		}
+		scenes, restErrResp, err := conbeeClient.GetGroupScenes(groupParams.GroupId)
+		if err != nil {
+			return nil, err
+		}
+		if restErrResp != nil && restErrResp.Code != 200 {
+			return restErrResp, nil
+		}
+		return scenes, nil
+	})
+
 	wsServer.AddHandler("loginKostal", func(request models2.Request, concurrentWs *jrws.ConcurrentWebsocket) (interface{}, error) {
 		log.Info().Msg("Handler: loginKostal")
 		authParams := &models.AuthenticateParams{}
@@ -309,7 +358,7 @@ func main() {
 		properties.KostalPassword = authParams.Password
 		log.Info().Msgf("KostalAddress: %s, KostalUsername: %s", properties.KostalAddress, properties.KostalUsername)
 
-		inverter = NewInverterClient(authParams.HostAddress, authParams.Password, properties.KostalType)
+		inverter = NewInverterClient(*properties)
 		err = inverter.Connect()
 		if err != nil {
 			log.Error().Err(err).Msg("Error connecting to inverter")
@@ -319,7 +368,7 @@ func main() {
 			}, nil
 
 		}
-		err = ini.SavePropertiesToFile("config.ini", properties.ToMap())
+		err = saveProperties(properties)
 		if err != nil {
 			return models.InitResponseParams{
 				Status:        models.InitStatusError,
@@ -354,7 +403,7 @@ func main() {
 				conbeeClient.hostAddress = authParams.HostAddress
 				conbeeClient.restClient.SetBaseURL("http://" + conbeeClient.hostAddress)
 			}
-			err = ini.SavePropertiesToFile("config.ini", properties.ToMap())
+			err = saveProperties(properties)
 			if err != nil {
 				return nil, err
 			}
@@ -377,9 +426,12 @@ func main() {
 	wsServer.AddHandler("startMonitoring", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
 		log.Info().Msg("Handler: startMonitoring")
 		if monitoring == nil {
-			monitoring = NewMonitoringController(conbeeClient, inverter, wsServer)
+			monitoring = NewMonitoringController(conbeeClient, inverter, stateStore, historyStore, decisionLog, wsServer)
+		}
+		err := monitoring.StartMonitoring(*properties)
+		if err != nil {
+			return nil, err
 		}
-		monitoring.StartMonitoring(*properties)
 		return nil, nil
 	})
 
@@ -396,25 +448,49 @@ func main() {
 		if err != nil {
 			return nil, err
 		}
-		properties.PlugName = saveProps.PlugName
-		properties.Threshold = saveProps.Threshold
-		properties.PollDuration = saveProps.PollDuration
-		err = ini.SavePropertiesToFile("config.ini", properties.ToMap())
+		updatedProperties := *properties
+		if saveProps.PlugName != properties.PlugName {
+			updatedProperties.PlugUniqueId = ""
+		}
+		updatedProperties.PlugName = saveProps.PlugName
+		updatedProperties.Threshold = saveProps.Threshold
+		updatedProperties.PollDuration = saveProps.PollDuration
+		fieldErrors := updatedProperties.Validate()
+		fieldErrors = append(fieldErrors, validateLoadsOnGateway(&updatedProperties, conbeeClient)...)
+		if len(fieldErrors) > 0 {
+			return models.InitResponseParams{
+				Status:        models.InitStatusConfig,
+				StatusMessage: "Invalid configuration: " + fieldErrors.Error(),
+				FieldErrors:   fieldErrors,
+			}, nil
+		}
+
+		if conbeeClient != nil {
+			_, err = resolveLightUniqueIds(&updatedProperties, conbeeClient)
+			if err != nil {
+				log.Warn().Err(err).Msg("Could not resolve the uniqueids of the lights")
+			}
+		}
+		*properties = updatedProperties
+		err = saveProperties(properties)
 		if err != nil {
 			return nil, err
 		}
 
 		status := CheckSystemStatus(properties, conbeeClient, inverter)
-		if status.Status != models.InitStatusOk {
+		if !status.IsOperational() {
 			return status, nil
 		}
 
 		if monitoring == nil {
-			monitoring = NewMonitoringController(conbeeClient, inverter, wsServer)
+			monitoring = NewMonitoringController(conbeeClient, inverter, stateStore, historyStore, decisionLog, wsServer)
 		}
 		if monitoring.IsRunning() {
 			log.Info().Msg("Restart monitoring")
-			monitoring.StartMonitoring(*properties)
+			err = monitoring.StartMonitoring(*properties)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			log.Info().Msg("Start monitoring")
 		}
@@ -437,10 +513,26 @@ func main() {
 
 		log.Info().Msg("Handler: switchLightOn")
 		status := CheckSystemStatus(properties, conbeeClient, inverter)
-		if status.Status != models.InitStatusOk {
+		if !status.IsOperational() {
 			return status, nil
 		}
-		err = conbeeClient.SwitchOnLight(switchLightParams.LightId)
+		// Keep the monitoring from switching the load back right away
+		load, isLoad := FindLightLoad(properties, switchLightParams.LightId)
+		override, err := overrideFromParams(true, *switchLightParams, time.Now())
+		if err != nil {
+			return models.InitResponseParams{
+				Status:        models.InitStatusError,
+				StatusMessage: err.Error(),
+			}, nil
+		}
+		actuator, err := NewLightActuator(properties, conbeeClient, switchLightParams.LightId)
+		if err == nil {
+			err = SwitchVerified(actuator, true)
+		}
+		if err == nil && isLoad {
+			log.Info().Msgf("Manual override of load %s: %s", load.Name, override)
+			err = stateStore.SetOverride(load.Name, override)
+		}
 		if err != nil {
 			return models.InitResponseParams{
 				Status:        models.InitStatusError,
@@ -468,10 +560,26 @@ func main() {
 
 		log.Info().Msg("Handler: switchLightOn")
 		status := CheckSystemStatus(properties, conbeeClient, inverter)
-		if status.Status != models.InitStatusOk {
+		if !status.IsOperational() {
 			return status, nil
 		}
-		err = conbeeClient.SwitchOffLight(switchLightParams.LightId)
+		// Keep the monitoring from switching the load back right away
+		load, isLoad := FindLightLoad(properties, switchLightParams.LightId)
+		override, err := overrideFromParams(false, *switchLightParams, time.Now())
+		if err != nil {
+			return models.InitResponseParams{
+				Status:        models.InitStatusError,
+				StatusMessage: err.Error(),
+			}, nil
+		}
+		actuator, err := NewLightActuator(properties, conbeeClient, switchLightParams.LightId)
+		if err == nil {
+			err = SwitchVerified(actuator, false)
+		}
+		if err == nil && isLoad {
+			log.Info().Msgf("Manual override of load %s: %s", load.Name, override)
+			err = stateStore.SetOverride(load.Name, override)
+		}
 		if err != nil {
 			return models.InitResponseParams{
 				Status:        models.InitStatusError,
@@ -487,21 +595,231 @@ func main() {
 		}, nil
 	})
 
+	wsServer.AddHandler("getSchedules", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getSchedules")
+		return getSchedules(properties, time.Now()), nil
+	})
+
+	wsServer.AddHandler("setSchedule", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: setSchedule")
+		scheduleParams := &models.SetScheduleParams{}
+		err := jrws.CreateParamsObject(request.Params, scheduleParams)
+		if err != nil {
+			return nil, err
+		}
+		updatedProperties, err := setSchedule(properties, *scheduleParams)
+		if err != nil {
+			return nil, err
+		}
+		fieldErrors := updatedProperties.Validate()
+		if len(fieldErrors) > 0 {
+			return models.InitResponseParams{
+				Status:        models.InitStatusConfig,
+				StatusMessage: "Invalid schedule: " + fieldErrors.Error(),
+				FieldErrors:   fieldErrors,
+			}, nil
+		}
+		err = saveProperties(updatedProperties)
+		if err != nil {
+			return nil, err
+		}
+		previous := *properties
+		*properties = *updatedProperties
+		applyPropertiesChange(previous, *properties, wsServer)
+		return models.InitResponseParams{
+			Status:        models.InitStatusOk,
+			StatusMessage: "Schedule of " + scheduleParams.Load + " saved",
+		}, nil
+	})
+
+	wsServer.AddHandler("getShadowMode", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getShadowMode")
+		return getShadowMode(properties, monitoring), nil
+	})
+
+	wsServer.AddHandler("setShadowMode", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: setShadowMode")
+		shadowParams := &models.SetShadowModeParams{}
+		err := jrws.CreateParamsObject(request.Params, shadowParams)
+		if err != nil {
+			return nil, err
+		}
+		updatedProperties, err := setShadowMode(properties, *shadowParams)
+		if err != nil {
+			return nil, err
+		}
+		err = saveProperties(updatedProperties)
+		if err != nil {
+			return nil, err
+		}
+		previous := *properties
+		*properties = *updatedProperties
+		applyPropertiesChange(previous, *properties, wsServer)
+		return getShadowMode(properties, monitoring), nil
+	})
+
+	wsServer.AddHandler("getTargets", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getTargets")
+		return targetPlans(*properties, stateStore, time.Now()), nil
+	})
+
+	wsServer.AddHandler("setOverride", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: setOverride")
+		overrideParams := &models.SetOverrideParams{}
+		err := jrws.CreateParamsObject(request.Params, overrideParams)
+		if err != nil {
+			return nil, err
+		}
+		load, ok := properties.FindLoad(overrideParams.Load)
+		if !ok {
+			return nil, fmt.Errorf("unknown load %s", overrideParams.Load)
+		}
+		override, err := NewLoadOverride(overrideParams.Mode, overrideParams.Duration, overrideParams.Until, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if override != nil {
+			actuator, err := NewActuator(load, conbeeClient)
+			if err == nil {
+				err = SwitchVerified(actuator, override.Mode == OverrideModeOn)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not switch load %s: %v", load.Name, err)
+			}
+			log.Info().Msgf("Manual override of load %s: %s", load.Name, override)
+		} else {
+			log.Info().Msgf("Load %s is back in automatic mode", load.Name)
+		}
+		err = stateStore.SetOverride(load.Name, override)
+		if err != nil {
+			return nil, err
+		}
+		if monitoring != nil {
+			monitoring.RequestDataAndSendWsNotification(*properties)
+		}
+		return override, nil
+	})
+
+	wsServer.AddHandler("getDecisions", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getDecisions")
+		decisionsParams := &models.GetDecisionsParams{}
+		if request.Params != nil {
+			err := jrws.CreateParamsObject(request.Params, decisionsParams)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return queryDecisions(decisionLog, historyStore, *decisionsParams, time.Now())
+	})
+
+	wsServer.AddHandler("getForecast", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: getForecast")
+		forecastParams := &models.GetForecastParams{}
+		if request.Params != nil {
+			err := jrws.CreateParamsObject(request.Params, forecastParams)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var forecaster *Forecaster
+		if monitoring != nil {
+			forecaster = monitoring.Forecaster()
+		}
+		return getForecast(*properties, forecaster, historyStore, forecastCachePath(), *forecastParams, time.Now())
+	})
+
+	wsServer.AddHandler("evaluateRule", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: evaluateRule")
+		ruleParams := &models.EvaluateRuleParams{}
+		err := jrws.CreateParamsObject(request.Params, ruleParams)
+		if err != nil {
+			return nil, err
+		}
+		var inverterData *InverterData
+		if inverter != nil && inverter.IsConnected() {
+			data, err := inverter.GetInverterData()
+			if err != nil {
+				log.Warn().Err(err).Msg("Evaluating the rule without inverter data")
+			} else {
+				inverterData = &data
+			}
+		}
+		var sensors map[string]models.Sensor
+		if conbeeClient != nil {
+			var restErrResp *models.RestErrorResponse
+			sensors, restErrResp, err = conbeeClient.GetSensors()
+			if err != nil || restErrResp != nil {
+				log.Warn().Err(err).Interface("response", restErrResp).Msg("Evaluating the rule without sensors")
+			}
+		}
+		return evaluateRule(*ruleParams, inverterData, sensors, time.Now().In(properties.Location()))
+	})
+
+	wsServer.AddHandler("exportConfig", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: exportConfig")
+		exportParams := &models.ExportConfigParams{}
+		if request.Params != nil {
+			err := jrws.CreateParamsObject(request.Params, exportParams)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if exportParams.IncludeHistory {
+			return exportConfig(properties, exportParams.Password, stateStore, historyStore)
+		}
+		return exportConfig(properties, exportParams.Password, nil, nil)
+	})
+
+	wsServer.AddHandler("importConfig", func(request models2.Request, ws *jrws.ConcurrentWebsocket) (interface{}, error) {
+		log.Info().Msg("Handler: importConfig")
+		importParams := &models.ImportConfigParams{}
+		err := jrws.CreateParamsObject(request.Params, importParams)
+		if err != nil {
+			return nil, err
+		}
+		imported, result, err := importConfig(properties, &importParams.Bundle, importParams.Password, importParams.DryRun, stateStore, historyStore)
+		if err != nil {
+			return nil, err
+		}
+		if result.Applied {
+			log.Info().Msgf("Imported %d changes", len(result.Changes))
+			previous := *properties
+			*properties = *imported
+			applyPropertiesChange(previous, *properties, wsServer)
+		}
+		return result, nil
+	})
+
+	lockHandlers(wsServer)
+
+	configWatcher, err := WatchConfigFile(configPath, func() {
+		reloadProperties(wsServer)
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not watch config file, changes need a restart")
+	} else {
+		defer configWatcher.Close()
+	}
+
 	log.Info().Msg("Starting websocket server..")
 	wsServer.StartListening()
 }
 
 func IfStatusOk_InitAndStartMonitoring(startupStatus models.InitResponseParams, wsServer *jrws.WebsocketServer) {
-	if startupStatus.Status == models.InitStatusOk {
+	if startupStatus.IsOperational() {
 		if monitoring == nil {
-			monitoring = NewMonitoringController(conbeeClient, inverter, wsServer)
+			monitoring = NewMonitoringController(conbeeClient, inverter, stateStore, historyStore, decisionLog, wsServer)
 		}
+		monitoring.SetClients(conbeeClient, inverter)
 		_, err := monitoring.RequestDataAndSendWsNotification(*properties)
 		if err != nil {
 			log.Error().Stack().Err(err).Msg("Error requesting data and sending ws notification")
 			return
 		}
-		monitoring.StartMonitoring(*properties)
+		err = monitoring.StartMonitoring(*properties)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not start monitoring")
+		}
 	}
 }
 
@@ -557,22 +875,36 @@ func CheckSystemStatus(properties *models.Properties, conbeeClient *ConbeeClient
 		}
 	}
 
-	if properties.PlugName == "" {
+	if len(properties.SwitchedLoads()) == 0 {
 		return models.InitResponseParams{
 			Status:        models.InitStatusConfig,
 			StatusMessage: "No socket name configured",
 		}
 	}
-	if properties.PollDuration == 0 {
+
+	fieldErrors := properties.Validate()
+	fieldErrors = append(fieldErrors, validateLoadsOnGateway(properties, conbeeClient)...)
+	if len(fieldErrors) > 0 {
+		log.Info().Err(fieldErrors).Msg("Invalid configuration")
 		return models.InitResponseParams{
 			Status:        models.InitStatusConfig,
-			StatusMessage: "No poll duration configured",
+			StatusMessage: "Invalid configuration: " + fieldErrors.Error(),
+			FieldErrors:   fieldErrors,
+		}
+	}
+
+	var unreachable []string
+	for _, load := range properties.SwitchedLoads() {
+		actuator, err := NewActuator(load, conbeeClient)
+		if err != nil || !IsActuatorReachable(actuator) {
+			unreachable = append(unreachable, load.Name)
 		}
 	}
-	if properties.Threshold == 10000 {
+	if len(unreachable) > 0 {
+		log.Warn().Strs("loads", unreachable).Msg("Actuator unreachable")
 		return models.InitResponseParams{
-			Status:        models.InitStatusConfig,
-			StatusMessage: "No threshold configured",
+			Status:        models.InitStatusActuatorUnreachable,
+			StatusMessage: "Actuator unreachable: " + strings.Join(unreachable, ", "),
 		}
 	}
 
@@ -581,3 +913,78 @@ func CheckSystemStatus(properties *models.Properties, conbeeClient *ConbeeClient
 		StatusMessage: "Everything is fine",
 	}
 }
+
+// validateLoadsOnGateway checks that the plugs of the deconz loads exist on the gateway.
+func validateLoadsOnGateway(properties *models.Properties, conbeeClient *ConbeeClient) models.ValidationErrors {
+	if conbeeClient == nil {
+		return nil
+	}
+	var errs models.ValidationErrors
+	for _, load := range properties.SwitchedLoads() {
+		if load.BackendOrDefault() != models.ActuatorBackendDeconz {
+			continue
+		}
+		if load.Group != "" {
+			groupId, _, err := conbeeClient.GetGroupByName(load.Group)
+			if err != nil {
+				errs = append(errs, models.FieldError{Field: models.SectionLoadPrefix + load.Name + ".group", Message: err.Error()})
+				continue
+			}
+			if load.Scene != "" {
+				if _, err := conbeeClient.GetSceneIdByName(groupId, load.Scene); err != nil {
+					errs = append(errs, models.FieldError{Field: models.SectionLoadPrefix + load.Name + ".scene", Message: err.Error()})
+				}
+			}
+			continue
+		}
+		_, _, err := conbeeClient.FindLight(load.Light, load.UniqueID)
+		if err != nil {
+			field := models.SectionLoadPrefix + load.Name + ".light"
+			switch {
+			case load.Name == models.DefaultLoadName && load.UniqueID != "":
+				field = "plugUniqueId"
+			case load.Name == models.DefaultLoadName:
+				field = "plugName"
+			case load.UniqueID != "":
+				field = models.SectionLoadPrefix + load.Name + ".uniqueId"
+			}
+			errs = append(errs, models.FieldError{Field: field, Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// resolveLightUniqueIds sets the uniqueid of the plug of plugName and of the
+// deconz loads configured by the name of their light only, so they are still
+// found after they are renamed. Lights that are not found or whose name is not
+// unique are left as they are. It returns whether a uniqueid was set.
+func resolveLightUniqueIds(properties *models.Properties, conbeeClient *ConbeeClient) (bool, error) {
+	lights, m, err := conbeeClient.GetLights()
+	if err != nil {
+		return false, err
+	}
+	if m != nil {
+		return false, fmt.Errorf("unexpected status code: %d", m.Code)
+	}
+	resolve := func(name string, uniqueID *string) bool {
+		if name == "" || *uniqueID != "" {
+			return false
+		}
+		_, light, err := findLight(lights, name, "")
+		if err != nil || light.UniqueID == "" {
+			log.Warn().Err(err).Msgf("Could not resolve the uniqueid of light %s", name)
+			return false
+		}
+		log.Info().Msgf("Light %s has the uniqueid %s", name, light.UniqueID)
+		*uniqueID = light.UniqueID
+		return true
+	}
+	changed := resolve(properties.PlugName, &properties.PlugUniqueId)
+	for i := range properties.Loads {
+		load := &properties.Loads[i]
+		if load.BackendOrDefault() == models.ActuatorBackendDeconz && load.Group == "" {
+			changed = resolve(load.Light, &load.UniqueID) || changed
+		}
+	}
+	return changed, nil
+}
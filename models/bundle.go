@@ -0,0 +1,289 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundleVersion is the version of the layout of ConfigBundle. The layout of the
+// config inside the bundle has its own schema version.
+const BundleVersion = 1
+
+const (
+	BundleEncryptionScryptAesGcm = "scrypt-aes-256-gcm"
+	// Prefix of encrypted values in the config of a bundle
+	encryptedValuePrefix = "enc:"
+	// Shown instead of secrets when changes are listed
+	maskedSecret = "********"
+
+	// Limits of the scrypt parameters of imported bundles, larger values
+	// would let a bundle exhaust memory and CPU. scrypt needs 128*N*r bytes.
+	maxScryptN      = 1 << 20
+	maxScryptR      = 16
+	maxScryptP      = 4
+	maxScryptMemory = 256 << 20
+)
+
+// secretKeys are the property keys that are encrypted when a bundle is
+// exported with a password. The passwords of the loads are secret as well.
+var secretKeys = map[string]bool{
+	"apiKey":         true,
+	"deconzPassword": true,
+	"kostalPassword": true,
+	"forecastApiKey": true,
+}
+
+// IsSecretKey reports whether the value of the flat key, as returned by
+// Sections.Flatten, is a password or an API key.
+func IsSecretKey(key string) bool {
+	index := strings.LastIndex(key, ".")
+	if index < 0 {
+		return secretKeys[key]
+	}
+	return isSecretValue(key[:index], key[index+1:])
+}
+
+func isSecretValue(section string, key string) bool {
+	if strings.HasPrefix(section, SectionLoadPrefix) {
+		return key == "password"
+	}
+	return secretKeys[key] && SectionOf(key) == section
+}
+
+// ConfigBundle is everything needed to move the app to another machine.
+type ConfigBundle struct {
+	BundleVersion int       `json:"bundleVersion"`
+	AppVersion    string    `json:"appVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	SchemaVersion int       `json:"schemaVersion"`
+	// The config file including the loads and notification targets
+	Config     Sections          `json:"config"`
+	Encryption *BundleEncryption `json:"encryption,omitempty"`
+	// The learned state and the history, only if requested by the export
+	Data *BundleData `json:"data,omitempty"`
+}
+
+// BundleData is the runtime data of the app. It is left out of bundles by
+// default, a month of history can be hundreds of MB.
+type BundleData struct {
+	// Content of the state file
+	State json.RawMessage `json:"state,omitempty"`
+	// Content of the history files by day, YYYY-MM-DD
+	History map[string]string `json:"history,omitempty"`
+}
+
+// BundleEncryption describes how the secrets of a bundle are encrypted. The
+// key is derived from the password with scrypt.
+type BundleEncryption struct {
+	Algorithm string `json:"algorithm"`
+	Salt      string `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// ConfigChange is a value that is changed by an import. Secrets are masked.
+type ConfigChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+	// The value is set by an environment variable, the import does not change it
+	EnvOverride bool `json:"envOverride,omitempty"`
+}
+
+// NewConfigBundle creates a bundle of the properties. If password is not
+// empty, the secrets are encrypted with it.
+func NewConfigBundle(p *Properties, appVersion string, password string) (*ConfigBundle, error) {
+	bundle := &ConfigBundle{
+		BundleVersion: BundleVersion,
+		AppVersion:    appVersion,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: CurrentSchemaVersion,
+		Config:        p.ToSections(),
+	}
+	if password == "" {
+		return bundle, nil
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Encryption = &BundleEncryption{
+		Algorithm: BundleEncryptionScryptAesGcm,
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		N:         32768,
+		R:         8,
+		P:         1,
+	}
+	aead, err := bundle.Encryption.cipher(password)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range bundle.Config.secretValues() {
+		section, key, value := secret[0], secret[1], secret[2]
+		if value == "" {
+			continue
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		// The name is authenticated, so encrypted values cannot be swapped
+		sealed := aead.Seal(nonce, nonce, []byte(value), []byte(flatName(section, key)))
+		bundle.Config.Set(section, key, encryptedValuePrefix+base64.StdEncoding.EncodeToString(sealed))
+	}
+	return bundle, nil
+}
+
+// secretValues returns section, key and value of all secrets.
+func (s Sections) secretValues() [][3]string {
+	var secrets [][3]string
+	for section, values := range s {
+		for key, value := range values {
+			if isSecretValue(section, key) {
+				secrets = append(secrets, [3]string{section, key, value})
+			}
+		}
+	}
+	return secrets
+}
+
+func (e *BundleEncryption) cipher(password string) (cipher.AEAD, error) {
+	if e.Algorithm != BundleEncryptionScryptAesGcm {
+		return nil, fmt.Errorf("unsupported encryption %q", e.Algorithm)
+	}
+	if e.N < 2 || e.N > maxScryptN || e.N&(e.N-1) != 0 {
+		return nil, fmt.Errorf("invalid scrypt parameter n %d, must be a power of two up to %d", e.N, maxScryptN)
+	}
+	if e.R < 1 || e.R > maxScryptR {
+		return nil, fmt.Errorf("invalid scrypt parameter r %d, must be between 1 and %d", e.R, maxScryptR)
+	}
+	if e.P < 1 || e.P > maxScryptP {
+		return nil, fmt.Errorf("invalid scrypt parameter p %d, must be between 1 and %d", e.P, maxScryptP)
+	}
+	if 128*e.N*e.R > maxScryptMemory {
+		return nil, fmt.Errorf("the scrypt parameters n %d and r %d need more than %d MiB", e.N, e.R, maxScryptMemory>>20)
+	}
+	salt, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	key, err := scrypt.Key([]byte(password), salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sections returns the config of the bundle with decrypted secrets, migrated
+// to the current schema version.
+func (b *ConfigBundle) Sections(password string) (Sections, error) {
+	if b.BundleVersion < 1 || b.BundleVersion > BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.BundleVersion)
+	}
+	if b.Config == nil {
+		return nil, errors.New("bundle contains no config")
+	}
+	sections := b.Config.Copy()
+	if b.Encryption != nil {
+		if password == "" {
+			return nil, errors.New("the bundle is encrypted, a password is required")
+		}
+		aead, err := b.Encryption.cipher(password)
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range sections.secretValues() {
+			section, key, value := secret[0], secret[1], secret[2]
+			if !strings.HasPrefix(value, encryptedValuePrefix) {
+				continue
+			}
+			sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+			if err != nil || len(sealed) < aead.NonceSize() {
+				return nil, fmt.Errorf("invalid encrypted value of %s", flatName(section, key))
+			}
+			plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(flatName(section, key)))
+			if err != nil {
+				return nil, errors.New("wrong password")
+			}
+			sections.Set(section, key, string(plain))
+		}
+	}
+
+	// Bundles of older versions carry their schema version in the bundle
+	if _, ok := sections.Get("", SchemaVersionKey); !ok && b.SchemaVersion > 0 {
+		sections.Set("", SchemaVersionKey, fmt.Sprint(b.SchemaVersion))
+	}
+	migrated, _, err := Migrate(sections)
+	if err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// Check returns an error if the state is not valid JSON or a history day is
+// not a date, so nothing is written outside the history directory.
+func (d *BundleData) Check() error {
+	if len(d.State) > 0 && !json.Valid(d.State) {
+		return errors.New("the state of the bundle is not valid JSON")
+	}
+	for day := range d.History {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("invalid history day %q in the bundle", day)
+		}
+	}
+	return nil
+}
+
+// DiffSections lists the values that differ between current and imported,
+// sorted by their flat name. Secrets are masked.
+func DiffSections(current Sections, imported Sections) []ConfigChange {
+	currentValues := current.Flatten()
+	importedValues := imported.Flatten()
+	var changes []ConfigChange
+	for key, newValue := range importedValues {
+		oldValue, ok := currentValues[key]
+		if ok && oldValue == newValue {
+			continue
+		}
+		changes = append(changes, ConfigChange{Key: key, Old: oldValue, New: newValue})
+	}
+	for key, oldValue := range currentValues {
+		if _, ok := importedValues[key]; !ok {
+			changes = append(changes, ConfigChange{Key: key, Old: oldValue})
+		}
+	}
+	for i := range changes {
+		if IsSecretKey(changes[i].Key) {
+			changes[i].Old = maskSecret(changes[i].Old)
+			changes[i].New = maskSecret(changes[i].New)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return maskedSecret
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestConfigBundleEncryption(t *testing.T) {
+	properties := &Properties{
+		HostAddress:    "192.168.1.20:80",
+		ApiKey:         "0123456789",
+		KostalPassword: "secret",
+		PlugName:       "Heating rod",
+		PollDuration:   10,
+		Loads:          []Load{{Name: "boiler", Light: "Boiler plug"}},
+	}
+	bundle, err := NewConfigBundle(properties, "1.0.0", "passphrase")
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: Secrets are not stored in plain text
+	if strings.Contains(string(data), "0123456789") || strings.Contains(string(data), "secret") {
+		t.Errorf("Test case 1: Expected encrypted secrets but got %s", data)
+	}
+
+	// Test case 2: Decryption with the right password
+	decoded := &ConfigBundle{}
+	err = json.Unmarshal(data, decoded)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	sections, err := decoded.Sections("passphrase")
+	if err != nil {
+		t.Fatalf("Test case 2: Expected nil error but got %v", err)
+	}
+	if value, _ := sections.Get(SectionGateway, "apiKey"); value != "0123456789" {
+		t.Errorf("Test case 2: Expected 0123456789 but got %s", value)
+	}
+	if value, _ := sections.Get(SectionLoadPrefix+"boiler", "light"); value != "Boiler plug" {
+		t.Errorf("Test case 2: Expected Boiler plug but got %s", value)
+	}
+
+	// Test case 3: Wrong or missing password
+	_, err = decoded.Sections("wrong")
+	if err == nil {
+		t.Error("Test case 3: Expected an error for a wrong password")
+	}
+	_, err = decoded.Sections("")
+	if err == nil {
+		t.Error("Test case 3: Expected an error for a missing password")
+	}
+
+	// Test case 4: Scrypt parameters beyond the limits are rejected before deriving the key
+	for _, encryption := range []BundleEncryption{{N: 1 << 30, R: 8, P: 1}, {N: 30000, R: 8, P: 1},
+		{N: 32768, R: 64, P: 1}, {N: 32768, R: 8, P: 16}, {N: 1 << 20, R: 16, P: 1}} {
+		invalid := *decoded
+		encryption.Algorithm = BundleEncryptionScryptAesGcm
+		encryption.Salt = decoded.Encryption.Salt
+		invalid.Encryption = &encryption
+		if _, err := invalid.Sections("passphrase"); err == nil || !strings.Contains(err.Error(), "scrypt") {
+			t.Errorf("Test case 4: Expected an error for n %d, r %d, p %d but got %v", encryption.N, encryption.R, encryption.P, err)
+		}
+	}
+}
+
+func TestDiffSections(t *testing.T) {
+	current := Sections{
+		SectionGateway:    {"apiKey": "old"},
+		SectionController: {"plugName": "Heating rod", "pollDuration": "10"},
+	}
+	imported := Sections{
+		SectionGateway:             {"apiKey": "new"},
+		SectionController:          {"plugName": "Heating rod", "pollDuration": "30"},
+		SectionLoadPrefix + "pump": {"light": "Pump plug"},
+	}
+	changes := DiffSections(current, imported)
+	expected := []ConfigChange{
+		{Key: "apiKey", Old: maskedSecret, New: maskedSecret},
+		{Key: "load.pump.light", New: "Pump plug"},
+		{Key: "pollDuration", Old: "10", New: "30"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Test case %d: Expected %v but got %v", i+1, expected[i], changes[i])
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"fmt"
+	"github.com/db-tech/SolarKostalConbee2Controller/ini"
+	"github.com/db-tech/SolarKostalConbee2Controller/safefile"
+	"github.com/db-tech/SolarKostalConbee2Controller/yaml"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsYamlFile reports whether the config file at path is written in YAML
+// instead of INI, which is decided by the extension.
+func IsYamlFile(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+func ParseSections(path string, data []byte) (Sections, error) {
+	if IsYamlFile(path) {
+		return yaml.ParseSections(data)
+	}
+	return ini.ParseSections(data)
+}
+
+func FormatSections(path string, sections Sections) ([]byte, error) {
+	if IsYamlFile(path) {
+		return yaml.FormatSections(sections)
+	}
+	return ini.FormatSections(sections)
+}
+
+// Number of previous versions of the config file that are kept as
+// config.ini.1 to config.ini.<ConfigBackups>
+const ConfigBackups = 5
+
+// LoadSectionsFromFile reads an INI or YAML config file without migrating it.
+func LoadSectionsFromFile(path string) (Sections, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := ParseSections(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sections, nil
+}
+
+// LoadSectionsWithFallback reads the config file at path. If it cannot be
+// parsed, or it is empty although backups exist, the newest backup that can
+// be parsed is used instead. It returns the path that has been read.
+func LoadSectionsWithFallback(path string) (Sections, string, error) {
+	sections, err := LoadSectionsFromFile(path)
+	if err == nil && len(sections.Flatten()) > 0 {
+		return sections, path, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, path, err
+	}
+
+	for _, backupPath := range safefile.Backups(path, ConfigBackups) {
+		backupSections, backupErr := LoadSectionsFromFile(backupPath)
+		if backupErr == nil && len(backupSections.Flatten()) > 0 {
+			return backupSections, backupPath, nil
+		}
+	}
+	// No usable backup, an empty file is a new installation
+	return sections, path, err
+}
+
+// SaveSectionsToFile atomically replaces the config file and keeps the
+// previous version as backup.
+func SaveSectionsToFile(path string, sections Sections) error {
+	data, err := FormatSections(path, sections)
+	if err != nil {
+		return err
+	}
+	return safefile.WriteFile(path, data, 0600, ConfigBackups)
+}
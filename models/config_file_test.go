@@ -0,0 +1,54 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSectionsWithFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	good := Sections{SectionController: {"plugName": "Heating rod"}}
+	err := SaveSectionsToFile(path, good)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	err = SaveSectionsToFile(path, Sections{SectionController: {"plugName": "Boiler"}})
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: Readable file
+	sections, readPath, err := LoadSectionsWithFallback(path)
+	if err != nil || readPath != path {
+		t.Errorf("Test case 1: Expected %s but got %s, %v", path, readPath, err)
+	}
+	if value, _ := sections.Get(SectionController, "plugName"); value != "Boiler" {
+		t.Errorf("Test case 1: Expected Boiler but got %s", value)
+	}
+
+	// Test case 2: Truncated file
+	os.WriteFile(path, nil, 0600)
+	sections, readPath, err = LoadSectionsWithFallback(path)
+	if err != nil || readPath != path+".1" {
+		t.Errorf("Test case 2: Expected %s.1 but got %s, %v", path, readPath, err)
+	}
+	if value, _ := sections.Get(SectionController, "plugName"); value != "Heating rod" {
+		t.Errorf("Test case 2: Expected Heating rod but got %s", value)
+	}
+
+	// Test case 3: Unparsable file
+	os.WriteFile(path, []byte("[controller\nplugName"), 0600)
+	_, readPath, err = LoadSectionsWithFallback(path)
+	if err != nil || readPath != path+".1" {
+		t.Errorf("Test case 3: Expected %s.1 but got %s, %v", path, readPath, err)
+	}
+
+	// Test case 4: Empty file without backups is a new installation
+	emptyPath := filepath.Join(t.TempDir(), "config.ini")
+	os.WriteFile(emptyPath, nil, 0600)
+	_, readPath, err = LoadSectionsWithFallback(emptyPath)
+	if err != nil || readPath != emptyPath {
+		t.Errorf("Test case 4: Expected %s but got %s, %v", emptyPath, readPath, err)
+	}
+}
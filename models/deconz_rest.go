@@ -1,5 +1,9 @@
 package models
 
+import (
+	"strings"
+)
+
 type Device struct {
 	ID                string `json:"id"`
 	InternalIPAddress string `json:"internalipaddress"`
@@ -44,3 +48,81 @@ type Light struct {
 }
 
 type LightsResponse map[string]Light
+
+const (
+	SensorTypePower       = "ZHAPower"
+	SensorTypeConsumption = "ZHAConsumption"
+)
+
+type SensorState struct {
+	// Power in W, only reported by ZHAPower and some ZHAConsumption sensors
+	Power *float64 `json:"power,omitempty"`
+	// Energy consumed in Wh, reported by ZHAConsumption sensors
+	Consumption *float64 `json:"consumption,omitempty"`
+	// Temperature in 0.01 °C and relative humidity in 0.01 %
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	// Air pressure in hPa
+	Pressure *float64 `json:"pressure,omitempty"`
+	Lux      *float64 `json:"lux,omitempty"`
+	Presence *bool    `json:"presence,omitempty"`
+	// Whether a door or window is open
+	Open        *bool  `json:"open,omitempty"`
+	LastUpdated string `json:"lastupdated"`
+}
+
+type SensorConfig struct {
+	On        bool `json:"on"`
+	Reachable bool `json:"reachable"`
+}
+
+type Sensor struct {
+	Config           SensorConfig `json:"config"`
+	Etag             string       `json:"etag"`
+	Manufacturername string       `json:"manufacturername"`
+	ModelID          string       `json:"modelid"`
+	Name             string       `json:"name"`
+	State            SensorState  `json:"state"`
+	SWVersion        string       `json:"swversion"`
+	Type             string       `json:"type"`
+	UniqueID         string       `json:"uniqueid"`
+}
+
+// DeviceAddress returns the MAC address part of a uniqueid, e.g.
+// 00:0d:6f:ff:fe:01:02:03 of 00:0d:6f:ff:fe:01:02:03-01-0b04. Lights and
+// sensors of the same device share it.
+func DeviceAddress(uniqueID string) string {
+	if index := strings.Index(uniqueID, "-"); index >= 0 {
+		return uniqueID[:index]
+	}
+	return uniqueID
+}
+
+type GroupState struct {
+	AllOn bool `json:"all_on"`
+	AnyOn bool `json:"any_on"`
+}
+
+type SceneRef struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	LightCount int    `json:"lightcount"`
+}
+
+type Group struct {
+	Action  State      `json:"action"`
+	Etag    string     `json:"etag"`
+	ID      string     `json:"id"`
+	Lights  []string   `json:"lights"`
+	Name    string     `json:"name"`
+	Scenes  []SceneRef `json:"scenes"`
+	State   GroupState `json:"state"`
+	Type    string     `json:"type"`
+	Devices []string   `json:"devicemembership"`
+}
+
+type Scene struct {
+	Lights         []string `json:"lights"`
+	Name           string   `json:"name"`
+	TransitionTime int      `json:"transitiontime"`
+}
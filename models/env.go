@@ -0,0 +1,36 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix is prepended to the environment variable of every property.
+const EnvPrefix = "SKC_"
+
+// EnvName returns the environment variable that overrides the property with
+// the given config key, e.g. SKC_KOSTAL_ADDRESS for kostalAddress.
+func EnvName(key string) string {
+	var name strings.Builder
+	name.WriteString(EnvPrefix)
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// EnvOverrides returns the config values that are set by environment
+// variables. lookup is usually os.LookupEnv.
+func EnvOverrides(lookup func(string) (string, bool)) map[string]string {
+	overrides := map[string]string{}
+	for key := range (&Properties{}).ToMap() {
+		if value, ok := lookup(EnvName(key)); ok {
+			overrides[key] = value
+		}
+	}
+	return overrides
+}
@@ -0,0 +1,33 @@
+package models
+
+import "testing"
+
+func TestEnvName(t *testing.T) {
+	testCases := map[string]string{
+		"kostalAddress":       "SKC_KOSTAL_ADDRESS",
+		"Threshold":           "SKC_THRESHOLD",
+		"apiKey":              "SKC_API_KEY",
+		"simKWp":              "SKC_SIM_KWP",
+		"simTimeAcceleration": "SKC_SIM_TIME_ACCELERATION",
+	}
+	for key, expected := range testCases {
+		if name := EnvName(key); name != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, key, name)
+		}
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"SKC_KOSTAL_ADDRESS": "192.168.1.10",
+		"SKC_POLL_DURATION":  "30",
+		"SKC_UNKNOWN":        "ignored",
+	}
+	overrides := EnvOverrides(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if len(overrides) != 2 || overrides["kostalAddress"] != "192.168.1.10" || overrides["pollDuration"] != "30" {
+		t.Errorf("Unexpected overrides %v", overrides)
+	}
+}
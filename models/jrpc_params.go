@@ -7,11 +7,21 @@ const (
 	InitStatusError
 	InitStatusKostalAuth
 	InitStatusLogin
+	// The system works, but the actuator of at least one load cannot be
+	// reached and its load is paused
+	InitStatusActuatorUnreachable
 )
 
 type InitResponseParams struct {
 	Status        int
 	StatusMessage string
+	FieldErrors   []FieldError `json:",omitempty"`
+}
+
+// IsOperational reports whether the loads can be monitored and switched,
+// possibly with some loads paused.
+func (p InitResponseParams) IsOperational() bool {
+	return p.Status == InitStatusOk || p.Status == InitStatusActuatorUnreachable
 }
 
 type RestErrorResponse struct {
@@ -33,8 +43,121 @@ type SavePropertiesParams struct {
 
 type SwitchLightParams struct {
 	LightId string `json:"lightId"`
+	// How long the load of the light stays switched, e.g. 2h, or until when,
+	// e.g. 06:00. Two hours if neither is set.
+	Duration string `json:"duration,omitempty"`
+	Until    string `json:"until,omitempty"`
+}
+
+// SetScheduleParams replaces the schedule of a load, empty values remove the
+// restriction.
+type SetScheduleParams struct {
+	Load   string `json:"load"`
+	Allow  string `json:"allow"`
+	Forbid string `json:"forbid"`
+	Season string `json:"season"`
+}
+
+// LoadSchedule is the schedule of a load and whether it allows the load to run
+// right now.
+type LoadSchedule struct {
+	Load    string `json:"load"`
+	Allow   string `json:"allow"`
+	Forbid  string `json:"forbid"`
+	Season  string `json:"season"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type SchedulesResult struct {
+	// Timezone the schedules refer to
+	Timezone string         `json:"timezone"`
+	Now      string         `json:"now"`
+	Loads    []LoadSchedule `json:"loads"`
+}
+
+// SetOverrideParams forces a load on or off or switches it back to automatic
+// mode with the mode "auto".
+type SetOverrideParams struct {
+	Load     string `json:"load"`
+	Mode     string `json:"mode"`
+	Duration string `json:"duration,omitempty"`
+	Until    string `json:"until,omitempty"`
+}
+
+// EvaluateRuleParams evaluates a rule without switching anything. Values
+// replace the current values of the variables, Time is a RFC 3339 time that
+// replaces the current time.
+type EvaluateRuleParams struct {
+	Rule   string             `json:"rule"`
+	Values map[string]float64 `json:"values,omitempty"`
+	Time   string             `json:"time,omitempty"`
+}
+
+// EvaluateRuleResult is the outcome of a rule, or why it is invalid.
+type EvaluateRuleResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	RuleResult
+	Explanation string `json:"explanation,omitempty"`
+	// Values the rule was evaluated with
+	Values RuleValues `json:"values"`
+	Time   string     `json:"time"`
+}
+
+// SetShadowModeParams enables or disables the shadow mode of a load, of all
+// loads without a load.
+type SetShadowModeParams struct {
+	Load    string `json:"load,omitempty"`
+	Enabled bool   `json:"enabled"`
+}
+
+// GetForecastParams selects the forecast curve: Hours from now, 24 if 0, in
+// steps of StepMinutes, 15 if 0.
+type GetForecastParams struct {
+	Hours       int `json:"hours,omitempty"`
+	StepMinutes int `json:"stepMinutes,omitempty"`
+}
+
+type GroupParams struct {
+	GroupId string `json:"groupId"`
 }
 
 type MonitoringEnabledParams struct {
 	Enabled bool `json:"enabled"`
 }
+
+type ExportConfigParams struct {
+	// Encrypts the secrets of the bundle if not empty
+	Password string `json:"password"`
+	// Adds the learned state and the history to the bundle
+	IncludeHistory bool `json:"includeHistory"`
+}
+
+type ImportConfigParams struct {
+	Bundle   ConfigBundle `json:"bundle"`
+	Password string       `json:"password"`
+	// Only report the changes without applying them
+	DryRun bool `json:"dryRun"`
+}
+
+type ImportConfigResult struct {
+	Applied     bool           `json:"applied"`
+	Changes     []ConfigChange `json:"changes"`
+	FieldErrors []FieldError   `json:"fieldErrors,omitempty"`
+	// The bundle contains the state and days of history, they are restored
+	// unless it is a dry run
+	State       bool `json:"state,omitempty"`
+	HistoryDays int  `json:"historyDays,omitempty"`
+}
+
+// GetDecisionsParams selects decision records. Without From the recent records
+// kept in memory are returned, otherwise the history from From until To, both
+// RFC 3339 times, To requires From. Load restricts the records to a load,
+// Limit returns the last records only.
+type GetDecisionsParams struct {
+	Load  string `json:"load,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
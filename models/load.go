@@ -0,0 +1,321 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	ActuatorBackendDeconz = "deconz"
+	// Shelly devices of the first generation, e.g. Shelly Plug S
+	ActuatorBackendShelly = "shelly"
+	// Shelly devices of the second generation with the RPC API, e.g. Shelly Plus Plug S
+	ActuatorBackendShellyGen2 = "shelly2"
+	ActuatorBackendTasmota    = "tasmota"
+)
+
+const (
+	// The load is switched on and off, the default
+	LoadModeSwitch = "switch"
+	// The brightness of a dimmable light is set in proportion to the surplus,
+	// e.g. for a heating element behind a power regulator
+	LoadModeProportional = "proportional"
+)
+
+// Brightness levels of deconz lights
+const (
+	MinBrightness = 1
+	MaxBrightness = 255
+)
+
+// Defaults of the proportional mode
+const (
+	DefaultMaxStep   = 50
+	DefaultSmoothing = 0.5
+)
+
+// DefaultLoadName is the name of the load that is switched by the plug
+// configured with plugName.
+const DefaultLoadName = "plug"
+
+// Load is a device that is switched depending on the surplus.
+type Load struct {
+	Name string
+	// Actuator backend that switches the load, deconz if empty
+	Backend string
+	// Name of the deconz light or plug
+	Light string
+	// deconz uniqueid of the light, e.g. 00:0d:6f:ff:fe:01:02:03-01. It is
+	// resolved to the id of the light at runtime and takes precedence over
+	// Light, which may be renamed or used twice.
+	UniqueID string
+	// Name of a deconz group whose lights are switched together, instead of Light
+	Group string
+	// Name of a scene of Group that is recalled to switch the load on
+	Scene string
+	// Address of Shelly and Tasmota devices, e.g. 192.168.1.40
+	Address string
+	// Relay of devices with several relays, starting at 0
+	Channel int
+	// Credentials of Shelly Gen1 and Tasmota devices, if enabled
+	Username string
+	Password string
+
+	// LoadModeSwitch or LoadModeProportional, switch if empty
+	Mode string
+	// Lowest and highest brightness level used in proportional mode, below
+	// MinLevel the load is switched off. 0 uses MinBrightness and MaxBrightness.
+	MinLevel int
+	MaxLevel int
+	// Largest change of the level per poll, DefaultMaxStep if 0
+	MaxStep int
+	// Weight of the new target level between 0 and 1, 1 follows the surplus
+	// without smoothing, DefaultSmoothing if 0
+	Smoothing float64
+	// Power drawn at MaxBrightness in W, Threshold if 0
+	MaxPower float64
+
+	// Schedule of the load, see Schedule: allowed and forbidden time windows
+	// like "Mon-Fri 08:00-20:00" and date ranges like "05-01..09-30"
+	Allow  string
+	Forbid string
+	Season string
+
+	// Daily targets: the load runs at least MinRuntime or until it has drawn
+	// MinEnergy in Wh per day, from the grid if the surplus does not suffice
+	// before Deadline, a time of day like 20:00, the end of the day if empty
+	MinRuntime time.Duration
+	MinEnergy  float64
+	Deadline   string
+
+	// Rules that replace the surplus logic, see ParseRule: a load that is off
+	// is switched on when OnRule holds, a load that is on is switched off when
+	// OffRule holds. Without a rule the surplus logic applies.
+	OnRule  string
+	OffRule string
+
+	// The decisions on the load are only recorded, it is not switched
+	Shadow bool
+}
+
+// LevelRange returns the lowest and the highest brightness level of a
+// proportional load.
+func (l Load) LevelRange() (int, int) {
+	minLevel, maxLevel := l.MinLevel, l.MaxLevel
+	if minLevel == 0 {
+		minLevel = MinBrightness
+	}
+	if maxLevel == 0 {
+		maxLevel = MaxBrightness
+	}
+	return minLevel, maxLevel
+}
+
+func (l Load) MaxStepOrDefault() int {
+	if l.MaxStep == 0 {
+		return DefaultMaxStep
+	}
+	return l.MaxStep
+}
+
+func (l Load) SmoothingOrDefault() float64 {
+	if l.Smoothing == 0 {
+		return DefaultSmoothing
+	}
+	return l.Smoothing
+}
+
+// HasTarget reports whether the load has a daily runtime or energy target.
+func (l Load) HasTarget() bool {
+	return l.MinRuntime > 0 || l.MinEnergy > 0
+}
+
+// DeadlineOn returns the time the daily target has to be reached on the day of
+// t, in the location of t.
+func (l Load) DeadlineOn(t time.Time) time.Time {
+	minutes := 24 * 60
+	if l.Deadline != "" {
+		if clock, err := ParseClock(l.Deadline); err == nil {
+			minutes = clock
+		}
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, t.Location())
+}
+
+// IsProportional reports whether the load is dimmed in proportion to the
+// surplus.
+func (l Load) IsProportional() bool {
+	return l.Mode == LoadModeProportional
+}
+
+// BackendOrDefault returns the actuator backend of the load.
+func (l Load) BackendOrDefault() string {
+	if l.Backend == "" {
+		return ActuatorBackendDeconz
+	}
+	return l.Backend
+}
+
+// IsHttpRelay reports whether the load is switched by a Shelly or Tasmota
+// device instead of the deconz gateway.
+func (l Load) IsHttpRelay() bool {
+	switch l.BackendOrDefault() {
+	case ActuatorBackendShelly, ActuatorBackendShellyGen2, ActuatorBackendTasmota:
+		return true
+	}
+	return false
+}
+
+func loadFromSection(name string, values map[string]string) (Load, error) {
+	load := Load{
+		Name:     name,
+		Backend:  values["backend"],
+		Light:    values["light"],
+		UniqueID: values["uniqueId"],
+		Group:    values["group"],
+		Scene:    values["scene"],
+		Address:  values["address"],
+		Username: values["username"],
+		Password: values["password"],
+		Mode:     values["mode"],
+		Allow:    values["allow"],
+		Forbid:   values["forbid"],
+		Season:   values["season"],
+		Deadline: values["deadline"],
+		OnRule:   values["onRule"],
+		OffRule:  values["offRule"],
+	}
+	if value := values["minRuntime"]; value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return load, ValidationErrors{{Field: SectionLoadPrefix + name + ".minRuntime", Message: "must be a duration like 4h30m"}}
+		}
+		load.MinRuntime = duration
+	}
+	if value := values["shadow"]; value != "" {
+		shadow, err := strconv.ParseBool(value)
+		if err != nil {
+			return load, ValidationErrors{{Field: SectionLoadPrefix + name + ".shadow", Message: "must be true or false"}}
+		}
+		load.Shadow = shadow
+	}
+	intValues := map[string]*int{
+		"channel":  &load.Channel,
+		"minLevel": &load.MinLevel,
+		"maxLevel": &load.MaxLevel,
+		"maxStep":  &load.MaxStep,
+	}
+	for key, target := range intValues {
+		if value, ok := values[key]; ok && value != "" {
+			integer, err := strconv.Atoi(value)
+			if err != nil {
+				return load, ValidationErrors{{Field: SectionLoadPrefix + name + "." + key, Message: "must be a whole number"}}
+			}
+			*target = integer
+		}
+	}
+	floatValues := map[string]*float64{
+		"smoothing": &load.Smoothing,
+		"maxPower":  &load.MaxPower,
+		"minEnergy": &load.MinEnergy,
+	}
+	for key, target := range floatValues {
+		if value, ok := values[key]; ok && value != "" {
+			float, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return load, ValidationErrors{{Field: SectionLoadPrefix + name + "." + key, Message: "must be a number"}}
+			}
+			*target = float
+		}
+	}
+	return load, nil
+}
+
+// toSection returns the values of the load section, empty optional values are
+// left out.
+func (l Load) toSection() map[string]string {
+	values := map[string]string{}
+	if l.Backend != "" {
+		values["backend"] = l.Backend
+	}
+	if l.IsHttpRelay() {
+		values["address"] = l.Address
+		if l.Channel != 0 {
+			values["channel"] = strconv.Itoa(l.Channel)
+		}
+		if l.Username != "" {
+			values["username"] = l.Username
+		}
+		if l.Password != "" {
+			values["password"] = l.Password
+		}
+	} else if l.Group != "" {
+		values["group"] = l.Group
+		if l.Scene != "" {
+			values["scene"] = l.Scene
+		}
+	} else {
+		if l.Light != "" || l.UniqueID == "" {
+			values["light"] = l.Light
+		}
+		if l.UniqueID != "" {
+			values["uniqueId"] = l.UniqueID
+		}
+	}
+	if l.Mode != "" {
+		values["mode"] = l.Mode
+	}
+	for key, value := range map[string]int{"minLevel": l.MinLevel, "maxLevel": l.MaxLevel, "maxStep": l.MaxStep} {
+		if value != 0 {
+			values[key] = strconv.Itoa(value)
+		}
+	}
+	for key, value := range map[string]float64{"smoothing": l.Smoothing, "maxPower": l.MaxPower, "minEnergy": l.MinEnergy} {
+		if value != 0 {
+			values[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	for key, value := range map[string]string{"allow": l.Allow, "forbid": l.Forbid, "season": l.Season, "deadline": l.Deadline,
+		"onRule": l.OnRule, "offRule": l.OffRule} {
+		if value != "" {
+			values[key] = value
+		}
+	}
+	if l.MinRuntime != 0 {
+		values["minRuntime"] = l.MinRuntime.String()
+	}
+	if l.Shadow {
+		values["shadow"] = "true"
+	}
+	return values
+}
+
+// SwitchedLoads returns the loads the monitoring switches: the configured loads
+// and the plug of plugName, unless it is configured as a load as well.
+func (p *Properties) SwitchedLoads() []Load {
+	loads := make([]Load, 0, len(p.Loads)+1)
+	if p.PlugName != "" {
+		configured := false
+		for _, load := range p.Loads {
+			if load.BackendOrDefault() == ActuatorBackendDeconz && load.Group == "" &&
+				(load.Light == p.PlugName || (p.PlugUniqueId != "" && load.UniqueID == p.PlugUniqueId)) {
+				configured = true
+			}
+		}
+		if !configured {
+			loads = append(loads, Load{Name: DefaultLoadName, Backend: ActuatorBackendDeconz, Light: p.PlugName,
+				UniqueID: p.PlugUniqueId})
+		}
+	}
+	return append(loads, p.Loads...)
+}
+
+// FindLoad returns the switched load with the name.
+func (p *Properties) FindLoad(name string) (Load, bool) {
+	for _, load := range p.SwitchedLoads() {
+		if load.Name == name {
+			return load, true
+		}
+	}
+	return Load{}, false
+}
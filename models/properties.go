@@ -2,28 +2,103 @@ package models
 
 import (
 	"fmt"
-	"github.com/db-tech/SolarKostalConbee2Controller/ini"
 	"github.com/rs/zerolog/log"
 	"strconv"
+	"time"
+)
+
+// Filters of the inverter readings
+const (
+	FilterNone = "none"
+	// Moving average over FilterWindow samples
+	FilterAverage = "average"
+	// Exponential moving average with the weight FilterAlpha
+	FilterEMA = "ema"
+	// Median of FilterWindow samples
+	FilterMedian = "median"
+)
+
+// Defaults of the filter of the inverter readings
+const (
+	DefaultFilterWindow = 5
+	DefaultFilterAlpha  = 0.3
+)
+
+// Minutes between fetches of the external forecast, the free plan of
+// forecast.solar allows 12 requests per hour
+const DefaultForecastRefresh = 60
+
+const (
+	InverterTypeKostal    = "kostal"
+	InverterTypeSimulator = "simulator"
+	InverterTypeReplay    = "replay"
 )
 
 type Properties struct {
-	HostAddress    string
-	ApiKey         string
-	Threshold      float64
-	PollDuration   int
+	HostAddress  string
+	ApiKey       string
+	Threshold    float64
+	PollDuration int
+	// IANA timezone the schedules of the loads refer to, e.g. Europe/Berlin.
+	// The timezone of the system if empty.
+	Timezone string
+	// Decisions are only recorded, no load is switched
+	ShadowMode bool
+	// Smoothing of the inverter readings: FilterNone if empty, FilterAverage,
+	// FilterEMA or FilterMedian. FilterWindow is the number of samples,
+	// DefaultFilterWindow if 0, FilterAlpha the weight of a new sample for the
+	// EMA, DefaultFilterAlpha if 0.
+	Filter       string
+	FilterWindow int
+	FilterAlpha  float64
+	// Readings that differ from the median of the window by more than this in
+	// W are rejected as spikes, unless they persist. 0 disables it.
+	SpikeThreshold float64
 	PlugName       string
+	// deconz uniqueid of the plug of PlugName, it identifies the plug even
+	// after it is renamed
+	PlugUniqueId   string
 	DeconzUsername string
 	DeconzPassword string
 	KostalUsername string
 	KostalPassword string
 	KostalAddress  string
 	KostalType     string
+
+	// Settings of the simulator inverter (KostalType "simulator")
+	SimLatitude         float64
+	SimKWp              float64
+	SimCloudiness       float64
+	SimBaseLoad         float64
+	SimTimeAcceleration float64
+	SimDate             string
+
+	// Recording played back by the replay inverter (KostalType "replay")
+	ReplayFile string
+
+	// PV system of the local forecast, disabled while ForecastKWp is 0.
+	// Latitude and longitude in degrees, tilt in degrees from flat and
+	// azimuth in degrees clockwise from north, 180 is south.
+	ForecastLatitude  float64
+	ForecastLongitude float64
+	ForecastTilt      float64
+	ForecastAzimuth   float64
+	ForecastKWp       float64
+	// forecast.solar compatible service the hourly forecast of the PV system
+	// is fetched from, e.g. https://api.forecast.solar, disabled if empty.
+	// ForecastApiKey is only needed for the paid plans, ForecastRefresh is
+	// the time between fetches in minutes, DefaultForecastRefresh if 0.
+	ForecastURL     string
+	ForecastApiKey  string
+	ForecastRefresh int
+
+	Loads         []Load
+	Notifications []NotificationTarget
 }
 
 func (p *Properties) SaveToFile(s string) error {
 	log.Info().Msg("Save properties to file")
-	err := ini.SavePropertiesToFile(s, p.ToMap())
+	err := SaveSectionsToFile(s, p.ToSections())
 	if err != nil {
 		return err
 	}
@@ -36,20 +111,33 @@ func FromMapWithDefaults(m map[string]string) (*Properties, error) {
 		ApiKey:         "",
 		Threshold:      100000.0,
 		PollDuration:   10,
+		Timezone:       "",
 		PlugName:       "",
+		PlugUniqueId:   "",
 		DeconzUsername: "",
 		DeconzPassword: "",
 		KostalUsername: "",
 		KostalPassword: "",
 		KostalAddress:  "",
 		KostalType:     "",
+
+		SimLatitude:         51.0,
+		SimKWp:              8.0,
+		SimCloudiness:       0.3,
+		SimBaseLoad:         300,
+		SimTimeAcceleration: 1,
+		SimDate:             "",
+
+		ReplayFile: "",
+
+		ForecastTilt:    30,
+		ForecastAzimuth: 180,
 	}
 
 	if threshold, ok := m["Threshold"]; ok {
 		float, err := strconv.ParseFloat(threshold, 64)
 		if err != nil {
-			fmt.Println(err)
-			return nil, err
+			return nil, ValidationErrors{{Field: "Threshold", Message: "must be a number"}}
 		}
 		properties.Threshold = float
 	}
@@ -74,6 +162,34 @@ func FromMapWithDefaults(m map[string]string) (*Properties, error) {
 		properties.PlugName = plugName
 	}
 
+	if timezone, ok := m["timezone"]; ok {
+		properties.Timezone = timezone
+	}
+
+	if shadowMode, ok := m["shadowMode"]; ok && shadowMode != "" {
+		enabled, err := strconv.ParseBool(shadowMode)
+		if err != nil {
+			return nil, ValidationErrors{{Field: "shadowMode", Message: "must be true or false"}}
+		}
+		properties.ShadowMode = enabled
+	}
+
+	if filter, ok := m["filter"]; ok {
+		properties.Filter = filter
+	}
+
+	if filterWindow, ok := m["filterWindow"]; ok && filterWindow != "" {
+		window, err := strconv.Atoi(filterWindow)
+		if err != nil {
+			return nil, ValidationErrors{{Field: "filterWindow", Message: "must be a whole number"}}
+		}
+		properties.FilterWindow = window
+	}
+
+	if plugUniqueId, ok := m["plugUniqueId"]; ok {
+		properties.PlugUniqueId = plugUniqueId
+	}
+
 	if kostalUsername, ok := m["kostalUsername"]; ok {
 		properties.KostalUsername = kostalUsername
 	}
@@ -93,14 +209,85 @@ func FromMapWithDefaults(m map[string]string) (*Properties, error) {
 	if pollDuration, ok := m["pollDuration"]; ok {
 		pullDurationInt, err := strconv.Atoi(pollDuration)
 		if err != nil {
-			fmt.Println(err)
-			return nil, err
+			return nil, ValidationErrors{{Field: "pollDuration", Message: "must be a whole number"}}
 		}
 		properties.PollDuration = pullDurationInt
 	}
+
+	floatProperties := map[string]*float64{
+		"filterAlpha":         &properties.FilterAlpha,
+		"spikeThreshold":      &properties.SpikeThreshold,
+		"simLatitude":         &properties.SimLatitude,
+		"simKWp":              &properties.SimKWp,
+		"simCloudiness":       &properties.SimCloudiness,
+		"simBaseLoad":         &properties.SimBaseLoad,
+		"simTimeAcceleration": &properties.SimTimeAcceleration,
+		"forecastLatitude":    &properties.ForecastLatitude,
+		"forecastLongitude":   &properties.ForecastLongitude,
+		"forecastTilt":        &properties.ForecastTilt,
+		"forecastAzimuth":     &properties.ForecastAzimuth,
+		"forecastKWp":         &properties.ForecastKWp,
+	}
+	for key, target := range floatProperties {
+		if value, ok := m[key]; ok {
+			float, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, ValidationErrors{{Field: key, Message: "must be a number"}}
+			}
+			*target = float
+		}
+	}
+
+	if forecastURL, ok := m["forecastUrl"]; ok {
+		properties.ForecastURL = forecastURL
+	}
+
+	if forecastApiKey, ok := m["forecastApiKey"]; ok {
+		properties.ForecastApiKey = forecastApiKey
+	}
+
+	if forecastRefresh, ok := m["forecastRefresh"]; ok && forecastRefresh != "" {
+		refresh, err := strconv.Atoi(forecastRefresh)
+		if err != nil {
+			return nil, ValidationErrors{{Field: "forecastRefresh", Message: "must be a whole number"}}
+		}
+		properties.ForecastRefresh = refresh
+	}
+
+	if simDate, ok := m["simDate"]; ok {
+		properties.SimDate = simDate
+	}
+
+	if replayFile, ok := m["replayFile"]; ok {
+		properties.ReplayFile = replayFile
+	}
 	return properties, nil
 }
 
+// FilterWindowOrDefault returns the number of samples the filter works on.
+func (p *Properties) FilterWindowOrDefault() int {
+	if p.FilterWindow == 0 {
+		return DefaultFilterWindow
+	}
+	return p.FilterWindow
+}
+
+func (p *Properties) FilterAlphaOrDefault() float64 {
+	if p.FilterAlpha == 0 {
+		return DefaultFilterAlpha
+	}
+	return p.FilterAlpha
+}
+
+// ForecastRefreshOrDefault returns the time between fetches of the external
+// forecast.
+func (p *Properties) ForecastRefreshOrDefault() time.Duration {
+	if p.ForecastRefresh == 0 {
+		return DefaultForecastRefresh * time.Minute
+	}
+	return time.Duration(p.ForecastRefresh) * time.Minute
+}
+
 func (p *Properties) ToMap() map[string]string {
 	return map[string]string{
 		"hostAddress":    p.HostAddress,
@@ -109,10 +296,35 @@ func (p *Properties) ToMap() map[string]string {
 		"deconzPassword": p.DeconzPassword,
 		"Threshold":      fmt.Sprintf("%f", p.Threshold),
 		"plugName":       p.PlugName,
+		"plugUniqueId":   p.PlugUniqueId,
 		"pollDuration":   fmt.Sprintf("%d", p.PollDuration),
+		"timezone":       p.Timezone,
+		"shadowMode":     strconv.FormatBool(p.ShadowMode),
+		"filter":         p.Filter,
+		"filterWindow":   fmt.Sprintf("%d", p.FilterWindow),
+		"filterAlpha":    fmt.Sprintf("%f", p.FilterAlpha),
+		"spikeThreshold": fmt.Sprintf("%f", p.SpikeThreshold),
 		"kostalUsername": p.KostalUsername,
 		"kostalPassword": p.KostalPassword,
 		"kostalAddress":  p.KostalAddress,
 		"kostalType":     p.KostalType,
+
+		"simLatitude":         fmt.Sprintf("%f", p.SimLatitude),
+		"simKWp":              fmt.Sprintf("%f", p.SimKWp),
+		"simCloudiness":       fmt.Sprintf("%f", p.SimCloudiness),
+		"simBaseLoad":         fmt.Sprintf("%f", p.SimBaseLoad),
+		"simTimeAcceleration": fmt.Sprintf("%f", p.SimTimeAcceleration),
+		"simDate":             p.SimDate,
+
+		"replayFile": p.ReplayFile,
+
+		"forecastLatitude":  fmt.Sprintf("%f", p.ForecastLatitude),
+		"forecastLongitude": fmt.Sprintf("%f", p.ForecastLongitude),
+		"forecastTilt":      fmt.Sprintf("%f", p.ForecastTilt),
+		"forecastAzimuth":   fmt.Sprintf("%f", p.ForecastAzimuth),
+		"forecastKWp":       fmt.Sprintf("%f", p.ForecastKWp),
+		"forecastUrl":       p.ForecastURL,
+		"forecastApiKey":    p.ForecastApiKey,
+		"forecastRefresh":   fmt.Sprintf("%d", p.ForecastRefresh),
 	}
 }
@@ -0,0 +1,455 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleVariables are the values a rule can compare, with their description.
+var RuleVariables = map[string]string{
+	"surplus":     "power fed into the grid in W, negative while power is taken from it",
+	"pv":          "power generated by the PV system in W",
+	"consumption": "power consumed by the house in W",
+	"soc":         "state of charge of the battery in %, unknown without battery",
+	"power":       "power drawn by the load in W",
+	"forecast":    "mean PV power expected in the next hour in W, unknown without forecast",
+}
+
+// sensorRulePrefix starts the variables of deCONZ sensors, see
+// SensorRuleFields.
+const sensorRulePrefix = "sensor."
+
+// SensorRuleFields are the values of deCONZ sensors a rule can compare as
+// sensor.<name>.<field>, with the spaces in the name of the sensor written as
+// _, e.g. sensor.living_room.temperature.
+var SensorRuleFields = map[string]string{
+	"temperature": "temperature in °C",
+	"humidity":    "relative humidity in %",
+	"pressure":    "air pressure in hPa",
+	"lux":         "illuminance in lux",
+	"power":       "power in W",
+	"consumption": "energy consumed in Wh",
+	"presence":    "1 while presence is detected, 0 otherwise",
+	"open":        "1 while the door or window is open, 0 otherwise",
+}
+
+// SensorRuleVariable returns the variable of the field of the sensor with the
+// name.
+func SensorRuleVariable(name, field string) string {
+	return sensorRulePrefix + strings.ToLower(strings.ReplaceAll(name, " ", "_")) + "." + field
+}
+
+// IsRuleVariable reports whether a rule can compare the variable, one of
+// RuleVariables or a field of a sensor.
+func IsRuleVariable(variable string) bool {
+	if _, ok := RuleVariables[variable]; ok {
+		return true
+	}
+	if !strings.HasPrefix(variable, sensorRulePrefix) {
+		return false
+	}
+	index := strings.LastIndex(variable, ".")
+	_, ok := SensorRuleFields[variable[index+1:]]
+	return ok && index > len(sensorRulePrefix)
+}
+
+// SensorRuleValues returns the values of the sensors as rule variables.
+// Sensors of the same device share the name, each contributes its fields.
+func SensorRuleValues(sensors map[string]Sensor) RuleValues {
+	values := RuleValues{}
+	set := func(name, field string, value *float64, scale float64) {
+		if value != nil {
+			values[SensorRuleVariable(name, field)] = *value * scale
+		}
+	}
+	flag := func(name, field string, value *bool) {
+		if value != nil {
+			values[SensorRuleVariable(name, field)] = 0
+			if *value {
+				values[SensorRuleVariable(name, field)] = 1
+			}
+		}
+	}
+	for _, sensor := range sensors {
+		set(sensor.Name, "temperature", sensor.State.Temperature, 0.01)
+		set(sensor.Name, "humidity", sensor.State.Humidity, 0.01)
+		set(sensor.Name, "pressure", sensor.State.Pressure, 1)
+		set(sensor.Name, "lux", sensor.State.Lux, 1)
+		set(sensor.Name, "power", sensor.State.Power, 1)
+		set(sensor.Name, "consumption", sensor.State.Consumption, 1)
+		flag(sensor.Name, "presence", sensor.State.Presence)
+		flag(sensor.Name, "open", sensor.State.Open)
+	}
+	return values
+}
+
+// RuleValues are the current values of the rule variables. Variables that are
+// missing are unknown, conditions on them do not hold.
+type RuleValues map[string]float64
+
+var ruleOperators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// RuleCondition is a single comparison of a rule, e.g. "surplus > 1500 for 5m"
+// or "time between Mon-Fri 10:00-17:00".
+type RuleCondition struct {
+	// Text of the condition as written in the rule
+	Text     string
+	Variable string
+	Operator string
+	Value    float64
+	// The comparison has to hold this long, 0 if it only has to hold now
+	For time.Duration
+	// Time window of "time between" conditions, nil for comparisons
+	Window *TimeWindow
+}
+
+// Rule is a parsed rule expression: conditions combined with and, or, not and
+// parentheses, and binds stronger than or.
+type Rule struct {
+	Text       string
+	Conditions []*RuleCondition
+	root       ruleNode
+}
+
+type ruleNode interface {
+	evaluate(holds []bool) bool
+}
+
+type ruleAnd []ruleNode
+type ruleOr []ruleNode
+type ruleNot struct{ node ruleNode }
+
+// ruleConditionNode refers to a condition by its index in Rule.Conditions.
+type ruleConditionNode int
+
+func (n ruleAnd) evaluate(holds []bool) bool {
+	for _, node := range n {
+		if !node.evaluate(holds) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n ruleOr) evaluate(holds []bool) bool {
+	for _, node := range n {
+		if node.evaluate(holds) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n ruleNot) evaluate(holds []bool) bool {
+	return !n.node.evaluate(holds)
+}
+
+func (n ruleConditionNode) evaluate(holds []bool) bool {
+	return holds[n]
+}
+
+// ParseRule parses a rule like "surplus > 1500 for 5m and soc > 80 and time
+// between 10:00-17:00". See RuleVariables for the values that can be compared.
+func ParseRule(text string) (*Rule, error) {
+	parser := &ruleParser{tokens: tokenizeRule(text), rule: &Rule{Text: strings.TrimSpace(text)}}
+	if len(parser.tokens) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token != "" {
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+	parser.rule.root = root
+	return parser.rule, nil
+}
+
+// tokenizeRule splits a rule into words, parentheses and operators.
+func tokenizeRule(text string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case strings.IndexByte("<>=!", c) >= 0:
+			flush()
+			if i+1 < len(text) && text[i+1] == '=' {
+				tokens = append(tokens, text[i:i+2])
+				i++
+			} else {
+				tokens = append(tokens, string(c))
+			}
+		default:
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type ruleParser struct {
+	tokens []string
+	pos    int
+	rule   *Rule
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	nodes := ruleOr{}
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !strings.EqualFold(p.peek(), "or") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	nodes := ruleAnd{}
+	for {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !strings.EqualFold(p.peek(), "and") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *ruleParser) parseUnary() (ruleNode, error) {
+	switch token := p.peek(); {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of the rule")
+	case strings.EqualFold(token, "not"):
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return ruleNot{node}, nil
+	case token == "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	}
+	condition, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	p.rule.Conditions = append(p.rule.Conditions, condition)
+	return ruleConditionNode(len(p.rule.Conditions) - 1), nil
+}
+
+func (p *ruleParser) parseCondition() (*RuleCondition, error) {
+	start := p.pos
+	variable := strings.ToLower(p.next())
+	condition := &RuleCondition{Variable: variable}
+	if variable == "time" {
+		if !strings.EqualFold(p.next(), "between") {
+			return nil, fmt.Errorf("expected between after time, e.g. time between 10:00-17:00")
+		}
+		window := p.next()
+		if !strings.Contains(window, ":") {
+			// Weekdays before the time range
+			window += " " + p.next()
+		}
+		parsed, err := parseTimeWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		condition.Window = &parsed
+	} else {
+		if !IsRuleVariable(variable) {
+			return nil, fmt.Errorf("unknown variable %q, use %s", variable, strings.Join(ruleVariableNames(), ", "))
+		}
+		condition.Operator = p.next()
+		if _, ok := ruleOperators[condition.Operator]; !ok {
+			return nil, fmt.Errorf("expected a comparison like > after %s but got %q", variable, condition.Operator)
+		}
+		value := p.next()
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number after %s %s but got %q", variable, condition.Operator, value)
+		}
+		condition.Value = number
+		if strings.EqualFold(p.peek(), "for") {
+			p.next()
+			value := p.next()
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("expected a duration like 5m after for but got %q", value)
+			}
+			condition.For = duration
+		}
+	}
+	condition.Text = strings.Join(p.tokens[start:p.pos], " ")
+	return condition, nil
+}
+
+func ruleVariableNames() []string {
+	names := make([]string, 0, len(RuleVariables)+1)
+	for name := range RuleVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(names, sensorRulePrefix+"<name>.<field>", "time")
+}
+
+// UsesSensors reports whether the rule compares values of deCONZ sensors.
+func (r *Rule) UsesSensors() bool {
+	for _, condition := range r.Conditions {
+		if strings.HasPrefix(condition.Variable, sensorRulePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleConditionResult is the outcome of a single condition.
+type RuleConditionResult struct {
+	Condition string `json:"condition"`
+	// Current value of the variable, nil for time conditions and unknown values
+	Value *float64 `json:"value,omitempty"`
+	Holds bool     `json:"holds"`
+	// How long the comparison has held, for conditions with a duration
+	HeldFor string `json:"heldFor,omitempty"`
+}
+
+// RuleResult is the outcome of a rule and of its conditions.
+type RuleResult struct {
+	Matched    bool                  `json:"matched"`
+	Conditions []RuleConditionResult `json:"conditions"`
+}
+
+// Evaluate evaluates the rule with the values at now. since holds the time
+// each condition with a duration started to hold, by its index, and is
+// updated. With a nil since, e.g. for a dry run, durations are not checked.
+func (r *Rule) Evaluate(values RuleValues, now time.Time, since map[int]time.Time) RuleResult {
+	holds := make([]bool, len(r.Conditions))
+	result := RuleResult{Conditions: make([]RuleConditionResult, len(r.Conditions))}
+	for i, condition := range r.Conditions {
+		conditionResult := RuleConditionResult{Condition: condition.Text}
+		if condition.Window != nil {
+			conditionResult.Holds = condition.Window.Contains(now)
+		} else if value, ok := values[condition.Variable]; ok {
+			conditionResult.Value = &value
+			conditionResult.Holds = ruleOperators[condition.Operator](value, condition.Value)
+		}
+		if condition.For > 0 && since != nil {
+			if !conditionResult.Holds {
+				delete(since, i)
+			} else {
+				start, ok := since[i]
+				if !ok {
+					start = now
+					since[i] = start
+				}
+				held := now.Sub(start)
+				conditionResult.HeldFor = held.Truncate(time.Second).String()
+				conditionResult.Holds = held >= condition.For
+			}
+		}
+		holds[i] = conditionResult.Holds
+		result.Conditions[i] = conditionResult
+	}
+	result.Matched = r.root.evaluate(holds)
+	return result
+}
+
+// String explains the outcome of the conditions for the decision logs, e.g.
+// "surplus > 1500 for 5m: 1800 for 2m0s, no; soc > 80: 85, yes".
+func (r RuleResult) String() string {
+	parts := make([]string, 0, len(r.Conditions))
+	for _, condition := range r.Conditions {
+		part := condition.Condition + ": "
+		if condition.Value != nil {
+			part += strconv.FormatFloat(math.Round(*condition.Value*10)/10, 'f', -1, 64)
+			if condition.HeldFor != "" {
+				part += " for " + condition.HeldFor
+			}
+			part += ", "
+		} else if !strings.HasPrefix(condition.Condition, "time ") {
+			part += "unknown, "
+		}
+		if condition.Holds {
+			part += "yes"
+		} else {
+			part += "no"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Rules parses the rules of the load, nil if the load has none.
+func (l Load) Rules() (onRule *Rule, offRule *Rule, err error) {
+	if l.OnRule != "" {
+		if onRule, err = ParseRule(l.OnRule); err != nil {
+			return nil, nil, err
+		}
+	}
+	if l.OffRule != "" {
+		if offRule, err = ParseRule(l.OffRule); err != nil {
+			return nil, nil, err
+		}
+	}
+	return onRule, offRule, nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		// Test case 1: The example of the documentation
+		{"surplus > 1500 for 5m and soc > 80 and time between 10:00-17:00", true},
+		// Test case 2: Parentheses, not, or and weekdays
+		{"not (pv<500 or consumption >= 3000) and time between Mon-Fri 08:00-20:00", true},
+		// Test case 3: Unknown variable
+		{"temperature > 20", false},
+		// Test case 4: Missing number
+		{"surplus >", false},
+		// Test case 5: Invalid duration
+		{"surplus > 1500 for ever", false},
+		// Test case 6: Missing closing parenthesis
+		{"(surplus > 1500 or soc > 50", false},
+		// Test case 7: Empty rule
+		{" ", false},
+		// Test case 8: Unexpected trailing word
+		{"surplus > 1500 soc > 80", false},
+		// Test case 9: Sensor values
+		{"sensor.living_room.temperature < 20 and sensor.door.open == 0", true},
+		// Test case 10: Unknown field of a sensor
+		{"sensor.living_room.color > 1", false},
+		// Test case 11: Sensor without name
+		{"sensor.temperature > 20", false},
+	}
+	for i, test := range tests {
+		_, err := ParseRule(test.rule)
+		if (err == nil) != test.valid {
+			t.Errorf("Test case %d: Expected valid %v for %q but got %v", i+1, test.valid, test.rule, err)
+		}
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	rule, err := ParseRule("surplus > 1500 for 5m and (soc > 80 or time between 10:00-17:00)")
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	noon := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	evening := time.Date(2024, 5, 10, 18, 0, 0, 0, time.UTC)
+	since := map[int]time.Time{}
+
+	// Test case 1: The surplus has to hold for 5 minutes
+	result := rule.Evaluate(RuleValues{"surplus": 2000}, noon, since)
+	if result.Matched || result.Conditions[0].Holds {
+		t.Errorf("Test case 1: Expected the rule not to hold yet but got %s", result)
+	}
+
+	// Test case 2: After 5 minutes the rule holds
+	result = rule.Evaluate(RuleValues{"surplus": 2000}, noon.Add(5*time.Minute), since)
+	if !result.Matched {
+		t.Errorf("Test case 2: Expected the rule to hold but got %s", result)
+	}
+
+	// Test case 3: A drop resets the duration
+	rule.Evaluate(RuleValues{"surplus": 1000}, noon.Add(6*time.Minute), since)
+	result = rule.Evaluate(RuleValues{"surplus": 2000}, noon.Add(7*time.Minute), since)
+	if result.Matched {
+		t.Errorf("Test case 3: Expected the rule not to hold after the drop but got %s", result)
+	}
+
+	// Test case 4: An unknown soc does not hold outside of the time window
+	result = rule.Evaluate(RuleValues{"surplus": 2000}, evening, nil)
+	if result.Matched || result.Conditions[1].Value != nil {
+		t.Errorf("Test case 4: Expected the rule not to hold without soc but got %s", result)
+	}
+
+	// Test case 5: Without a history durations are not checked
+	result = rule.Evaluate(RuleValues{"surplus": 2000, "soc": 90}, evening, nil)
+	if !result.Matched {
+		t.Errorf("Test case 5: Expected the rule to hold but got %s", result)
+	}
+}
+
+func TestSensorRuleValues(t *testing.T) {
+	temperature, power, open := 2150.0, 42.0, true
+	sensors := map[string]Sensor{
+		"1": {Name: "Living room", State: SensorState{Temperature: &temperature}},
+		"2": {Name: "Plug", State: SensorState{Power: &power}},
+		"3": {Name: "Door", State: SensorState{Open: &open}},
+	}
+	values := SensorRuleValues(sensors)
+
+	// Test case 1: The values are converted to their units, spaces in the name become _
+	if values["sensor.living_room.temperature"] != 21.5 || values["sensor.plug.power"] != 42 {
+		t.Errorf("Test case 1: Expected 21.5 °C and 42 W but got %v", values)
+	}
+
+	// Test case 2: Flags are 1 or 0
+	if value, ok := values["sensor.door.open"]; !ok || value != 1 {
+		t.Errorf("Test case 2: Expected the door to be open but got %v", values)
+	}
+
+	// Test case 3: Only the values reported by the sensors are known
+	if len(values) != 3 {
+		t.Errorf("Test case 3: Expected 3 values but got %v", values)
+	}
+
+	// Test case 4: The rule uses the sensor values
+	rule, _ := ParseRule("sensor.living_room.temperature < 22 and sensor.door.open == 1")
+	if !rule.UsesSensors() || !rule.Evaluate(values, time.Time{}, nil).Matched {
+		t.Errorf("Test case 4: Expected the rule to hold on the sensor values but got %s", rule.Evaluate(values, time.Time{}, nil))
+	}
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Time zones have to work on systems without zoneinfo, like minimal images
+	_ "time/tzdata"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily time range on some weekdays. A window that ends
+// before it starts lasts over midnight, e.g. Fri 22:00-06:00 ends on Saturday.
+type TimeWindow struct {
+	Days [7]bool
+	// Minutes since midnight, End may be 24*60
+	Start int
+	End   int
+}
+
+// DateRange is a range of days of the year, e.g. 05-01..09-30. A range that
+// ends before it starts lasts over new year.
+type DateRange struct {
+	// Month*100 + day, e.g. 501 for May 1st
+	From int
+	To   int
+}
+
+// Schedule restricts the times a load may be switched on.
+type Schedule struct {
+	// The load may only run in these windows, at any time if empty
+	Allow []TimeWindow
+	// The load must not run in these windows, they take precedence
+	Forbid []TimeWindow
+	// The load may only run in these date ranges, all year if empty
+	Seasons []DateRange
+}
+
+// ParseTimeWindows parses windows separated by semicolons. A window is a time
+// range with optional weekdays, e.g. "Mon-Fri 08:00-20:00; Sat,Sun 10:00-18:00"
+// or "22:00-06:00" for every night.
+func ParseTimeWindows(value string) ([]TimeWindow, error) {
+	var windows []TimeWindow
+	for _, part := range splitList(value) {
+		window, err := parseTimeWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func splitList(value string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, ";") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func parseTimeWindow(value string) (TimeWindow, error) {
+	var window TimeWindow
+	fields := strings.Fields(value)
+	var days, times string
+	switch len(fields) {
+	case 1:
+		days, times = "*", fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return window, fmt.Errorf("invalid time window %q, use e.g. Mon-Fri 08:00-20:00", value)
+	}
+
+	if days == "*" {
+		for i := range window.Days {
+			window.Days[i] = true
+		}
+	} else {
+		for _, day := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(day, "-")
+			first, ok := weekdayNames[strings.ToLower(from)]
+			if !ok {
+				return window, fmt.Errorf("invalid weekday %q in %q", from, value)
+			}
+			last := first
+			if isRange {
+				last, ok = weekdayNames[strings.ToLower(to)]
+				if !ok {
+					return window, fmt.Errorf("invalid weekday %q in %q", to, value)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				window.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return window, fmt.Errorf("invalid time range %q in %q", times, value)
+	}
+	var err error
+	if window.Start, err = ParseClock(start); err != nil || window.Start == 24*60 {
+		return window, fmt.Errorf("invalid start %q in %q", start, value)
+	}
+	if window.End, err = ParseClock(end); err != nil {
+		return window, fmt.Errorf("invalid end %q in %q", end, value)
+	}
+	if window.Start == window.End {
+		return window, fmt.Errorf("empty time range %q in %q", times, value)
+	}
+	return window, nil
+}
+
+// ParseClock parses a time of day like 06:30 into minutes since midnight,
+// 24:00 is the end of the day.
+func ParseClock(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || len(minutes) != 2 || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether the wall clock time of t is in the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	weekday := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[weekday] && minute >= w.Start && minute < w.End
+	}
+	previous := (weekday + 6) % 7
+	return (w.Days[weekday] && minute >= w.Start) || (w.Days[previous] && minute < w.End)
+}
+
+// ParseDateRanges parses date ranges separated by semicolons, e.g.
+// "05-01..09-30" or "11-01..02-28; 06-15..06-30".
+func ParseDateRanges(value string) ([]DateRange, error) {
+	var ranges []DateRange
+	for _, part := range splitList(value) {
+		from, to, ok := strings.Cut(part, "..")
+		if !ok {
+			return nil, fmt.Errorf("invalid date range %q, use e.g. 05-01..09-30", part)
+		}
+		var dateRange DateRange
+		var err error
+		if dateRange.From, err = parseMonthDay(from); err != nil {
+			return nil, err
+		}
+		if dateRange.To, err = parseMonthDay(to); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, dateRange)
+	}
+	return ranges, nil
+}
+
+func parseMonthDay(value string) (int, error) {
+	// A leap year, so 02-29 is accepted
+	date, err := time.Parse("2006-01-02", "2024-"+strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q, use MM-DD", value)
+	}
+	return int(date.Month())*100 + date.Day(), nil
+}
+
+// Contains reports whether the date of t is in the range.
+func (r DateRange) Contains(t time.Time) bool {
+	day := int(t.Month())*100 + t.Day()
+	if r.From <= r.To {
+		return day >= r.From && day <= r.To
+	}
+	return day >= r.From || day <= r.To
+}
+
+// Schedule parses the schedule of the load.
+func (l Load) Schedule() (Schedule, error) {
+	var schedule Schedule
+	var err error
+	if schedule.Allow, err = ParseTimeWindows(l.Allow); err != nil {
+		return schedule, err
+	}
+	if schedule.Forbid, err = ParseTimeWindows(l.Forbid); err != nil {
+		return schedule, err
+	}
+	schedule.Seasons, err = ParseDateRanges(l.Season)
+	return schedule, err
+}
+
+// HasSchedule reports whether the times of the load are restricted.
+func (l Load) HasSchedule() bool {
+	return l.Allow != "" || l.Forbid != "" || l.Season != ""
+}
+
+// Allows reports whether the load may run at t, which has to be in the
+// configured timezone. If not, the reason is returned as well. The windows
+// refer to the wall clock, so they follow daylight saving time.
+func (s Schedule) Allows(t time.Time) (bool, string) {
+	if len(s.Seasons) > 0 {
+		inSeason := false
+		for _, season := range s.Seasons {
+			inSeason = inSeason || season.Contains(t)
+		}
+		if !inSeason {
+			return false, "out of season"
+		}
+	}
+	for _, window := range s.Forbid {
+		if window.Contains(t) {
+			return false, "in a forbidden time window"
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true, ""
+	}
+	for _, window := range s.Allow {
+		if window.Contains(t) {
+			return true, ""
+		}
+	}
+	return false, "outside of the allowed time windows"
+}
+
+// Location returns the configured timezone, the local timezone of the system
+// if none is configured or it is unknown.
+func (p *Properties) Location() *time.Location {
+	if p.Timezone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return location
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleAllows(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("Invalid time %s", value)
+		}
+		return parsed.In(berlin)
+	}
+
+	tests := []struct {
+		load     Load
+		time     time.Time
+		expected bool
+	}{
+		// Test case 1: Inside the allowed window on a weekday
+		{Load{Allow: "Mon-Fri 08:00-20:00"}, at("2024-05-10T10:00:00+02:00"), true},
+		// Test case 2: Saturday is not allowed
+		{Load{Allow: "Mon-Fri 08:00-20:00"}, at("2024-05-11T10:00:00+02:00"), false},
+		// Test case 3: The end of the window is excluded
+		{Load{Allow: "Mon-Fri 08:00-20:00"}, at("2024-05-10T20:00:00+02:00"), false},
+		// Test case 4: A forbidden night window lasts over midnight
+		{Load{Forbid: "22:00-06:00"}, at("2024-05-11T03:00:00+02:00"), false},
+		// Test case 5: Outside of the forbidden night window
+		{Load{Forbid: "22:00-06:00"}, at("2024-05-11T12:00:00+02:00"), true},
+		// Test case 6: The night window of Friday ends on Saturday morning
+		{Load{Forbid: "Fri 22:00-06:00"}, at("2024-05-11T05:00:00+02:00"), false},
+		// Test case 7: Forbidden windows take precedence over allowed ones
+		{Load{Allow: "08:00-20:00", Forbid: "12:00-13:00"}, at("2024-05-10T12:30:00+02:00"), false},
+		// Test case 8: Out of season
+		{Load{Season: "05-01..09-30"}, at("2024-10-01T12:00:00+02:00"), false},
+		// Test case 9: A season over new year
+		{Load{Season: "11-01..02-28"}, at("2024-01-15T12:00:00+01:00"), true},
+		// Test case 10: On the day DST starts 08:30 CEST is 06:30 UTC
+		{Load{Allow: "08:00-20:00"}, at("2024-03-31T06:30:00Z"), true},
+		// Test case 11: On the day DST ends 07:30 CET is 06:30 UTC
+		{Load{Allow: "08:00-20:00"}, at("2024-10-27T06:30:00Z"), false},
+		// Test case 12: Several windows
+		{Load{Allow: "Mon-Fri 08:00-20:00; Sat,Sun 10:00-18:00"}, at("2024-05-12T17:00:00+02:00"), true},
+	}
+	for i, test := range tests {
+		schedule, err := test.load.Schedule()
+		if err != nil {
+			t.Errorf("Test case %d: Expected nil error but got %v", i+1, err)
+			continue
+		}
+		allowed, reason := schedule.Allows(test.time)
+		if allowed != test.expected {
+			t.Errorf("Test case %d: Expected %t at %s but got %t (%s)", i+1, test.expected, test.time, allowed, reason)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	invalid := []Load{
+		{Allow: "Mon-Fri"},
+		{Allow: "Funday 08:00-20:00"},
+		{Allow: "08:00-25:00"},
+		{Forbid: "10:00-10:00"},
+		{Season: "05-01-09-30"},
+		{Season: "02-30..03-01"},
+	}
+	for i, load := range invalid {
+		if _, err := load.Schedule(); err == nil {
+			t.Errorf("Test case %d: Expected an error for %+v", i+1, load)
+		}
+	}
+
+	windows, err := ParseTimeWindows("Sat-Mon 22:00-24:00")
+	if err != nil || len(windows) != 1 {
+		t.Fatalf("Expected one window but got %v, %v", windows, err)
+	}
+	expected := [7]bool{true, true, false, false, false, false, true}
+	if windows[0].Days != expected || windows[0].End != 24*60 {
+		t.Errorf("Expected Saturday to Monday until midnight but got %+v", windows[0])
+	}
+}
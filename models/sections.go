@@ -0,0 +1,289 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CurrentSchemaVersion is the version of the config file layout written by this
+// version of the app. Version 1 is the flat config.ini without sections.
+const CurrentSchemaVersion = 2
+
+const (
+	SchemaVersionKey = "schemaVersion"
+
+	SectionGateway    = "gateway"
+	SectionInverter   = "inverter"
+	SectionController = "controller"
+	SectionForecast   = "forecast"
+	// Prefix of the sections of the loads, e.g. [load.boiler]
+	SectionLoadPrefix = "load."
+	// Prefix of the sections of the notification targets, e.g. [notification.phone]
+	SectionNotificationPrefix = "notification."
+)
+
+// Sections is the content of a config file, section name to key to value.
+// Keys outside of any section are stored in the section "".
+type Sections map[string]map[string]string
+
+// propertySections maps each key of Properties.ToMap to its section.
+var propertySections = map[string]string{
+	"hostAddress":    SectionGateway,
+	"apiKey":         SectionGateway,
+	"deconzUsername": SectionGateway,
+	"deconzPassword": SectionGateway,
+
+	"kostalType":          SectionInverter,
+	"kostalAddress":       SectionInverter,
+	"kostalUsername":      SectionInverter,
+	"kostalPassword":      SectionInverter,
+	"simLatitude":         SectionInverter,
+	"simKWp":              SectionInverter,
+	"simCloudiness":       SectionInverter,
+	"simBaseLoad":         SectionInverter,
+	"simTimeAcceleration": SectionInverter,
+	"simDate":             SectionInverter,
+	"replayFile":          SectionInverter,
+
+	"Threshold":    SectionController,
+	"pollDuration": SectionController,
+	"plugName":     SectionController,
+	"plugUniqueId": SectionController,
+	"timezone":     SectionController,
+	"shadowMode":   SectionController,
+
+	"filter":         SectionController,
+	"filterWindow":   SectionController,
+	"filterAlpha":    SectionController,
+	"spikeThreshold": SectionController,
+
+	"forecastLatitude":  SectionForecast,
+	"forecastLongitude": SectionForecast,
+	"forecastTilt":      SectionForecast,
+	"forecastAzimuth":   SectionForecast,
+	"forecastKWp":       SectionForecast,
+	"forecastUrl":       SectionForecast,
+	"forecastApiKey":    SectionForecast,
+	"forecastRefresh":   SectionForecast,
+}
+
+// SectionOf returns the section of a property key.
+func SectionOf(key string) string {
+	return propertySections[key]
+}
+
+// NotificationTarget is a receiver of notifications, e.g. a webhook.
+type NotificationTarget struct {
+	Name string
+	Type string
+	URL  string
+}
+
+func (s Sections) Copy() Sections {
+	copied := make(Sections, len(s))
+	for name, values := range s {
+		copiedValues := make(map[string]string, len(values))
+		for key, value := range values {
+			copiedValues[key] = value
+		}
+		copied[name] = copiedValues
+	}
+	return copied
+}
+
+func (s Sections) Get(section string, key string) (string, bool) {
+	value, ok := s[section][key]
+	return value, ok
+}
+
+func (s Sections) Set(section string, key string, value string) {
+	if s[section] == nil {
+		s[section] = make(map[string]string)
+	}
+	s[section][key] = value
+}
+
+func (s Sections) Delete(section string, key string) {
+	delete(s[section], key)
+	if len(s[section]) == 0 {
+		delete(s, section)
+	}
+}
+
+// Flatten returns all values with their flat names. Properties keep their key,
+// e.g. hostAddress, other values are prefixed with their section, e.g.
+// load.boiler.light.
+func (s Sections) Flatten() map[string]string {
+	flat := make(map[string]string)
+	for name, values := range s {
+		for key, value := range values {
+			flat[flatName(name, key)] = value
+		}
+	}
+	delete(flat, SchemaVersionKey)
+	return flat
+}
+
+func flatName(section string, key string) string {
+	if propertySections[key] == section || section == "" {
+		return key
+	}
+	return section + "." + key
+}
+
+// SetFlat sets a value by its flat name as returned by Flatten.
+func (s Sections) SetFlat(name string, value string) {
+	if section, ok := propertySections[name]; ok {
+		s.Set(section, name, value)
+		return
+	}
+	index := strings.LastIndex(name, ".")
+	if index < 0 {
+		s.Set("", name, value)
+		return
+	}
+	s.Set(name[:index], name[index+1:], value)
+}
+
+// SchemaVersion returns the schema version of the config, files without a
+// version are version 1.
+func (s Sections) SchemaVersion() (int, error) {
+	value, ok := s.Get("", SchemaVersionKey)
+	if !ok {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", SchemaVersionKey, value)
+	}
+	return version, nil
+}
+
+// migrations[i] migrates a config from schema version i+1 to i+2.
+var migrations = []func(Sections) Sections{
+	migrateFlatToSections,
+}
+
+// Migrate upgrades the config to CurrentSchemaVersion. It returns the version
+// the config had before.
+func Migrate(s Sections) (Sections, int, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > CurrentSchemaVersion {
+		return nil, version, fmt.Errorf("config schema version %d is newer than the supported version %d, please update the app",
+			version, CurrentSchemaVersion)
+	}
+	migrated := s.Copy()
+	for v := version; v < CurrentSchemaVersion; v++ {
+		migrated = migrations[v-1](migrated)
+		migrated.Set("", SchemaVersionKey, strconv.Itoa(v+1))
+	}
+	return migrated, version, nil
+}
+
+// migrateFlatToSections moves the keys of the flat config.ini into their
+// sections. Unknown keys stay where they are.
+func migrateFlatToSections(s Sections) Sections {
+	migrated := Sections{}
+	for name, values := range s {
+		for key, value := range values {
+			section, known := propertySections[key]
+			if !known {
+				section = name
+			}
+			migrated.Set(section, key, value)
+		}
+	}
+	return migrated
+}
+
+// FromSectionsWithDefaults creates the properties from the sections of a
+// config file with the current schema version.
+func FromSectionsWithDefaults(s Sections) (*Properties, error) {
+	flat := make(map[string]string)
+	for key, section := range propertySections {
+		if value, ok := s.Get(section, key); ok {
+			flat[key] = value
+		}
+	}
+	properties, err := FromMapWithDefaults(flat)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range s.sectionNames(SectionLoadPrefix) {
+		load, err := loadFromSection(name, s[SectionLoadPrefix+name])
+		if err != nil {
+			return nil, err
+		}
+		properties.Loads = append(properties.Loads, load)
+	}
+	for _, name := range s.sectionNames(SectionNotificationPrefix) {
+		values := s[SectionNotificationPrefix+name]
+		properties.Notifications = append(properties.Notifications, NotificationTarget{
+			Name: name,
+			Type: values["type"],
+			URL:  values["url"],
+		})
+	}
+	return properties, nil
+}
+
+// sectionNames returns the sorted names of the sections with the prefix,
+// without the prefix.
+func (s Sections) sectionNames(prefix string) []string {
+	var names []string
+	for name := range s {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, strings.TrimPrefix(name, prefix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ToSections creates the sections of a config file with the current schema version.
+func (p *Properties) ToSections() Sections {
+	s := Sections{}
+	s.Set("", SchemaVersionKey, strconv.Itoa(CurrentSchemaVersion))
+	for key, value := range p.ToMap() {
+		s.Set(propertySections[key], key, value)
+	}
+	for _, load := range p.Loads {
+		for key, value := range load.toSection() {
+			s.Set(SectionLoadPrefix+load.Name, key, value)
+		}
+	}
+	for _, target := range p.Notifications {
+		s.Set(SectionNotificationPrefix+target.Name, "type", target.Type)
+		s.Set(SectionNotificationPrefix+target.Name, "url", target.URL)
+	}
+	return s
+}
+
+// MergeSections is a three way merge of config files. base is the file as it
+// was read, ours contains the changes of the app and theirs is the file as it
+// is now. Changes of the app win, other values of theirs are kept.
+func MergeSections(base Sections, ours Sections, theirs Sections) Sections {
+	merged := theirs.Copy()
+	for name, values := range ours {
+		for key, value := range values {
+			if baseValue, ok := base.Get(name, key); !ok || baseValue != value {
+				merged.Set(name, key, value)
+			}
+		}
+	}
+	// Loads and notification targets removed by the app are removed from the
+	// file, other values unknown to the app are kept
+	for name := range base {
+		isListSection := strings.HasPrefix(name, SectionLoadPrefix) || strings.HasPrefix(name, SectionNotificationPrefix)
+		if _, ok := ours[name]; !ok && isListSection {
+			delete(merged, name)
+		}
+	}
+	return merged
+}
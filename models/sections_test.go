@@ -0,0 +1,147 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrateFlatConfig(t *testing.T) {
+	flat := Sections{"": {
+		"hostAddress":  "192.168.1.20:80",
+		"plugName":     "Heating rod",
+		"kostalType":   "simulator",
+		"pollDuration": "30",
+		"custom":       "kept",
+	}}
+
+	migrated, version, err := Migrate(flat)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	if version != 1 {
+		t.Errorf("Expected version 1 but got %d", version)
+	}
+	expected := Sections{
+		"":                {"schemaVersion": "2", "custom": "kept"},
+		SectionGateway:    {"hostAddress": "192.168.1.20:80"},
+		SectionInverter:   {"kostalType": "simulator"},
+		SectionController: {"plugName": "Heating rod", "pollDuration": "30"},
+	}
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Errorf("Expected %v but got %v", expected, migrated)
+	}
+
+	_, _, err = Migrate(Sections{"": {"schemaVersion": "99"}})
+	if err == nil {
+		t.Error("Expected an error for a newer schema version")
+	}
+}
+
+func TestSectionsRoundTrip(t *testing.T) {
+	properties, _ := FromMapWithDefaults(map[string]string{"kostalAddress": "192.168.1.30"})
+	properties.Loads = []Load{{Name: "boiler", Light: "Boiler plug"}}
+	properties.Notifications = []NotificationTarget{{Name: "phone", Type: "webhook", URL: "http://example.com/hook"}}
+
+	for _, path := range []string{"config.ini", "config.yaml"} {
+		data, err := FormatSections(path, properties.ToSections())
+		if err != nil {
+			t.Fatalf("%s: Expected nil error but got %v", path, err)
+		}
+		sections, err := ParseSections(path, data)
+		if err != nil {
+			t.Fatalf("%s: Expected nil error but got %v", path, err)
+		}
+		parsed, err := FromSectionsWithDefaults(sections)
+		if err != nil {
+			t.Fatalf("%s: Expected nil error but got %v", path, err)
+		}
+		if !reflect.DeepEqual(parsed, properties) {
+			t.Errorf("%s: Expected %+v but got %+v", path, properties, parsed)
+		}
+	}
+}
+
+func TestMergeSections(t *testing.T) {
+	base := Sections{
+		SectionController: {"Threshold": "1000", "pollDuration": "10"},
+		"load.boiler":     {"light": "Boiler"},
+	}
+	// The app changed the threshold and removed the load
+	ours := Sections{
+		SectionController: {"Threshold": "2000", "pollDuration": "10"},
+	}
+	// Someone edited the poll duration by hand
+	theirs := Sections{
+		SectionController: {"Threshold": "1000", "pollDuration": "60"},
+		"load.boiler":     {"light": "Boiler"},
+	}
+
+	merged := MergeSections(base, ours, theirs)
+	expected := Sections{
+		SectionController: {"Threshold": "2000", "pollDuration": "60"},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v but got %v", expected, merged)
+	}
+}
+
+func TestNotificationSections(t *testing.T) {
+	data := []byte("[controller]\nThreshold = 1000\n\n[notification.phone]\ntype = webhook\nurl  = http://192.168.1.5/hook\n\n" +
+		"[notification.mail]\ntype = webhook\nurl = http://192.168.1.6/hook\n")
+	sections, err := ParseSections("config.ini", data)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: Every notification section is a target, sorted by name
+	properties, err := FromSectionsWithDefaults(sections)
+	expected := []NotificationTarget{
+		{Name: "mail", Type: "webhook", URL: "http://192.168.1.6/hook"},
+		{Name: "phone", Type: "webhook", URL: "http://192.168.1.5/hook"},
+	}
+	if err != nil || !reflect.DeepEqual(properties.Notifications, expected) {
+		t.Fatalf("Test case 1: Expected %v but got %v, %v", expected, properties.Notifications, err)
+	}
+
+	// Test case 2: The targets are written back to their sections
+	written := properties.ToSections()
+	if url, _ := written.Get(SectionNotificationPrefix+"phone", "url"); url != "http://192.168.1.5/hook" {
+		t.Errorf("Test case 2: Expected the url of phone but got %v", written)
+	}
+
+	// Test case 3: A target removed by the app is removed from the file
+	properties.Notifications = properties.Notifications[1:]
+	merged := MergeSections(sections, properties.ToSections(), sections)
+	if _, ok := merged[SectionNotificationPrefix+"mail"]; ok {
+		t.Errorf("Test case 3: Expected the section of mail to be removed but got %v", merged)
+	}
+	if _, ok := merged[SectionNotificationPrefix+"phone"]; !ok {
+		t.Errorf("Test case 3: Expected the section of phone to be kept but got %v", merged)
+	}
+
+	// Test case 4: Invalid URLs are reported
+	properties.Notifications[0].URL = "hook"
+	if errs := properties.Validate(); len(errs) != 1 || errs[0].Field != "notification.phone.url" {
+		t.Errorf("Test case 4: Expected an error for notification.phone.url but got %v", errs)
+	}
+}
+
+func TestSwitchedLoads(t *testing.T) {
+	// Test case 1: The plug of plugName is switched as default load
+	properties := &Properties{PlugName: "Heating rod", Loads: []Load{{Name: "pump", Light: "Pump plug"}}}
+	loads := properties.SwitchedLoads()
+	expected := []Load{
+		{Name: DefaultLoadName, Backend: ActuatorBackendDeconz, Light: "Heating rod"},
+		{Name: "pump", Light: "Pump plug"},
+	}
+	if !reflect.DeepEqual(loads, expected) {
+		t.Errorf("Test case 1: Expected %v but got %v", expected, loads)
+	}
+
+	// Test case 2: The plug of plugName is configured as load as well
+	properties.Loads = append(properties.Loads, Load{Name: "boiler", Light: "Heating rod"})
+	loads = properties.SwitchedLoads()
+	if len(loads) != 2 || loads[0].Name != "pump" || loads[1].Name != "boiler" {
+		t.Errorf("Test case 2: Expected the loads pump and boiler but got %v", loads)
+	}
+}
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MinPollDuration = 1
+	MaxPollDuration = 3600
+)
+
+// FieldError describes why the value of a single property is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldError := range e {
+		messages = append(messages, fieldError.Error())
+	}
+	return strings.Join(messages, ", ")
+}
+
+// Validate checks the ranges and the syntax of the properties. Properties that
+// are not configured yet, like an empty plug name, are not reported.
+func (p *Properties) Validate() ValidationErrors {
+	var errs ValidationErrors
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.PollDuration < MinPollDuration || p.PollDuration > MaxPollDuration {
+		add("pollDuration", "must be between %d and %d seconds", MinPollDuration, MaxPollDuration)
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil {
+			add("timezone", "unknown timezone %q, use e.g. Europe/Berlin", p.Timezone)
+		}
+	}
+	switch p.Filter {
+	case "", FilterNone, FilterAverage, FilterEMA, FilterMedian:
+	default:
+		add("filter", "unknown filter %q, use %s, %s, %s or %s", p.Filter, FilterNone, FilterAverage, FilterEMA, FilterMedian)
+	}
+	if p.FilterWindow < 0 || p.FilterWindow > 100 {
+		add("filterWindow", "must be 0 for the default or 1 to 100 samples")
+	}
+	if p.FilterAlpha < 0 || p.FilterAlpha > 1 {
+		add("filterAlpha", "must be greater than 0 and at most 1")
+	}
+	if p.SpikeThreshold < 0 {
+		add("spikeThreshold", "must not be negative")
+	}
+	if p.Threshold < 0 {
+		add("Threshold", "must not be negative")
+	}
+	if p.HostAddress != "" {
+		if err := ValidateAddress(p.HostAddress); err != nil {
+			add("hostAddress", "%s", err.Error())
+		}
+	}
+	if p.KostalAddress != "" {
+		if err := ValidateAddress(p.KostalAddress); err != nil {
+			add("kostalAddress", "%s", err.Error())
+		}
+	}
+
+	switch p.KostalType {
+	case "", InverterTypeKostal:
+	case InverterTypeSimulator:
+		if p.SimLatitude < -90 || p.SimLatitude > 90 {
+			add("simLatitude", "must be between -90 and 90 degrees")
+		}
+		if p.SimKWp <= 0 {
+			add("simKWp", "must be positive")
+		}
+		if p.SimCloudiness < 0 || p.SimCloudiness > 1 {
+			add("simCloudiness", "must be between 0 and 1")
+		}
+		if p.SimBaseLoad < 0 {
+			add("simBaseLoad", "must not be negative")
+		}
+		if p.SimTimeAcceleration <= 0 {
+			add("simTimeAcceleration", "must be positive")
+		}
+		if p.SimDate != "" {
+			if _, err := time.Parse("2006-01-02", p.SimDate); err != nil {
+				add("simDate", "must have the format YYYY-MM-DD")
+			}
+		}
+	case InverterTypeReplay:
+		if p.ReplayFile == "" {
+			add("replayFile", "is required for the replay inverter")
+		}
+	default:
+		add("kostalType", "unknown inverter type %q, use %s, %s or %s", p.KostalType,
+			InverterTypeKostal, InverterTypeSimulator, InverterTypeReplay)
+	}
+
+	if p.ForecastKWp < 0 {
+		add("forecastKWp", "must not be negative")
+	}
+	if p.ForecastKWp > 0 {
+		if p.ForecastLatitude < -90 || p.ForecastLatitude > 90 {
+			add("forecastLatitude", "must be between -90 and 90 degrees")
+		}
+		if p.ForecastLongitude < -180 || p.ForecastLongitude > 180 {
+			add("forecastLongitude", "must be between -180 and 180 degrees")
+		}
+		if p.ForecastTilt < 0 || p.ForecastTilt > 90 {
+			add("forecastTilt", "must be between 0 and 90 degrees")
+		}
+		if p.ForecastAzimuth < 0 || p.ForecastAzimuth > 360 {
+			add("forecastAzimuth", "must be between 0 and 360 degrees")
+		}
+	}
+	if p.ForecastURL != "" {
+		if parsed, err := url.Parse(p.ForecastURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			add("forecastUrl", "must be an http or https URL")
+		}
+		if p.ForecastKWp <= 0 {
+			add("forecastKWp", "is required for the forecast of forecastUrl")
+		}
+	}
+	if p.ForecastRefresh < 0 || (p.ForecastRefresh > 0 && p.ForecastRefresh < 15) {
+		add("forecastRefresh", "must be at least 15 minutes")
+	}
+
+	for _, load := range p.Loads {
+		// The flat keys and the fields of the errors are load.<name>.<key>, a
+		// dot in the name would make them ambiguous
+		if load.Name == "" || strings.Contains(load.Name, ".") {
+			add(SectionLoadPrefix+load.Name, "the name of a load must not be empty or contain a dot")
+		}
+		switch load.BackendOrDefault() {
+		case ActuatorBackendDeconz:
+			switch {
+			case load.Light == "" && load.UniqueID == "" && load.Group == "":
+				add(SectionLoadPrefix+load.Name+".light", "a light, a uniqueId or a group is required")
+			case (load.Light != "" || load.UniqueID != "") && load.Group != "":
+				add(SectionLoadPrefix+load.Name+".group", "must not be set together with a light")
+			case load.Scene != "" && load.Group == "":
+				add(SectionLoadPrefix+load.Name+".scene", "requires a group")
+			}
+		case ActuatorBackendShelly, ActuatorBackendShellyGen2, ActuatorBackendTasmota:
+			if load.Address == "" {
+				add(SectionLoadPrefix+load.Name+".address", "is required")
+			} else if err := ValidateAddress(load.Address); err != nil {
+				add(SectionLoadPrefix+load.Name+".address", "%s", err.Error())
+			}
+			if load.Channel < 0 {
+				add(SectionLoadPrefix+load.Name+".channel", "must not be negative")
+			}
+		default:
+			add(SectionLoadPrefix+load.Name+".backend", "unknown actuator backend %q, use %s, %s, %s or %s", load.Backend,
+				ActuatorBackendDeconz, ActuatorBackendShelly, ActuatorBackendShellyGen2, ActuatorBackendTasmota)
+		}
+		for key, value := range map[string]string{"allow": load.Allow, "forbid": load.Forbid} {
+			if _, err := ParseTimeWindows(value); err != nil {
+				add(SectionLoadPrefix+load.Name+"."+key, "%s", err.Error())
+			}
+		}
+		if _, err := ParseDateRanges(load.Season); err != nil {
+			add(SectionLoadPrefix+load.Name+".season", "%s", err.Error())
+		}
+		if load.MinRuntime < 0 || load.MinRuntime > 24*time.Hour {
+			add(SectionLoadPrefix+load.Name+".minRuntime", "must be between 0 and 24h")
+		}
+		if load.MinEnergy < 0 {
+			add(SectionLoadPrefix+load.Name+".minEnergy", "must not be negative")
+		}
+		if load.Deadline != "" {
+			if _, err := ParseClock(load.Deadline); err != nil {
+				add(SectionLoadPrefix+load.Name+".deadline", "must be a time of day like 20:00")
+			}
+		}
+		for key, value := range map[string]string{"onRule": load.OnRule, "offRule": load.OffRule} {
+			if value == "" {
+				continue
+			}
+			if _, err := ParseRule(value); err != nil {
+				add(SectionLoadPrefix+load.Name+"."+key, "%s", err.Error())
+			} else if load.IsProportional() {
+				add(SectionLoadPrefix+load.Name+"."+key, "rules require the switch mode")
+			}
+		}
+		switch load.Mode {
+		case "", LoadModeSwitch:
+		case LoadModeProportional:
+			field := SectionLoadPrefix + load.Name + "."
+			if load.BackendOrDefault() != ActuatorBackendDeconz {
+				add(field+"mode", "proportional mode requires a dimmable deconz light")
+			}
+			minLevel, maxLevel := load.LevelRange()
+			if minLevel < MinBrightness || minLevel > MaxBrightness {
+				add(field+"minLevel", "must be between %d and %d", MinBrightness, MaxBrightness)
+			}
+			if maxLevel < minLevel || maxLevel > MaxBrightness {
+				add(field+"maxLevel", "must be between minLevel and %d", MaxBrightness)
+			}
+			if load.MaxStep < 0 {
+				add(field+"maxStep", "must not be negative")
+			}
+			if load.Smoothing < 0 || load.Smoothing > 1 {
+				add(field+"smoothing", "must be greater than 0 and at most 1")
+			}
+			if load.MaxPower < 0 {
+				add(field+"maxPower", "must not be negative")
+			}
+		default:
+			add(SectionLoadPrefix+load.Name+".mode", "unknown mode %q, use %s or %s", load.Mode,
+				LoadModeSwitch, LoadModeProportional)
+		}
+	}
+	for _, target := range p.Notifications {
+		if target.Name == "" || strings.Contains(target.Name, ".") {
+			add(SectionNotificationPrefix+target.Name, "the name of a notification target must not be empty or contain a dot")
+		}
+		if target.URL != "" {
+			if parsed, err := url.Parse(target.URL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				add(SectionNotificationPrefix+target.Name+".url", "must be an absolute URL")
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateAddress checks that address is a host name or IP address with an
+// optional port and without a scheme, e.g. 192.168.1.20:80.
+func ValidateAddress(address string) error {
+	if strings.Contains(address, "://") {
+		return fmt.Errorf("must not contain a scheme like http://")
+	}
+	host := address
+	if strings.Contains(address, ":") && !(strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]")) &&
+		net.ParseIP(address) == nil {
+		var port string
+		var err error
+		host, port, err = net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber < 1 || portNumber > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return fmt.Errorf("host is missing")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid host name %q", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("invalid host name %q", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	properties, err := FromMapWithDefaults(map[string]string{})
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+
+	// Test case 1: The defaults are valid
+	if errs := properties.Validate(); len(errs) != 0 {
+		t.Errorf("Test case 1: Expected no errors but got %v", errs)
+	}
+
+	// Test case 2: Every invalid field is reported
+	properties.PollDuration = 0
+	properties.Threshold = -1
+	properties.KostalAddress = "http://192.168.1.10"
+	properties.KostalType = "unknown"
+	errs := properties.Validate()
+	fields := map[string]bool{}
+	for _, fieldError := range errs {
+		fields[fieldError.Field] = true
+	}
+	for _, field := range []string{"pollDuration", "Threshold", "kostalAddress", "kostalType"} {
+		if !fields[field] {
+			t.Errorf("Test case 2: Expected an error for %s but got %v", field, errs)
+		}
+	}
+
+	// Test case 3: Unparsable numbers are reported as field errors
+	_, err = FromMapWithDefaults(map[string]string{"pollDuration": "ten"})
+	if fieldErrors, ok := err.(ValidationErrors); !ok || fieldErrors[0].Field != "pollDuration" {
+		t.Errorf("Test case 3: Expected a field error for pollDuration but got %v", err)
+	}
+
+	// Test case 4: The external forecast needs an http URL and the PV system
+	properties, _ = FromMapWithDefaults(map[string]string{"forecastUrl": "ftp://api.forecast.solar", "forecastRefresh": "5"})
+	fields = map[string]bool{}
+	for _, fieldError := range properties.Validate() {
+		fields[fieldError.Field] = true
+	}
+	for _, field := range []string{"forecastUrl", "forecastKWp", "forecastRefresh"} {
+		if !fields[field] {
+			t.Errorf("Test case 4: Expected an error for %s but got %v", field, fields)
+		}
+	}
+
+	// Test case 5: The name of a load must not contain a dot
+	properties, _ = FromMapWithDefaults(map[string]string{})
+	properties.Loads = []Load{{Name: "boiler.top", Light: "Boiler plug"}}
+	if errs := properties.Validate(); len(errs) != 1 || errs[0].Field != "load.boiler.top" {
+		t.Errorf("Test case 5: Expected an error for the name of the load but got %v", errs)
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	valid := []string{"192.168.1.20", "192.168.1.20:80", "phoscon.local", "deconz:8080", "[fe80::1]:80", "fe80::1"}
+	for _, address := range valid {
+		if err := ValidateAddress(address); err != nil {
+			t.Errorf("Expected %s to be valid but got %v", address, err)
+		}
+	}
+	invalid := []string{"http://192.168.1.20", "192.168.1.20:", "192.168.1.20:99999", ":80", "my host", "host..local"}
+	for _, address := range invalid {
+		if err := ValidateAddress(address); err == nil {
+			t.Errorf("Expected %s to be invalid", address)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package safefile
+
+import "sync"
+
+var locks sync.Map
+
+// Lock takes an exclusive lock on path. On this platform the lock only works
+// within the process. The returned function releases the lock.
+func Lock(path string) (func(), error) {
+	mutex, _ := locks.LoadOrStore(path, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock, nil
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package safefile
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock takes an exclusive lock on path, which is shared with other processes,
+// e.g. the command line tool changing the config while the server runs. The
+// lock is held on a separate file path.lock, since the file itself is replaced
+// on every write. The returned function releases the lock.
+func Lock(path string) (func(), error) {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
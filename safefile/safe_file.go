@@ -0,0 +1,124 @@
+package safefile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the file at path atomically: the data is written to a
+// temporary file in the same directory, synced to disk and renamed over the
+// old file, so a crash leaves either the old or the new file, never a partial
+// one. Before that the old file is kept as path.1, older versions are rotated
+// up to path.<backups>.
+//
+// WriteFile does not lock the file, use Lock to serialize concurrent writers.
+func WriteFile(path string, data []byte, perm os.FileMode, backups int) error {
+	if backups > 0 {
+		err := rotateBackups(path, backups)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		// Only left over if something went wrong
+		os.Remove(tmpName)
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", tmpName, err)
+	}
+	err = os.Chmod(tmpName, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Backups returns the paths of the existing backups of path, newest first.
+func Backups(path string, backups int) []string {
+	var paths []string
+	for i := 1; i <= backups; i++ {
+		backupPath := backupName(path, i)
+		if _, err := os.Stat(backupPath); err == nil {
+			paths = append(paths, backupPath)
+		}
+	}
+	return paths
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// rotateBackups moves path.1 to path.2 and so on and copies the current file
+// to path.1. Empty files are not kept as backup, they are what a crash during
+// a non-atomic write leaves behind.
+func rotateBackups(path string, backups int) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backupName(path, i), backupName(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return copyFile(path, backupName(path, 1), info.Mode().Perm())
+}
+
+func copyFile(source string, target string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes the rename durable. Not every platform supports syncing a
+// directory, which is not treated as an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,92 @@
+package safefile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteFileRotatesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	for _, content := range []string{"one", "two", "three", "four"} {
+		err := WriteFile(path, []byte(content), 0600, 2)
+		if err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "four",
+		path + ".1": "three",
+		path + ".2": "two",
+	}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Expected nil error but got %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to contain %q but got %q", file, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups but got %s", path+".3")
+	}
+
+	backups := Backups(path, 5)
+	if !reflect.DeepEqual(backups, []string{path + ".1", path + ".2"}) {
+		t.Errorf("Expected 2 backups newest first but got %v", backups)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 3 {
+		t.Errorf("Expected no temporary files to be left but got %d files", len(entries))
+	}
+}
+
+func TestWriteFileSkipsEmptyBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	err := os.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteFile(path, []byte("new"), 0600, 2)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	if backups := Backups(path, 2); len(backups) != 0 {
+		t.Errorf("Expected an empty file not to be kept as backup but got %v", backups)
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	unlock, err := Lock(path)
+	if err != nil {
+		t.Fatalf("Expected nil error but got %v", err)
+	}
+	locked := make(chan error, 1)
+	go func() {
+		unlockSecond, err := Lock(path)
+		if err == nil {
+			unlockSecond()
+		}
+		locked <- err
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("Expected the second lock to wait for the first one but got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Errorf("Expected nil error but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second lock to be acquired after the first one was released")
+	}
+}
@@ -78,6 +78,10 @@ function App() {
                 setTitle("Kostal Authentication");
                 showPrimaryToast(response.StatusMessage);
                 break;
+            case InitStatus.ActuatorUnreachable:
+                setTitle("Start Page");
+                toast.error(response.StatusMessage);
+                break;
             case InitStatus.Error:
                 setTitle("Error");
                 toast.error("Error: " + response.StatusMessage);
@@ -116,7 +120,7 @@ function App() {
                 reverseOrder={true}
             />
             {(initStatus ===InitStatus.Login || localStorage.getItem("user") === null) && <LoginPage onLogin={login}/>}
-            {initStatus === InitStatus.Ok && <StartPage client={localClient} isConnected={localClient !== null} onStatusResponse={statusResponse}/>}
+            {(initStatus === InitStatus.Ok || initStatus === InitStatus.ActuatorUnreachable) && <StartPage client={localClient} isConnected={localClient !== null} onStatusResponse={statusResponse}/>}
             {initStatus === InitStatus.DeconzAuth &&
                 <DeconzAuthPage client={localClient} onStatusResponse={statusResponse}/>}
             {initStatus === InitStatus.Config && <ConfigPage client={localClient} onStatusResponse={statusResponse}/>}
@@ -8,6 +8,7 @@ const StartPage = ({isConnected, client, onStatusResponse}) => {
     const [housePowerConsumption, setHousePowerConsumption] = useState(0)
     const [pvPowerGenerated, setPvPowerGenerated] = useState(0)
     const [gridOut, setGridOut] = useState(0)
+    const [forecastPVPower, setForecastPVPower] = useState(null)
     const [socketState, setSocketState] = useState(false)
     const [enabled, setEnabled] = useState(false)
 
@@ -26,6 +27,8 @@ const StartPage = ({isConnected, client, onStatusResponse}) => {
             setHousePowerConsumption(tmpHousePowerConsumption)
             setPvPowerGenerated(tmpPvPowerGenerated)
             setGridOut(tmpGridOut)
+            setForecastPVPower(response.inverterData.ForecastPVPower != null ?
+                Math.round(response.inverterData.ForecastPVPower) : null)
             setSocketState(response.socketState)
         })
         client.subscribe("monitoring", (response) => {
@@ -76,6 +79,11 @@ const StartPage = ({isConnected, client, onStatusResponse}) => {
                                 <td>Overproduction</td>
                                 <td style={{color: gridOut < 0 ? "red" : "green"}}>{gridOut} Watt</td>
                             </tr>
+                            {forecastPVPower !== null &&
+                                <tr>
+                                    <td>PV Forecast (next hour)</td>
+                                    <td>{forecastPVPower} Watt</td>
+                                </tr>}
                             </tbody>
                         </Table>
                     </Col>
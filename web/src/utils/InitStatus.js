@@ -5,6 +5,7 @@ const InitStatus = {
     Error: 3,
     KostalAuth: 4,
     Login: 5,
+    ActuatorUnreachable: 6,
 };
 
 export default InitStatus;
\ No newline at end of file
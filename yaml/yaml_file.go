@@ -0,0 +1,92 @@
+package yaml
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// ParseSections parses YAML data into a map of sections. Top level scalars are
+// stored in the section "", nested mappings are flattened into sections with
+// dotted names, e.g. load.boiler for
+//
+//	load:
+//	  boiler:
+//	    light: Boiler
+func ParseSections(data []byte) (map[string]map[string]string, error) {
+	var document map[string]interface{}
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("error loading YAML file: %v", err)
+	}
+
+	sections := make(map[string]map[string]string)
+	err = flatten(sections, "", document)
+	if err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+func flatten(sections map[string]map[string]string, name string, values map[string]interface{}) error {
+	for key, value := range values {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			child := key
+			if name != "" {
+				child = name + "." + key
+			}
+			if _, ok := sections[child]; !ok {
+				sections[child] = make(map[string]string)
+			}
+			err := flatten(sections, child, value)
+			if err != nil {
+				return err
+			}
+		case []interface{}:
+			return fmt.Errorf("error loading YAML file: lists are not supported, found one at %s", key)
+		default:
+			if _, ok := sections[name]; !ok {
+				sections[name] = make(map[string]string)
+			}
+			if value == nil {
+				sections[name][key] = ""
+			} else {
+				sections[name][key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return nil
+}
+
+// FormatSections creates YAML data from a map of sections, sections with
+// dotted names are written as nested mappings.
+func FormatSections(sections map[string]map[string]string) ([]byte, error) {
+	document := make(map[string]interface{})
+	for name, values := range sections {
+		target := document
+		if name != "" {
+			for _, part := range strings.Split(name, ".") {
+				child, ok := target[part].(map[string]interface{})
+				if !ok {
+					child = make(map[string]interface{})
+					target[part] = child
+				}
+				target = child
+			}
+		}
+		for key, value := range values {
+			target[key] = value
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(document)
+	if err != nil {
+		return nil, fmt.Errorf("error writing YAML file: %v", err)
+	}
+	return buffer.Bytes(), nil
+}